@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -10,6 +11,9 @@ import (
 	"os"
 	"zenhack.net/go/irc-idler/internal/netextra"
 	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/charset"
+	"zenhack.net/go/irc-idler/irc/filters"
+	"zenhack.net/go/irc-idler/irc/sasl"
 	ircproxy "zenhack.net/go/irc-idler/proxy"
 	sqlstore "zenhack.net/go/irc-idler/storage/sql"
 )
@@ -23,6 +27,35 @@ var (
 
 	// TODO: default should probably be `true`.
 	useTLS = flag.Bool("tls", false, "Connect via tls.")
+
+	tlsCert = flag.String("tls-cert", "", "PEM file with a client certificate to present "+
+		"to the server (requires -tls)")
+	tlsKey = flag.String("tls-key", "", "PEM file with the private key for -tls-cert")
+
+	saslMech = flag.String("sasl-mech", "", "SASL mechanism to authenticate with "+
+		"{PLAIN,EXTERNAL,SCRAM-SHA-256}. SASL is not used if unspecified")
+	saslUser = flag.String("sasl-user", "", "SASL account name")
+	saslPass = flag.String("sasl-pass", "", "SASL password")
+
+	charsetName = flag.String("charset", "utf-8", "Character encoding used by the server "+
+		"{utf-8,latin1,cp1252,cp1251}")
+	fallbackCharset = flag.String("fallback-charset", "", "Decode text from the server "+
+		"that isn't valid UTF-8 using this encoding, instead of -charset. Text sent to "+
+		"the server is UTF-8")
+
+	ctcpReplies = flag.Bool("ctcp-replies", true, "Answer CTCP VERSION, PING, etc. "+
+		"while no client is connected")
+
+	replayTimestamps = flag.Bool("replay-timestamps", true, "Add the time to the text "+
+		"of messages replayed to clients which don't support server-time")
+	replayTimeFormat = flag.String("replay-time-format", ircproxy.DefaultReplayTimeFormat,
+		"Format of the time added by -replay-timestamps, as for Go's time.Time.Format")
+
+	floodBurst = flag.Int("flood-burst", filters.DefaultFloodControl.Burst,
+		"Number of bytes that may be sent to the server at once")
+	floodRate = flag.Int("flood-rate", filters.DefaultFloodControl.Rate,
+		"Number of bytes per second that may be sent to the server in the long run "+
+			"(0 for no limit)")
 )
 
 func checkFatal(err error) {
@@ -61,10 +94,53 @@ func main() {
 
 	var dialer netextra.Dialer
 	if *useTLS {
-		dialer = &netextra.TLSDialer{netextra.Direct}
+		tlsDialer := &netextra.TLSDialer{Base: netextra.Direct}
+		if *tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				logger.Fatalln("Failed to load client certificate:", err)
+			}
+			tlsDialer.ClientCert = &cert
+		}
+		dialer = tlsDialer
 	} else {
 		dialer = netextra.Direct
 	}
+
+	config := &ircproxy.Config{
+		DisableCTCPReplies: !*ctcpReplies,
+		FloodControl: &filters.FloodControl{
+			Burst: *floodBurst,
+			Rate:  *floodRate,
+		},
+		ReplayTimeFormat:        *replayTimeFormat,
+		DisableReplayTimestamps: !*replayTimestamps,
+	}
+	if *saslMech != "" {
+		config.SASL = &sasl.Credentials{
+			Mechanism: *saslMech,
+			Username:  *saslUser,
+			Password:  *saslPass,
+		}
+		// Make sure the mechanism is one we know about:
+		if _, err = config.SASL.NewMechanism(); err != nil {
+			logger.Fatalln(err)
+		}
+	}
+	var serverCharset charset.Charset
+	if *fallbackCharset != "" {
+		serverCharset, err = charset.Lookup(*fallbackCharset)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		serverCharset = charset.Fallback(serverCharset)
+	} else {
+		serverCharset, err = charset.Lookup(*charsetName)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
 	l, err := net.Listen("tcp", *laddr)
 	if err != nil {
 		logger.Fatal(err)
@@ -75,7 +151,8 @@ func main() {
 		Dialer:  dialer,
 		Network: "tcp",
 		Addr:    *raddr,
+		Charset: serverCharset,
 	}
 	go ircproxy.AcceptLoop(l, clientConns, logger)
-	ircproxy.NewProxy(logger, sqlstore.NewStore(db), clientConns, connector).Run()
+	ircproxy.NewProxy(logger, sqlstore.NewStore(db), clientConns, connector, config).Run()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"github.com/Sirupsen/logrus"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"zenhack.net/go/irc-idler/internal/netextra"
 	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/charset"
 	"zenhack.net/go/irc-idler/proxy"
 	"zenhack.net/go/irc-idler/sandstorm/webui"
 	sqlstore "zenhack.net/go/irc-idler/storage/sql"
@@ -159,7 +161,19 @@ func main() {
 		var dialer netextra.Dialer
 		dialer = &ip.IpNetworkDialer{ctx, *ipNetwork}
 		if serverConfig.TLS {
-			dialer = &netextra.TLSDialer{dialer}
+			tlsDialer := &netextra.TLSDialer{Base: dialer}
+			if serverConfig.ClientCert != "" {
+				cert, err := tls.X509KeyPair(
+					[]byte(serverConfig.ClientCert),
+					[]byte(serverConfig.ClientKey))
+				if err != nil {
+					// The web ui validates this, so this shouldn't happen.
+					logger.Errorln("Failed to load client certificate:", err)
+				} else {
+					tlsDialer.ClientCert = &cert
+				}
+			}
+			dialer = tlsDialer
 		}
 		daemon = proxy.NewProxy(
 			logger,
@@ -169,7 +183,9 @@ func main() {
 				Dialer:  dialer,
 				Network: "tcp",
 				Addr:    serverConfig.String(),
+				Charset: serverConfig.Charset(),
 			},
+			&proxy.Config{SASL: serverConfig.SASLCredentials()},
 		)
 		go daemon.Run()
 	}
@@ -209,7 +225,11 @@ func main() {
 				conn.Close()
 			} else {
 				logger.Debugln("Sending client connection to daemon.")
-				daemonClientConns <- irc.NewReadWriteCloser(conn)
+				daemonClientConns <- irc.NewReadWriteCloserOptions(conn,
+					irc.Options{
+						Charset:    charset.UTF8,
+						MaxLineLen: proxy.ClientMaxLineLen,
+					})
 			}
 		case backend.GetServerConfig <- serverConfig:
 		case backend.HaveNetwork <- ipNetwork != nil:
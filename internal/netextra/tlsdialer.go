@@ -9,6 +9,10 @@ import (
 // it is passed.
 type TLSDialer struct {
 	Base Dialer
+
+	// If non-nil, a client certificate to present to the server. This is
+	// what SASL EXTERNAL authenticates with.
+	ClientCert *tls.Certificate
 }
 
 // Dial invokes d.Base.Dial, and then establishes a TLS session over the
@@ -19,6 +23,9 @@ func (d *TLSDialer) Dial(network, addr string) (net.Conn, error) {
 	cfg := &tls.Config{
 		ServerName: host,
 	}
+	if d.ClientCert != nil {
+		cfg.Certificates = []tls.Certificate{*d.ClientCert}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -21,7 +21,7 @@ func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
 // Verify that TLSDialer closes the underlying connection if a handshake fails.
 func TestHandshakeErrorClosesConn(t *testing.T) {
 	done := make(chan struct{})
-	tlsDialer := &TLSDialer{&pipeDialer{func(conn net.Conn) {
+	tlsDialer := &TLSDialer{Base: &pipeDialer{func(conn net.Conn) {
 		go io.Copy(ioutil.Discard, conn)
 		buf := make([]byte, 4096)
 		err := error(nil)
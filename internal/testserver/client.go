@@ -0,0 +1,104 @@
+package testserver
+
+// This file provides Client, a minimal client for driving tests.
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// How long a Client waits for a message before failing the test.
+const clientTimeout = 5 * time.Second
+
+// A Client is a scripted IRC client, for tests. Its methods fail the test
+// (via t.Fatal) if anything goes wrong, so they must be called from the
+// test's goroutine.
+type Client struct {
+	t      testing.TB
+	conn   irc.ReadWriteCloser
+	stream *irc.Stream
+}
+
+// NewClient returns a Client speaking over `conn`, which may be connected to
+// a Server or anything else (e.g. a proxy).
+func NewClient(t testing.TB, conn irc.ReadWriteCloser) *Client {
+	return &Client{
+		t:      t,
+		conn:   conn,
+		stream: irc.NewStream(context.Background(), conn),
+	}
+}
+
+// Register sends NICK and USER, and waits for the end of the MOTD (or
+// ERR_NOMOTD).
+func (c *Client) Register(nick string) {
+	c.Send("NICK " + nick)
+	c.Send("USER " + nick + " 0 * :Test User")
+	c.Expect(irc.RPL_WELCOME)
+	for {
+		switch c.Read().Command {
+		case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
+			return
+		}
+	}
+}
+
+// Send parses `line` (without the trailing CRLF) and sends it.
+func (c *Client) Send(line string) {
+	msg, err := irc.ParseMessage(line + "\r\n")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Read returns the next message received. PINGs are answered and skipped,
+// so that the peer doesn't time us out while a test is busy elsewhere.
+func (c *Client) Read() *irc.Message {
+	timeout := time.After(clientTimeout)
+	for {
+		select {
+		case msg, ok := <-c.stream.C:
+			if !ok {
+				c.t.Fatalf("Connection closed: %v", c.stream.Err())
+			}
+			if msg.Command != "PING" {
+				return msg
+			}
+			err := c.conn.WriteMessage(&irc.Message{Command: "PONG", Params: msg.Params})
+			if err != nil {
+				c.t.Fatal(err)
+			}
+		case <-timeout:
+			c.t.Fatal("Timed out waiting for a message.")
+		}
+	}
+}
+
+// Expect reads a message, failing unless its command is `command`.
+func (c *Client) Expect(command string) *irc.Message {
+	msg := c.Read()
+	if msg.Command != command {
+		c.t.Fatalf("Expected a %s message, but got %q.", command, msg)
+	}
+	return msg
+}
+
+// SkipTo reads messages until one with the command `command`, and returns
+// it.
+func (c *Client) SkipTo(command string) *irc.Message {
+	for {
+		if msg := c.Read(); msg.Command == command {
+			return msg
+		}
+	}
+}
+
+// Close closes the connection.
+func (c *Client) Close() {
+	c.conn.Close()
+}
@@ -0,0 +1,416 @@
+package testserver
+
+// This file implements the commands the server understands.
+
+import (
+	"strings"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// Characters which may not appear in nicks, besides control characters.
+const badNickChars = " ,*?!@.:#&$"
+
+// Handle a message from `u`. Must be called with s.lock held.
+func (s *Server) handle(u *user, msg *irc.Message) {
+	if err := msg.ValidateFor(u.target()); err != nil {
+		err.Prefix = s.Name
+		s.send(u, (*irc.Message)(err))
+		return
+	}
+	switch msg.Command {
+	case "CAP":
+		s.handleCap(u, msg)
+		return
+	case "NICK":
+		s.handleNick(u, msg.Params[0])
+		return
+	case "USER":
+		if u.registered || u.id.User != "" {
+			s.reply(u, irc.ERR_ALREADYREGISTERED, "You may not reregister")
+			return
+		}
+		u.id.User = msg.Params[0]
+		u.realName = msg.Params[3]
+		s.tryRegister(u)
+		return
+	case "PING":
+		s.send(u, &irc.Message{
+			Prefix:  s.Name,
+			Command: "PONG",
+			Params:  []string{s.Name, msg.Params[0]},
+		})
+		return
+	case "PONG":
+		return
+	case "QUIT":
+		reason := "Client Quit"
+		if len(msg.Params) > 0 && msg.Params[0] != "" {
+			reason = "Quit: " + msg.Params[0]
+		}
+		s.quit(u, reason)
+		return
+	}
+
+	if !u.registered {
+		s.reply(u, irc.ERR_NOTREGISTERED, "You have not registered")
+		return
+	}
+	switch msg.Command {
+	case "NAMES":
+		s.handleNames(u, msg)
+		return
+	case "MODE":
+		s.handleMode(u, msg)
+		return
+	case "MOTD":
+		s.motd(u)
+		return
+	}
+	cmd, err := irc.ParseCommand(msg)
+	if err != nil {
+		// ValidateFor should have caught this.
+		s.reply(u, irc.ERR_NEEDMOREPARAMS, msg.Command, "Not enough parameters")
+		return
+	}
+	switch cmd := cmd.(type) {
+	case *irc.Join:
+		for _, name := range cmd.Channels {
+			s.join(u, name)
+		}
+	case *irc.Part:
+		for _, name := range cmd.Channels {
+			s.part(u, name, cmd.Reason)
+		}
+	case *irc.Kick:
+		s.kick(u, cmd)
+	case *irc.Topic:
+		s.topic(u, cmd)
+	case *irc.Privmsg:
+		s.privmsg(u, cmd)
+	default:
+		s.reply(u, irc.ERR_UNKNOWNCOMMAND, msg.Command, "Unknown command")
+	}
+}
+
+// Handle a CAP command. We don't support any capabilities, but clients
+// which start negotiation expect it to finish properly.
+func (s *Server) handleCap(u *user, msg *irc.Message) {
+	capReply := func(params ...string) {
+		s.send(u, &irc.Message{
+			Prefix:  s.Name,
+			Command: "CAP",
+			Params:  append([]string{u.target()}, params...),
+		})
+	}
+	switch strings.ToUpper(msg.Params[0]) {
+	case "LS":
+		if !u.registered {
+			u.negotiatingCaps = true
+		}
+		capReply("LS", "")
+	case "LIST":
+		capReply("LIST", "")
+	case "REQ":
+		if len(msg.Params) < 2 {
+			s.reply(u, irc.ERR_NEEDMOREPARAMS, "CAP", "Not enough parameters")
+			return
+		}
+		if !u.registered {
+			u.negotiatingCaps = true
+		}
+		capReply("NAK", msg.Params[1])
+	case "END":
+		u.negotiatingCaps = false
+		s.tryRegister(u)
+	default:
+		s.reply(u, irc.ERR_INVALIDCAPCMD, msg.Params[0], "Invalid CAP command")
+	}
+}
+
+func (s *Server) handleNick(u *user, nick string) {
+	if !validNick(nick) {
+		s.reply(u, irc.ERR_ERRONEUSNICKNAME, nick, "Erroneous nickname")
+		return
+	}
+	if other, ok := s.users[fold(nick)]; ok && other != u {
+		s.reply(u, irc.ERR_NICKNAMEINUSE, nick, "Nickname is already in use")
+		return
+	}
+	if !u.registered {
+		u.id.Nick = nick
+		s.tryRegister(u)
+		return
+	}
+	msg := (&irc.Nick{Prefix: u.id.String(), Nick: nick}).ToMessage()
+	delete(s.users, fold(u.id.Nick))
+	u.id.Nick = nick
+	s.users[fold(nick)] = u
+	s.sendToPeers(u, msg)
+}
+
+func validNick(nick string) bool {
+	if nick == "" || len(nick) > 30 || strings.ContainsAny(nick, badNickChars) {
+		return false
+	}
+	if nick[0] == '-' || (nick[0] >= '0' && nick[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(nick); i++ {
+		if nick[i] < ' ' || nick[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete registration if the user has supplied everything needed.
+func (s *Server) tryRegister(u *user) {
+	if u.registered || u.id.Nick == "" || u.id.User == "" || u.negotiatingCaps {
+		return
+	}
+	if _, ok := s.users[fold(u.id.Nick)]; ok {
+		// Someone else registered with this nick in the meantime.
+		s.reply(u, irc.ERR_NICKNAMEINUSE, u.id.Nick, "Nickname is already in use")
+		u.id.Nick = ""
+		return
+	}
+	u.registered = true
+	s.users[fold(u.id.Nick)] = u
+
+	s.reply(u, irc.RPL_WELCOME, "Welcome to the test network "+u.id.String())
+	s.reply(u, irc.RPL_YOURHOST, "Your host is "+s.Name+", running testserver")
+	s.reply(u, irc.RPL_CREATED, "This server was created just now")
+	s.reply(u, irc.RPL_MYINFO, s.Name, "testserver", "i", "ov")
+	s.reply(u, irc.RPL_ISUPPORT,
+		"CASEMAPPING="+irc.CaseMappingRFC1459,
+		"CHANTYPES=#",
+		"PREFIX=(ov)@+",
+		"NETWORK=TestNet",
+		"are supported by this server")
+	s.motd(u)
+}
+
+// Send the message of the day to `u`.
+func (s *Server) motd(u *user) {
+	if len(s.MOTD) == 0 {
+		s.reply(u, irc.ERR_NOMOTD, "MOTD File is missing")
+		return
+	}
+	s.reply(u, irc.RPL_MOTDSTART, "- "+s.Name+" Message of the day -")
+	for _, line := range s.MOTD {
+		s.reply(u, irc.RPL_MOTD, "- "+line)
+	}
+	s.reply(u, irc.RPL_ENDOFMOTD, "End of /MOTD command.")
+}
+
+// Look up the channel named `name`, replying with `code` (e.g.
+// ERR_NOSUCHCHANNEL) if it doesn't exist.
+func (s *Server) getChannel(u *user, name, code string) (*channel, bool) {
+	ch, ok := s.channels[fold(name)]
+	if !ok {
+		s.reply(u, code, name, "No such channel")
+	}
+	return ch, ok
+}
+
+// Look up the channel named `name`, replying with an error unless it exists
+// and `u` is in it.
+func (s *Server) memberChannel(u *user, name string) (*channel, bool) {
+	ch, ok := s.getChannel(u, name, irc.ERR_NOSUCHCHANNEL)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := ch.members[u]; !ok {
+		s.reply(u, irc.ERR_NOTONCHANNEL, ch.name, "You're not on that channel")
+		return nil, false
+	}
+	return ch, true
+}
+
+// Send `msg` to every member of `ch` other than `except`, which may be nil.
+func (s *Server) sendToChannel(ch *channel, except *user, msg *irc.Message) {
+	for member := range ch.members {
+		if member != except {
+			s.send(member, msg)
+		}
+	}
+}
+
+func (s *Server) join(u *user, name string) {
+	if !strings.HasPrefix(name, "#") || len(name) < 2 || strings.ContainsAny(name, " ,\x07") {
+		s.reply(u, irc.ERR_NOSUCHCHANNEL, name, "No such channel")
+		return
+	}
+	ch, ok := s.channels[fold(name)]
+	if !ok {
+		ch = &channel{name: name, members: make(map[*user]string)}
+		s.channels[fold(name)] = ch
+	}
+	if _, ok := ch.members[u]; ok {
+		return
+	}
+	prefix := ""
+	if len(ch.members) == 0 {
+		prefix = "@"
+	}
+	ch.members[u] = prefix
+	u.channels[ch] = struct{}{}
+
+	join := &irc.Join{Prefix: u.id.String(), Channels: []string{ch.name}}
+	s.sendToChannel(ch, nil, join.ToMessage())
+	if ch.topic != "" {
+		s.reply(u, irc.RPL_TOPIC, ch.name, ch.topic)
+	}
+	s.names(u, ch)
+}
+
+func (s *Server) part(u *user, name, reason string) {
+	ch, ok := s.memberChannel(u, name)
+	if !ok {
+		return
+	}
+	part := &irc.Part{Prefix: u.id.String(), Channels: []string{ch.name}, Reason: reason}
+	s.sendToChannel(ch, nil, part.ToMessage())
+	ch.remove(u)
+	if len(ch.members) == 0 {
+		delete(s.channels, fold(ch.name))
+	}
+}
+
+func (s *Server) kick(u *user, cmd *irc.Kick) {
+	ch, ok := s.memberChannel(u, cmd.Channel)
+	if !ok {
+		return
+	}
+	if ch.members[u] != "@" {
+		s.reply(u, irc.ERR_CHANOPRIVSNEEDED, ch.name, "You're not channel operator")
+		return
+	}
+	target, ok := s.users[fold(cmd.Nick)]
+	if _, in := ch.members[target]; !ok || !in {
+		s.reply(u, irc.ERR_USERNOTINCHANNEL, cmd.Nick, ch.name, "They aren't on that channel")
+		return
+	}
+	reason := cmd.Reason
+	if reason == "" {
+		reason = u.id.Nick
+	}
+	kick := &irc.Kick{
+		Prefix:  u.id.String(),
+		Channel: ch.name,
+		Nick:    target.id.Nick,
+		Reason:  reason,
+	}
+	s.sendToChannel(ch, nil, kick.ToMessage())
+	ch.remove(target)
+}
+
+func (s *Server) topic(u *user, cmd *irc.Topic) {
+	if !cmd.Set {
+		ch, ok := s.getChannel(u, cmd.Channel, irc.ERR_NOSUCHCHANNEL)
+		if !ok {
+			return
+		}
+		if ch.topic == "" {
+			s.reply(u, irc.RPL_NOTOPIC, ch.name, "No topic is set.")
+		} else {
+			s.reply(u, irc.RPL_TOPIC, ch.name, ch.topic)
+		}
+		return
+	}
+	ch, ok := s.memberChannel(u, cmd.Channel)
+	if !ok {
+		return
+	}
+	ch.topic = cmd.Topic
+	topic := &irc.Topic{Prefix: u.id.String(), Channel: ch.name, Set: true, Topic: cmd.Topic}
+	s.sendToChannel(ch, nil, topic.ToMessage())
+}
+
+func (s *Server) privmsg(u *user, cmd *irc.Privmsg) {
+	// Errors are never sent in response to a NOTICE:
+	reply := func(code string, params ...string) {
+		if !cmd.Notice {
+			s.reply(u, code, params...)
+		}
+	}
+	if cmd.Text == "" {
+		reply(irc.ERR_NOTEXTTOSEND, "No text to send")
+		return
+	}
+	msg := &irc.Privmsg{
+		Prefix: u.id.String(),
+		Notice: cmd.Notice,
+		Target: cmd.Target,
+		Text:   cmd.Text,
+	}
+	if strings.HasPrefix(cmd.Target, "#") {
+		ch, ok := s.channels[fold(cmd.Target)]
+		if !ok {
+			reply(irc.ERR_NOSUCHNICK, cmd.Target, "No such nick/channel")
+			return
+		}
+		if _, ok := ch.members[u]; !ok {
+			reply(irc.ERR_CANNOTSENDTOCHAN, ch.name, "Cannot send to channel")
+			return
+		}
+		s.sendToChannel(ch, u, msg.ToMessage())
+		return
+	}
+	target, ok := s.users[fold(cmd.Target)]
+	if !ok {
+		reply(irc.ERR_NOSUCHNICK, cmd.Target, "No such nick/channel")
+		return
+	}
+	s.send(target, msg.ToMessage())
+}
+
+// Handle a MODE command. There are no modes to change, so this only answers
+// queries.
+func (s *Server) handleMode(u *user, msg *irc.Message) {
+	target := msg.Params[0]
+	if !strings.HasPrefix(target, "#") {
+		if fold(target) != fold(u.id.Nick) {
+			s.reply(u, irc.ERR_USERSDONTMATCH, "Can't change mode for other users")
+		} else if len(msg.Params) == 1 {
+			s.reply(u, irc.RPL_UMODEIS, "+")
+		}
+		// Changes to our own modes are silently ignored.
+		return
+	}
+	ch, ok := s.getChannel(u, target, irc.ERR_NOSUCHCHANNEL)
+	if !ok {
+		return
+	}
+	if len(msg.Params) == 1 {
+		s.reply(u, irc.RPL_CHANNELMODEIS, ch.name, "+")
+		return
+	}
+	if modes := strings.Trim(msg.Params[1], "+-"); modes != "" {
+		s.reply(u, irc.ERR_UNKNOWNMODE, modes[:1], "is unknown mode char to me")
+	}
+}
+
+func (s *Server) handleNames(u *user, msg *irc.Message) {
+	if len(msg.Params) == 0 || msg.Params[0] == "" {
+		s.reply(u, irc.RPL_ENDOFNAMES, "*", "End of /NAMES list.")
+		return
+	}
+	for _, name := range strings.Split(msg.Params[0], ",") {
+		if ch, ok := s.channels[fold(name)]; ok {
+			s.names(u, ch)
+		} else {
+			s.reply(u, irc.RPL_ENDOFNAMES, name, "End of /NAMES list.")
+		}
+	}
+}
+
+// Send the names in `ch` to `u`.
+func (s *Server) names(u *user, ch *channel) {
+	names := make([]string, 0, len(ch.members))
+	for member, prefix := range ch.members {
+		names = append(names, prefix+member.id.Nick)
+	}
+	s.reply(u, irc.RPL_NAMEREPLY, "=", ch.name, strings.Join(names, " "))
+	s.reply(u, irc.RPL_ENDOFNAMES, ch.name, "End of /NAMES list.")
+}
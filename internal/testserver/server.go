@@ -0,0 +1,327 @@
+// Package testserver implements a small, in-process IRC server, for use in
+// tests.
+//
+// It supports just enough of the protocol to exercise clients and proxies end
+// to end: registration (including CAP negotiation, though it has no
+// capabilities to offer), the MOTD, JOIN, PART, KICK, NAMES, TOPIC, PRIVMSG,
+// NOTICE, NICK, MOTD, QUIT and PING. There is a single server, the first user to
+// join a channel becomes its operator, and there are no modes, keys or bans.
+package testserver
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+const (
+	// The host of every user's client ID.
+	userHost = "localhost"
+
+	// How many messages may be waiting to be sent to a user before we
+	// disconnect them, as real servers do when their send queue fills up.
+	sendQueueLen = 1024
+)
+
+// ErrServerClosed is returned by Connect and Serve after Close.
+var ErrServerClosed = errors.New("Server closed")
+
+// A Server is an IRC server. Its zero value is not usable; use New.
+type Server struct {
+	// The server's name, which is the prefix of the messages it sends.
+	// Don't change this once the server is in use.
+	Name string
+
+	// The lines of the message of the day. If this is empty, the server
+	// replies to registration with ERR_NOMOTD instead. Don't change this
+	// once the server is in use.
+	MOTD []string
+
+	// Protects everything below, and all users and channels. Each message
+	// from a user is handled with this held, so handlers needn't worry
+	// about concurrency.
+	lock sync.Mutex
+
+	closed    bool
+	conns     map[*user]struct{}  // All connected users, registered or not.
+	users     map[string]*user    // Registered users, by folded nick.
+	channels  map[string]*channel // By folded name.
+	listeners map[net.Listener]struct{}
+}
+
+// New returns a new server named "irc.example.com".
+func New() *Server {
+	return &Server{
+		Name:      "irc.example.com",
+		MOTD:      []string{"Welcome to the test server."},
+		conns:     make(map[*user]struct{}),
+		users:     make(map[string]*user),
+		channels:  make(map[string]*channel),
+		listeners: make(map[net.Listener]struct{}),
+	}
+}
+
+// Connect returns the client end of a new in-process connection to the
+// server, which is served in the background. This means a *Server is a
+// proxy.Connector.
+func (s *Server) Connect() (irc.ReadWriteCloser, error) {
+	clientEnd, serverEnd := net.Pipe()
+	conn := irc.NewReadWriteCloser(serverEnd)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		clientEnd.Close()
+		serverEnd.Close()
+		return nil, ErrServerClosed
+	}
+	go s.serve(s.newUser(conn), conn)
+	return irc.NewReadWriteCloser(clientEnd), nil
+}
+
+// Serve accepts connections from `l` and serves them, until accepting fails
+// or the server is closed. It always returns a non-nil error, which is
+// ErrServerClosed in the latter case.
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+	}()
+
+	for {
+		netConn, err := l.Accept()
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			if netConn != nil {
+				netConn.Close()
+			}
+			return ErrServerClosed
+		}
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		conn := irc.NewReadWriteCloser(netConn)
+		u := s.newUser(conn)
+		s.lock.Unlock()
+		go s.serve(u, conn)
+	}
+}
+
+// Close disconnects everyone, and stops accepting connections.
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for u := range s.conns {
+		s.quit(u, "Server shutting down")
+	}
+}
+
+// Members returns the nicks of the users in `channel`, sorted, or nil if there
+// is no such channel.
+func (s *Server) Members(channel string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch, ok := s.channels[fold(channel)]
+	if !ok {
+		return nil
+	}
+	ret := []string{}
+	for u := range ch.members {
+		ret = append(ret, u.id.Nick)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Topic returns the topic of `channel`, or "" if it has none or doesn't
+// exist.
+func (s *Server) Topic(channel string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ch, ok := s.channels[fold(channel)]; ok {
+		return ch.topic
+	}
+	return ""
+}
+
+// Read and handle messages from `u` until it disconnects.
+func (s *Server) serve(u *user, conn irc.ReadWriteCloser) {
+	go u.writeLoop()
+	for {
+		msg, err := conn.ReadMessage()
+		s.lock.Lock()
+		if err != nil {
+			s.quit(u, "Connection closed")
+		} else {
+			s.handle(u, msg)
+		}
+		gone := u.gone
+		s.lock.Unlock()
+		if gone {
+			return
+		}
+	}
+}
+
+// Fold a nick or channel name, so that names which differ only in case
+// compare equal.
+func fold(name string) string {
+	return irc.FoldName(irc.CaseMappingRFC1459, name)
+}
+
+// A user is a connection to the server.
+type user struct {
+	conn irc.ReadWriteCloser
+	out  chan *irc.Message
+
+	id       irc.ClientID // Nick and User are empty until supplied.
+	realName string
+
+	registered bool
+
+	// True if the client has started CAP negotiation and not yet
+	// finished it, which holds up registration.
+	negotiatingCaps bool
+
+	// True once the user has disconnected (or been disconnected), after
+	// which out is closed and the user is in no channels.
+	gone bool
+
+	channels map[*channel]struct{}
+}
+
+// Must be called with s.lock held.
+func (s *Server) newUser(conn irc.ReadWriteCloser) *user {
+	u := &user{
+		conn:     conn,
+		out:      make(chan *irc.Message, sendQueueLen),
+		id:       irc.ClientID{Host: userHost},
+		channels: make(map[*channel]struct{}),
+	}
+	s.conns[u] = struct{}{}
+	return u
+}
+
+// Write the messages queued for the user, then close the connection.
+func (u *user) writeLoop() {
+	defer u.conn.Close()
+	for msg := range u.out {
+		if u.conn.WriteMessage(msg) != nil {
+			return
+		}
+	}
+}
+
+// The target of numeric replies to the user: their nick, or "*" if they
+// haven't chosen one yet.
+func (u *user) target() string {
+	if u.id.Nick == "" {
+		return "*"
+	}
+	return u.id.Nick
+}
+
+// Queue `msg` to be sent to `u`, disconnecting them if their queue is full.
+// Must be called with s.lock held.
+func (s *Server) send(u *user, msg *irc.Message) {
+	if u.gone {
+		return
+	}
+	select {
+	case u.out <- msg:
+	default:
+		s.quit(u, "SendQ exceeded")
+	}
+}
+
+// Send a numeric reply to `u`. Must be called with s.lock held.
+func (s *Server) reply(u *user, code string, params ...string) {
+	s.send(u, &irc.Message{
+		Prefix:  s.Name,
+		Command: code,
+		Params:  append([]string{u.target()}, params...),
+	})
+}
+
+// Send `msg` to `u` and everyone who shares a channel with them, once each.
+// Must be called with s.lock held.
+func (s *Server) sendToPeers(u *user, msg *irc.Message) {
+	sent := map[*user]bool{u: true}
+	s.send(u, msg)
+	for ch := range u.channels {
+		for member := range ch.members {
+			if !sent[member] {
+				sent[member] = true
+				s.send(member, msg)
+			}
+		}
+	}
+}
+
+// Disconnect `u`, telling everyone who shares a channel with them, with
+// the reason `reason`. Must be called with s.lock held.
+func (s *Server) quit(u *user, reason string) {
+	if u.gone {
+		return
+	}
+	if u.registered {
+		peers := map[*user]bool{}
+		for ch := range u.channels {
+			ch.remove(u)
+			for member := range ch.members {
+				peers[member] = true
+			}
+			if len(ch.members) == 0 {
+				delete(s.channels, fold(ch.name))
+			}
+		}
+		quit := &irc.Quit{Prefix: u.id.String(), Reason: reason}
+		for peer := range peers {
+			s.send(peer, quit.ToMessage())
+		}
+		delete(s.users, fold(u.id.Nick))
+	}
+	select {
+	case u.out <- &irc.Message{
+		Command: "ERROR",
+		Params:  []string{"Closing Link: " + userHost + " (" + reason + ")"},
+	}:
+	default:
+		// The queue is full (which may be why we're here); they'll
+		// have to do without.
+	}
+	u.gone = true
+	close(u.out)
+	delete(s.conns, u)
+}
+
+// A channel on the server.
+type channel struct {
+	name  string
+	topic string
+
+	// The channel's members, and their membership prefixes: "@" for
+	// operators, otherwise "".
+	members map[*user]string
+}
+
+// Remove `u` from the channel.
+func (ch *channel) remove(u *user) {
+	delete(ch.members, u)
+	delete(u.channels, ch)
+}
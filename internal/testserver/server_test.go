@@ -0,0 +1,167 @@
+package testserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// Connect to `s` and register as `nick`.
+func register(t *testing.T, s *Server, nick string) *Client {
+	conn, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(t, conn)
+	c.Register(nick)
+	return c
+}
+
+func TestRegistration(t *testing.T) {
+	s := New()
+	defer s.Close()
+	conn, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(t, conn)
+
+	// Commands other than those for registration are refused:
+	c.Send("JOIN #a")
+	c.Expect(irc.ERR_NOTREGISTERED)
+
+	// CAP negotiation holds up registration until it's done:
+	c.Send("CAP LS 302")
+	if msg := c.Expect("CAP"); !reflect.DeepEqual(msg.Params, []string{"*", "LS", ""}) {
+		t.Fatalf("Unexpected CAP LS reply: %q", msg)
+	}
+	c.Send("NICK alice")
+	c.Send("USER alice 0 * :Alice")
+	c.Send("CAP REQ :server-time")
+	if msg := c.Expect("CAP"); msg.Params[1] != "NAK" {
+		t.Fatalf("Expected a NAK, but got %q.", msg)
+	}
+	c.Send("CAP END")
+	welcome := c.Expect(irc.RPL_WELCOME)
+	if welcome.Prefix != s.Name || welcome.Params[0] != "alice" {
+		t.Fatalf("Unexpected welcome: %q", welcome)
+	}
+	c.SkipTo(irc.RPL_ENDOFMOTD)
+
+	// Now the nick is taken:
+	conn, err = s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewClient(t, conn)
+	c.Send("NICK Alice")
+	c.Expect(irc.ERR_NICKNAMEINUSE)
+}
+
+func TestChannels(t *testing.T) {
+	s := New()
+	defer s.Close()
+	alice := register(t, s, "alice")
+	bob := register(t, s, "bob")
+
+	alice.Send("JOIN #chan")
+	alice.Expect("JOIN")
+	names := alice.Expect(irc.RPL_NAMEREPLY)
+	if names.Params[3] != "@alice" {
+		t.Fatalf("alice should be the channel's operator: %q", names)
+	}
+	alice.Expect(irc.RPL_ENDOFNAMES)
+
+	alice.Send("TOPIC #chan :Hello")
+	alice.Expect("TOPIC")
+	bob.Send("JOIN #chan")
+	alice.Expect("JOIN")
+	bob.Expect("JOIN")
+	if msg := bob.Expect(irc.RPL_TOPIC); msg.Params[2] != "Hello" {
+		t.Fatalf("Unexpected topic: %q", msg)
+	}
+	bob.SkipTo(irc.RPL_ENDOFNAMES)
+	if members := s.Members("#CHAN"); !reflect.DeepEqual(members, []string{"alice", "bob"}) {
+		t.Fatalf("Unexpected members: %q", members)
+	}
+
+	// Messages go to everyone else in the channel:
+	bob.Send("PRIVMSG #chan :hi")
+	msg := alice.Expect("PRIVMSG")
+	if msg.Prefix != "bob!bob@localhost" || msg.Params[1] != "hi" {
+		t.Fatalf("Unexpected message: %q", msg)
+	}
+
+	// ...and to nicks:
+	alice.Send("PRIVMSG bob :hey")
+	bob.Expect("PRIVMSG")
+
+	// Only operators can kick:
+	bob.Send("KICK #chan alice")
+	bob.Expect(irc.ERR_CHANOPRIVSNEEDED)
+	alice.Send("KICK #chan bob :bye")
+	alice.Expect("KICK")
+	if msg := bob.Expect("KICK"); msg.Params[1] != "bob" || msg.Params[2] != "bye" {
+		t.Fatalf("Unexpected kick: %q", msg)
+	}
+	bob.Send("PRIVMSG #chan :hi")
+	bob.Expect(irc.ERR_CANNOTSENDTOCHAN)
+
+	// Nick changes and quits are seen by those who share a channel:
+	bob.Send("JOIN #chan")
+	bob.SkipTo(irc.RPL_ENDOFNAMES)
+	alice.Expect("JOIN")
+	bob.Send("NICK robert")
+	bob.Expect("NICK")
+	if msg := alice.Expect("NICK"); msg.Prefix != "bob!bob@localhost" || msg.Params[0] != "robert" {
+		t.Fatalf("Unexpected nick change: %q", msg)
+	}
+	bob.Send("QUIT :later")
+	bob.Expect("ERROR")
+	if msg := alice.Expect("QUIT"); msg.Params[0] != "Quit: later" {
+		t.Fatalf("Unexpected quit: %q", msg)
+	}
+
+	alice.Send("PART #chan")
+	alice.Expect("PART")
+	if members := s.Members("#chan"); members != nil {
+		t.Fatalf("The channel should be gone, but has members %q.", members)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := register(t, s, "alice")
+	c.Send("PING :abc")
+	if msg := c.Expect("PONG"); msg.Params[1] != "abc" {
+		t.Fatalf("Unexpected PONG: %q", msg)
+	}
+}
+
+// The server should work over a real network connection too.
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(l) }()
+
+	netConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(t, irc.NewReadWriteCloser(netConn))
+	c.Send("NICK alice")
+	c.Send("USER alice 0 * :Alice")
+	c.Expect(irc.RPL_WELCOME)
+
+	s.Close()
+	c.SkipTo("ERROR")
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, but got %v.", err)
+	}
+}
@@ -0,0 +1,124 @@
+package irc
+
+// This file deals with batches, which group related messages (e.g. the QUITs
+// caused by a netsplit) so that clients can present them together. They are
+// defined by the IRCv3 batch capability.
+
+import (
+	"errors"
+	"strings"
+)
+
+// Batch types we know about.
+const (
+	BatchChatHistory = "chathistory" // Parameter: the channel or nick.
+	BatchNetsplit    = "netsplit"    // Parameters: the two servers.
+	BatchNetjoin     = "netjoin"     // Parameters: the two servers.
+)
+
+// ErrInvalidBatch is returned by ParseBatch if the message's reference tag
+// doesn't start with '+' or '-', or an opening message has no type.
+var ErrInvalidBatch = errors.New("Invalid BATCH message")
+
+// A Batch is a group of related messages. The batch is opened by the message
+// returned by Start, each message in it is tagged with a reference to it (see
+// Add), and it is closed by the message returned by End.
+type Batch struct {
+	Prefix string // The prefix of the BATCH messages; may be empty.
+
+	// The reference tag, which identifies the batch among those open on
+	// the connection.
+	Ref string
+
+	Type   string   // e.g. BatchNetsplit.
+	Params []string // Their meaning depends on Type.
+}
+
+// Start returns the message which opens the batch.
+func (b *Batch) Start() *Message {
+	return &Message{
+		Prefix:  b.Prefix,
+		Command: "BATCH",
+		Params:  append([]string{"+" + b.Ref, b.Type}, b.Params...),
+	}
+}
+
+// End returns the message which closes the batch.
+func (b *Batch) End() *Message {
+	return &Message{Prefix: b.Prefix, Command: "BATCH", Params: []string{"-" + b.Ref}}
+}
+
+// Add returns a copy of `msg` tagged as part of the batch.
+func (b *Batch) Add(msg *Message) *Message {
+	tagged := *msg
+	tagged.Tags = map[string]string{}
+	for name, value := range msg.Tags {
+		tagged.Tags[name] = value
+	}
+	tagged.Tags["batch"] = b.Ref
+	return &tagged
+}
+
+// ParseBatch parses a BATCH message. If it opens a batch, start is true and
+// the Batch is filled in; otherwise only its Prefix and Ref are.
+func ParseBatch(msg *Message) (b *Batch, start bool, err error) {
+	if err := checkCommand(msg, 1, "BATCH"); err != nil {
+		return nil, false, err
+	}
+	ref := msg.Params[0]
+	if len(ref) < 2 {
+		return nil, false, ErrInvalidBatch
+	}
+	b = &Batch{Prefix: msg.Prefix, Ref: ref[1:]}
+	switch {
+	case ref[0] == '-':
+		return b, false, nil
+	case ref[0] != '+' || len(msg.Params) < 2 || msg.Params[1] == "":
+		return nil, false, ErrInvalidBatch
+	}
+	b.Type = msg.Params[1]
+	b.Params = msg.Params[2:]
+	return b, true, nil
+}
+
+// BatchRef returns the reference tag of the batch the message is part of, if
+// any.
+func (m *Message) BatchRef() (ref string, ok bool) {
+	ref, ok = m.Tags["batch"]
+	return ref, ok && ref != ""
+}
+
+// SplitServers returns the two servers named by `reason`, the reason given
+// by QUITs caused by a netsplit, which is the names of the servers on either
+// side of the split, separated by a space. ok is false if `reason` doesn't
+// look like that. Since users can't choose reasons of this form (servers
+// prefix theirs with "Quit: "), this is how clients have traditionally spotted
+// netsplits.
+func SplitServers(reason string) (server1, server2 string, ok bool) {
+	names := strings.Split(reason, " ")
+	if len(names) != 2 || names[0] == names[1] {
+		return "", "", false
+	}
+	for _, name := range names {
+		if !isServerName(name) {
+			return "", "", false
+		}
+	}
+	return names[0], names[1], true
+}
+
+// Return true if `name` looks like a server's hostname.
+func isServerName(name string) bool {
+	if !strings.Contains(name, ".") || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '-' || c == '*':
+		default:
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
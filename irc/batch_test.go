@@ -0,0 +1,77 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	b := &Batch{
+		Prefix: "irc.example.com",
+		Ref:    "abc",
+		Type:   BatchNetsplit,
+		Params: []string{"a.example.com", "b.example.com"},
+	}
+	start := b.Start()
+	if start.String() != ":irc.example.com BATCH +abc netsplit a.example.com b.example.com\r\n" {
+		t.Fatalf("Unexpected start message: %q", start)
+	}
+	end := b.End()
+	if end.String() != ":irc.example.com BATCH -abc\r\n" {
+		t.Fatalf("Unexpected end message: %q", end)
+	}
+
+	parsed, isStart, err := ParseBatch(start)
+	if err != nil || !isStart || !reflect.DeepEqual(parsed, b) {
+		t.Fatalf("ParseBatch(%q) = (%v, %v, %v)", start, parsed, isStart, err)
+	}
+	parsed, isStart, err = ParseBatch(end)
+	if err != nil || isStart || parsed.Ref != "abc" {
+		t.Fatalf("ParseBatch(%q) = (%v, %v, %v)", end, parsed, isStart, err)
+	}
+	for _, params := range [][]string{{""}, {"abc", "netsplit"}, {"+"}, {"+abc"}, {"-"}} {
+		msg := &Message{Command: "BATCH", Params: params}
+		if _, _, err := ParseBatch(msg); err != ErrInvalidBatch {
+			t.Fatalf("ParseBatch(%q): expected ErrInvalidBatch, but got %v.", msg, err)
+		}
+	}
+
+	quit := &Message{
+		Tags:    map[string]string{"time": "2016-10-01T12:00:00.000Z"},
+		Prefix:  "alice!alice@example.com",
+		Command: "QUIT",
+		Params:  []string{"a.example.com b.example.com"},
+	}
+	tagged := b.Add(quit)
+	if ref, ok := tagged.BatchRef(); !ok || ref != "abc" {
+		t.Fatalf("BatchRef() = (%q, %v)", ref, ok)
+	}
+	if tagged.Tags["time"] != quit.Tags["time"] {
+		t.Fatal("Add() dropped the other tags.")
+	}
+	if _, ok := quit.BatchRef(); ok {
+		t.Fatal("Add() modified the original message.")
+	}
+}
+
+func TestSplitServers(t *testing.T) {
+	server1, server2, ok := SplitServers("hub.example.net leaf-2.example.net")
+	if !ok || server1 != "hub.example.net" || server2 != "leaf-2.example.net" {
+		t.Fatalf("SplitServers() = (%q, %q, %v)", server1, server2, ok)
+	}
+	for _, reason := range []string{
+		"",
+		"Quit: bye",
+		"Ping timeout",
+		"example.com",
+		"a.example.com a.example.com",
+		"a.example.com b.example.com c.example.com",
+		"a.example.com .example.com",
+		"a..example.com b.example.com",
+		"Quit: a.example.com",
+	} {
+		if _, _, ok := SplitServers(reason); ok {
+			t.Fatalf("SplitServers(%q) succeeded.", reason)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package irc
+
+// This file deals with case-insensitive comparison of nicks and channel
+// names. What counts as "the same letter in a different case" depends on the
+// server, which advertises it via the CASEMAPPING RPL_ISUPPORT token.
+
+import (
+	"strings"
+)
+
+// Case mappings understood by FoldName.
+const (
+	// Only the letters A-Z and a-z are equivalent.
+	CaseMappingASCII = "ascii"
+
+	// Like ascii, but additionally "[]\~" are the upper case versions of
+	// "{}|^". This is the default per RFC 1459, owing to the Scandinavian
+	// origins of IRC.
+	CaseMappingRFC1459 = "rfc1459"
+
+	// Like rfc1459, but without '~' and '^'.
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// FoldName returns a canonical (lower case) form of the nick or channel name
+// `name`, according to the case mapping `caseMapping`. Two names are
+// equivalent if and only if they fold to the same string. Unknown case
+// mappings are treated as ascii.
+func FoldName(caseMapping, name string) string {
+	var upper byte
+	switch caseMapping {
+	case CaseMappingRFC1459:
+		upper = '^'
+	case CaseMappingStrictRFC1459:
+		upper = ']'
+	default:
+		upper = 'Z'
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= rune(upper) {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+}
+
+// FoldName returns the canonical form of `name` under the server's case
+// mapping; see the package-level FoldName.
+func (is *ISupport) FoldName(name string) string {
+	return FoldName(is.CaseMapping(), name)
+}
+
+// EqualNames returns true if `a` and `b` denote the same nick or channel
+// under the server's case mapping.
+func (is *ISupport) EqualNames(a, b string) bool {
+	return is.FoldName(a) == is.FoldName(b)
+}
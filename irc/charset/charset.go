@@ -0,0 +1,180 @@
+// Package charset converts between UTF-8 and the legacy character encodings
+// still in use on some IRC networks.
+//
+// The IRC protocol itself just deals in bytes; nothing says what encoding
+// the text of a message is in, and in practice a single channel may see
+// several. Most clients these days send UTF-8, so the usual approach (and
+// the one taken by Fallback) is to decode a line as UTF-8 if it is valid
+// UTF-8, and as some single-byte encoding otherwise.
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Charset converts text between some encoding and UTF-8.
+type Charset interface {
+	// Name returns the canonical name of the charset, e.g. "utf-8".
+	Name() string
+
+	// Decode converts `b` to UTF-8. The result is always valid UTF-8;
+	// undecodable input is replaced with U+FFFD.
+	Decode(b []byte) string
+
+	// Encode converts `s` to the charset. Characters the charset can't
+	// represent are replaced with '?'.
+	Encode(s string) []byte
+}
+
+type utf8Charset struct{}
+
+// UTF8 is the UTF-8 encoding. Decoding replaces invalid sequences with
+// U+FFFD.
+var UTF8 Charset = utf8Charset{}
+
+func (utf8Charset) Name() string {
+	return "utf-8"
+}
+
+func (utf8Charset) Decode(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return string(bytes.ToValidUTF8(b, []byte(string(utf8.RuneError))))
+}
+
+func (utf8Charset) Encode(s string) []byte {
+	return []byte(s)
+}
+
+// A singleByte is a charset which maps each byte to a single code point,
+// and in which bytes 0x00-0x7F are ASCII.
+type singleByte struct {
+	name string
+
+	// Code points for the bytes 0x80-0xFF.
+	high *[128]rune
+
+	// Inverse of high.
+	encode map[rune]byte
+}
+
+func newSingleByte(name string, high *[128]rune) *singleByte {
+	cs := &singleByte{
+		name:   name,
+		high:   high,
+		encode: make(map[rune]byte, len(high)),
+	}
+	for i, r := range high {
+		cs.encode[r] = byte(0x80 + i)
+	}
+	return cs
+}
+
+var latin1Table = func() *[128]rune {
+	ret := &[128]rune{}
+	for i := range ret {
+		ret[i] = rune(0x80 + i)
+	}
+	return ret
+}()
+
+var (
+	// Latin1 is ISO 8859-1, in which each byte is the code point of the
+	// same value.
+	Latin1 Charset = newSingleByte("iso-8859-1", latin1Table)
+
+	// CP1252 is Windows-1252, the Windows code page for Western European
+	// languages. It is a superset of the printable characters of Latin1,
+	// and is often mislabeled as such.
+	CP1252 Charset = newSingleByte("windows-1252", &cp1252Table)
+
+	// CP1251 is Windows-1251, the Windows code page for Cyrillic.
+	CP1251 Charset = newSingleByte("windows-1251", &cp1251Table)
+)
+
+func (cs *singleByte) Name() string {
+	return cs.name
+}
+
+func (cs *singleByte) Decode(b []byte) string {
+	buf := &bytes.Buffer{}
+	buf.Grow(len(b))
+	for _, c := range b {
+		if c < 0x80 {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteRune(cs.high[c-0x80])
+		}
+	}
+	return buf.String()
+}
+
+func (cs *singleByte) Encode(s string) []byte {
+	ret := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < 0x80 {
+			ret = append(ret, byte(r))
+		} else if c, ok := cs.encode[r]; ok {
+			ret = append(ret, c)
+		} else {
+			ret = append(ret, '?')
+		}
+	}
+	return ret
+}
+
+type fallback struct {
+	Charset
+}
+
+// Fallback returns a Charset which decodes input as UTF-8 if it is valid
+// UTF-8, and using `cs` otherwise. It always encodes as UTF-8.
+func Fallback(cs Charset) Charset {
+	return fallback{cs}
+}
+
+func (f fallback) Name() string {
+	return "utf-8," + f.Charset.Name()
+}
+
+func (f fallback) Decode(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return f.Charset.Decode(b)
+}
+
+func (f fallback) Encode(s string) []byte {
+	return []byte(s)
+}
+
+// Aliases for the charsets Lookup knows about. Keys are lower case.
+var byName = map[string]Charset{
+	"utf-8":        UTF8,
+	"utf8":         UTF8,
+	"iso-8859-1":   Latin1,
+	"latin1":       Latin1,
+	"windows-1252": CP1252,
+	"cp1252":       CP1252,
+	"windows-1251": CP1251,
+	"cp1251":       CP1251,
+}
+
+type unknownCharsetError string
+
+func (e unknownCharsetError) Error() string {
+	return fmt.Sprintf("Unknown charset: %q", string(e))
+}
+
+// Lookup returns the charset with the given name (case insensitive), e.g.
+// "utf-8", "latin1" or "cp1251".
+func Lookup(name string) (Charset, error) {
+	if cs, ok := byName[strings.ToLower(name)]; ok {
+		return cs, nil
+	}
+	return nil, unknownCharsetError(name)
+}
@@ -0,0 +1,67 @@
+package charset
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		cs    Charset
+		input string
+		text  string
+	}{
+		{UTF8, "caf\xc3\xa9", "café"},
+		{UTF8, "caf\xe9", "caf�"},
+		{Latin1, "caf\xe9", "café"},
+		{CP1252, "\x80 \x93quoted\x94", "€ “quoted”"},
+		{CP1251, "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{Fallback(CP1251), "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{Fallback(CP1251), "caf\xc3\xa9", "café"},
+	}
+	for _, c := range cases {
+		if text := c.cs.Decode([]byte(c.input)); text != c.text {
+			t.Errorf("%s: Decode(%q) = %q, expected %q.", c.cs.Name(), c.input, text, c.text)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		cs     Charset
+		text   string
+		output string
+	}{
+		{UTF8, "café", "caf\xc3\xa9"},
+		{Latin1, "café €", "caf\xe9 ?"},
+		{CP1252, "café €", "caf\xe9 \x80"},
+		{CP1251, "Привет", "\xcf\xf0\xe8\xe2\xe5\xf2"},
+		{Fallback(CP1251), "Привет", "Привет"},
+	}
+	for _, c := range cases {
+		if output := string(c.cs.Encode(c.text)); output != c.output {
+			t.Errorf("%s: Encode(%q) = %q, expected %q.", c.cs.Name(), c.text, output, c.output)
+		}
+	}
+}
+
+// Every byte should survive a round trip through each single-byte charset.
+func TestSingleByteRoundTrip(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, cs := range []Charset{Latin1, CP1252, CP1251} {
+		if output := cs.Encode(cs.Decode(all)); string(output) != string(all) {
+			t.Errorf("%s: round trip failed: %q", cs.Name(), output)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if cs, err := Lookup("CP1251"); err != nil || cs != CP1251 {
+		t.Errorf("Lookup(\"CP1251\") = (%v, %v)", cs, err)
+	}
+	if _, err := Lookup("ebcdic"); err == nil {
+		t.Errorf("Lookup(\"ebcdic\") should fail.")
+	}
+}
@@ -0,0 +1,350 @@
+// Package client implements a high-level IRC client.
+//
+// A Client registers with the server, answers PINGs, notices when the
+// connection has died, and keeps track of its own nick and of the channels
+// it's in (using the same state tracking as the proxy). Applications handle
+// the messages they care about by registering Handlers.
+package client
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"strings"
+	"sync"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/filters"
+	"zenhack.net/go/irc-idler/proxy/state"
+)
+
+const (
+	// DefaultPingTime is the PingTime used if the Config doesn't set one.
+	DefaultPingTime = 30 * time.Second
+
+	// Handlers for AllCommands see every message from the server.
+	AllCommands = "*"
+
+	// Handlers for Registered are called once registration is complete,
+	// i.e. the server has sent the welcome sequence up to and including
+	// the MOTD, with the message that ended it. This isn't a valid IRC
+	// command, so it can't clash with one.
+	Registered = "<registered>"
+
+	// The parameter of the PINGs we send to check on the server.
+	pingToken = "keepalive"
+
+	// How many nicks we try during registration before giving up; see
+	// ErrNoNick.
+	maxNickAttempts = 5
+
+	// Pessimistic guesses at the lengths of our user and host, as others
+	// see them, if we don't know better; see Client.prefixLen.
+	maxUserLen = 11
+	maxHostLen = 63
+)
+
+// ErrNoNick is returned by Run if the server rejects every nick we try
+// during registration: the one in the Config, and then that with one or more
+// underscores appended.
+var ErrNoNick = errors.New("No acceptable nick")
+
+// Config configures a Client.
+type Config struct {
+	Nick     string
+	User     string // Defaults to Nick.
+	RealName string // Defaults to User.
+	Password string // Sent with PASS, if not empty.
+
+	// How long to wait for a message from the server before sending it a
+	// PING, and then for a reply before giving up on the connection. Zero
+	// means DefaultPingTime.
+	PingTime time.Duration
+
+	// How fast we may send messages to the server. nil means
+	// filters.DefaultFloodControl.
+	FloodControl *filters.FloodControl
+}
+
+// A Handler handles a message from the server. Handlers run on Run's
+// goroutine, one at a time, after the Client has updated its state from the
+// message.
+type Handler func(c *Client, msg *irc.Message)
+
+// A Client is a connection to an IRC server.
+//
+// The methods which send messages may be called from any goroutine. The
+// Session, and the methods which look at it, may only be used from Handlers
+// (or after Run has returned).
+type Client struct {
+	// The state of the connection, as seen from the server.
+	Session *state.Session
+
+	config   Config
+	pipeline *filters.Pipeline
+	handlers map[string][]Handler
+
+	// The number of nicks we've tried during registration, which lasts
+	// until the server welcomes us.
+	nickAttempts int
+	welcomed     bool
+
+	lock     sync.Mutex   // Protects the below.
+	id       irc.ClientID // A copy of Session.ClientID, for ID.
+	quitting bool         // Quit has been called.
+}
+
+// New returns a Client which will speak over `conn` (usually a connection to
+// a server) as configured by `config`. Messages may be sent right away, but
+// registration and the handling of received messages wait for Run.
+func New(conn irc.ReadWriteCloser, config Config) *Client {
+	if config.User == "" {
+		config.User = config.Nick
+	}
+	if config.RealName == "" {
+		config.RealName = config.User
+	}
+	if config.PingTime == 0 {
+		config.PingTime = DefaultPingTime
+	}
+	flood := filters.DefaultFloodControl
+	if config.FloodControl != nil {
+		flood = *config.FloodControl
+	}
+	c := &Client{
+		Session:  state.NewSession(),
+		config:   config,
+		pipeline: filters.NewPipeline(conn),
+		handlers: make(map[string][]Handler),
+	}
+	c.pipeline.Start(
+		filters.Keepalive(config.PingTime, pingToken, c.pipeline),
+		filters.Throttle(flood),
+	)
+	return c
+}
+
+// Handle registers `h` to be called for messages with the command `command`
+// (e.g. "PRIVMSG" or irc.RPL_WELCOME), or for the pseudo-commands
+// AllCommands and Registered. Handlers for the same command run in the order
+// they were registered, after those for AllCommands.
+//
+// Handle must not be called concurrently with Run, except from a Handler.
+func (c *Client) Handle(command string, h Handler) {
+	c.handlers[command] = append(c.handlers[command], h)
+}
+
+// Run registers with the server, then handles messages from it until the
+// connection ends or `ctx` is cancelled. It closes the connection before
+// returning.
+//
+// If the connection ends after a call to Quit, Run returns nil. Otherwise
+// it returns why the connection ended: ctx.Err(), ErrNoNick, an
+// *irc.MessageError if the server sent an invalid message, or anything
+// filters.Pipeline.Err may report.
+func (c *Client) Run(ctx context.Context) error {
+	err := c.run(ctx)
+	c.pipeline.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.quitting {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) run(ctx context.Context) error {
+	if c.config.Password != "" {
+		c.register(&irc.Message{Command: "PASS", Params: []string{c.config.Password}})
+	}
+	c.register(&irc.Message{Command: "NICK", Params: []string{c.config.Nick}})
+	c.register(&irc.Message{
+		Command: "USER",
+		Params:  []string{c.config.User, "0", "*", c.config.RealName},
+	})
+	c.nickAttempts = 1
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-c.pipeline.C:
+			if !ok {
+				return c.pipeline.Err()
+			}
+			if err := c.handleMessage(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send a registration message, updating our state to match.
+func (c *Client) register(msg *irc.Message) {
+	if msg.Command == "NICK" {
+		c.Session.ClientID.Nick = msg.Params[0]
+		c.updateID()
+	}
+	c.Session.UpdateFromClient(msg)
+	// If this fails, the pipeline has ended, and run will find out why:
+	c.pipeline.WriteMessage(msg)
+}
+
+// Update our state from `msg`, and call the handlers for it.
+func (c *Client) handleMessage(msg *irc.Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	wasDone := c.Session.Handshake.Done()
+	c.Session.UpdateFromServer(msg)
+
+	switch msg.Command {
+	case irc.RPL_WELCOME:
+		// The welcome is addressed to our nick. Our full client ID is
+		// usually the last word of the message, but not always, so
+		// only believe it if it looks like one, for the same nick.
+		c.Session.ClientID = irc.ClientID{Nick: msg.Params[0]}
+		words := strings.Split(msg.Params[len(msg.Params)-1], " ")
+		last := words[len(words)-1]
+		id, err := irc.ParseClientID(last)
+		if err == nil && strings.ContainsAny(last, "!@") &&
+			c.Session.ISupport.EqualNames(id.Nick, msg.Params[0]) {
+
+			c.Session.ClientID = id
+		}
+		c.welcomed = true
+	case irc.ERR_NICKNAMEINUSE, irc.ERR_NICKCOLLISION, irc.ERR_ERRONEUSNICKNAME:
+		if !c.welcomed {
+			if err := c.tryNextNick(); err != nil {
+				return err
+			}
+		}
+	}
+	c.updateID()
+
+	c.dispatch(AllCommands, msg)
+	c.dispatch(msg.Command, msg)
+	if !wasDone && c.Session.Handshake.Done() {
+		c.dispatch(Registered, msg)
+	}
+	return nil
+}
+
+// Try another nick during registration, after the server has rejected the
+// last one.
+func (c *Client) tryNextNick() error {
+	if c.nickAttempts >= maxNickAttempts {
+		return ErrNoNick
+	}
+	c.nickAttempts++
+	nick := c.config.Nick + strings.Repeat("_", c.nickAttempts-1)
+	c.register(&irc.Message{Command: "NICK", Params: []string{nick}})
+	return nil
+}
+
+// Call the handlers for `command`.
+func (c *Client) dispatch(command string, msg *irc.Message) {
+	for _, h := range c.handlers[command] {
+		h(c, msg)
+	}
+}
+
+// Copy Session.ClientID to where ID can get at it.
+func (c *Client) updateID() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.id = c.Session.ClientID
+}
+
+// ID returns our client ID, as far as we know it. Before registration is
+// complete, only the Nick is filled in, and it's the nick we've asked for.
+// Unlike the Session, this may be called from any goroutine.
+func (c *Client) ID() irc.ClientID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.id
+}
+
+// Channel returns the state of the channel `name`, or nil if we're not in
+// it. Only call this from a Handler.
+func (c *Client) Channel(name string) *state.ChannelState {
+	if !c.Session.HaveChannel(name) {
+		return nil
+	}
+	return c.Session.GetChannel(name)
+}
+
+// Channels returns the names of the channels we're in. Only call this from a
+// Handler.
+func (c *Client) Channels() []string {
+	return c.Session.ChannelsWithUser(c.Session.ClientID.Nick)
+}
+
+// Send sends `msg` to the server. Messages are sent in the order they are
+// passed to Send, subject to the Config's FloodControl. An error is returned
+// right away if the message fails msg.CheckWritable, or if the connection
+// has ended; otherwise, a failure to send the message ends the connection,
+// and Run reports it.
+func (c *Client) Send(msg *irc.Message) error {
+	return c.pipeline.WriteMessage(msg)
+}
+
+// Join joins the channels `channels`.
+func (c *Client) Join(channels ...string) error {
+	return c.Send((&irc.Join{Channels: channels}).ToMessage())
+}
+
+// Part leaves the channel `channel`, giving the reason `reason`, which may
+// be empty.
+func (c *Client) Part(channel, reason string) error {
+	return c.Send((&irc.Part{Channels: []string{channel}, Reason: reason}).ToMessage())
+}
+
+// SetNick asks the server to change our nick to `nick`. ID reflects the
+// change once the server has confirmed it.
+func (c *Client) SetNick(nick string) error {
+	return c.Send((&irc.Nick{Nick: nick}).ToMessage())
+}
+
+// Privmsg sends `text` to `target`, a nick or channel, splitting it into
+// several messages if it's too long for one; see irc.SplitMessage.
+func (c *Client) Privmsg(target, text string) error {
+	return c.sendText("PRIVMSG", target, text)
+}
+
+// Notice is like Privmsg, but sends a NOTICE.
+func (c *Client) Notice(target, text string) error {
+	return c.sendText("NOTICE", target, text)
+}
+
+func (c *Client) sendText(command, target, text string) error {
+	msg := &irc.Message{Command: command, Params: []string{target, text}}
+	for _, part := range irc.SplitMessage(msg, c.prefixLen()) {
+		if err := c.Send(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return a pessimistic estimate of the length of the prefix the server will
+// add to our messages when relaying them.
+func (c *Client) prefixLen() int {
+	id := c.ID()
+	userLen, hostLen := len(id.User), len(id.Host)
+	if userLen < maxUserLen {
+		userLen = maxUserLen
+	}
+	if hostLen < maxHostLen {
+		hostLen = maxHostLen
+	}
+	return len(id.Nick) + 1 + userLen + 1 + hostLen
+}
+
+// Quit sends QUIT, with the reason `reason` (which may be empty), and
+// arranges for Run to return nil once the server closes the connection.
+func (c *Client) Quit(reason string) error {
+	c.lock.Lock()
+	c.quitting = true
+	c.lock.Unlock()
+	return c.Send((&irc.Quit{Reason: reason}).ToMessage())
+}
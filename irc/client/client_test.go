@@ -0,0 +1,217 @@
+package client
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"sort"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/internal/testserver"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/proxy/state"
+)
+
+// A Client connected to a test server, running in the background.
+type testClient struct {
+	*Client
+	cancel context.CancelFunc
+	done   chan error // Receives Run's result.
+}
+
+// Connect a Client to `s` with `config`, and start it, once `setup` has had
+// a chance to register handlers.
+func startClient(t *testing.T, s *testserver.Server, config Config, setup func(c *Client)) *testClient {
+	conn, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tc := &testClient{
+		Client: New(conn, config),
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+	setup(tc.Client)
+	go func() { tc.done <- tc.Run(ctx) }()
+	return tc
+}
+
+// Wait for Run to return, and return its result.
+func (tc *testClient) wait(t *testing.T) error {
+	select {
+	case err := <-tc.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Run to return.")
+		return nil
+	}
+}
+
+// Receive a value from `ch`, failing the test if that takes too long.
+func recv(t *testing.T, ch <-chan string) string {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a handler.")
+		return ""
+	}
+}
+
+// If our nick is taken, we should pick another.
+func TestRegistration(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+	other, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testserver.NewClient(t, other).Register("bot")
+
+	registered := make(chan string, 1)
+	tc := startClient(t, s, Config{Nick: "bot"}, func(c *Client) {
+		c.Handle(Registered, func(c *Client, msg *irc.Message) {
+			registered <- c.ID().String()
+		})
+	})
+	defer tc.cancel()
+	if id := recv(t, registered); id != "bot_!bot@localhost" {
+		t.Fatalf("Unexpected client ID after registration: %q", id)
+	}
+}
+
+// Our nick comes from the welcome's target; the last word of its text is only
+// used if it's a full client ID for that nick.
+func TestWelcomeClientID(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"Welcome to the Example Internet Relay Chat Network bot!bot@example.com", "bot!bot@example.com"},
+		{"Welcome to the Example Internet Relay Chat Network BOT!bot@example.com", "BOT!bot@example.com"},
+		{"Welcome to the Example Network", "bot"},
+		{"Welcome to the Example Network alice!alice@example.com", "bot"},
+		{"Welcome to the Example Network bot", "bot"},
+	}
+	for _, c := range cases {
+		client := &Client{Session: state.NewSession(), handlers: make(map[string][]Handler)}
+		err := client.handleMessage(&irc.Message{
+			Prefix:  "irc.example.com",
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"bot", c.text},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := client.ID().String(); id != c.expected {
+			t.Errorf("Welcome %q: expected client ID %q, but got %q.", c.text, c.expected, id)
+		}
+	}
+}
+
+// If every nick we try is taken, Run should give up.
+func TestNoNick(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+	for i := 0; i < maxNickAttempts; i++ {
+		conn, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nick := "bot"
+		for j := 0; j < i; j++ {
+			nick += "_"
+		}
+		testserver.NewClient(t, conn).Register(nick)
+	}
+	tc := startClient(t, s, Config{Nick: "bot"}, func(c *Client) {})
+	if err := tc.wait(t); err != ErrNoNick {
+		t.Fatalf("Expected ErrNoNick, but got %v.", err)
+	}
+}
+
+// The client should keep track of its channels, and pass messages to the
+// handlers.
+func TestChannels(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+
+	events := make(chan string, 10)
+	tc := startClient(t, s, Config{Nick: "bot"}, func(c *Client) {
+		c.Handle(Registered, func(c *Client, msg *irc.Message) {
+			c.Join("#chan")
+		})
+		c.Handle(irc.RPL_ENDOFNAMES, func(c *Client, msg *irc.Message) {
+			events <- "joined " + c.Channels()[0]
+		})
+		c.Handle("JOIN", func(c *Client, msg *irc.Message) {
+			users := c.Channel("#chan").Users()
+			sort.Strings(users)
+			events <- "members " + users[0] + " " + users[len(users)-1]
+		})
+		c.Handle("PRIVMSG", func(c *Client, msg *irc.Message) {
+			c.Privmsg("#chan", "you said: "+msg.Params[1])
+		})
+		c.Handle("NICK", func(c *Client, msg *irc.Message) {
+			events <- "nick " + c.ID().Nick
+		})
+		c.Handle("PART", func(c *Client, msg *irc.Message) {
+			events <- "channels " + fmt.Sprint(c.Channels())
+		})
+	})
+	defer tc.cancel()
+
+	if ev := recv(t, events); ev != "members bot bot" {
+		t.Fatalf("Unexpected event: %q", ev)
+	}
+	if ev := recv(t, events); ev != "joined #chan" {
+		t.Fatalf("Unexpected event: %q", ev)
+	}
+
+	conn, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := testserver.NewClient(t, conn)
+	alice.Register("alice")
+	alice.Send("JOIN #chan")
+	alice.SkipTo(irc.RPL_ENDOFNAMES)
+	if ev := recv(t, events); ev != "members alice bot" {
+		t.Fatalf("Unexpected event: %q", ev)
+	}
+
+	alice.Send("PRIVMSG #chan :hello")
+	if msg := alice.Expect("PRIVMSG"); msg.Params[1] != "you said: hello" {
+		t.Fatalf("Unexpected reply: %q", msg)
+	}
+
+	tc.SetNick("robot")
+	if ev := recv(t, events); ev != "nick robot" {
+		t.Fatalf("Unexpected event: %q", ev)
+	}
+	tc.Part("#chan", "")
+	if ev := recv(t, events); ev != "channels []" {
+		t.Fatalf("Unexpected event: %q", ev)
+	}
+}
+
+// Run should return nil after Quit, and ctx.Err() if ctx is cancelled.
+func TestStop(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+
+	tc := startClient(t, s, Config{Nick: "bot"}, func(c *Client) {
+		c.Handle(Registered, func(c *Client, msg *irc.Message) {
+			c.Quit("bye")
+		})
+	})
+	if err := tc.wait(t); err != nil {
+		t.Fatalf("Expected Run to return nil after Quit, but got %v.", err)
+	}
+
+	tc = startClient(t, s, Config{Nick: "bot"}, func(c *Client) {})
+	tc.cancel()
+	if err := tc.wait(t); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, but got %v.", err)
+	}
+}
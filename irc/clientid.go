@@ -9,23 +9,15 @@ import (
 // in the latter half of the "prefix" production. The description of RPL_WELCOME
 // suggests (but actually doesn't explicitly say) that this is the syntax for
 // its client field.
+//
+// Membership prefixes, as in RPL_NAMEREPLY, are not part of a client ID; see
+// Membership.
 type ClientID struct {
-	// The flag provided with the nick in RPL_NAMEREPLY. TODO: we should
-	// find what the proper name is for this, and what the complete set
-	// of legal chars is.
-	//
-	// This is not legal in a prefix, but it's handy to have one data
-	// structure that we can use for a user id in other contexts as well.
-	//
-	// Still, this is a bit gross and I'd like to find a better solution.
-	Flag string
-
-	// Stuff that actually belongs here.
 	Nick, User, Host string
 }
 
 func (id ClientID) String() string {
-	ret := id.Flag + id.Nick
+	ret := id.Nick
 	if id.Host == "" {
 		return ret
 	}
@@ -44,13 +36,6 @@ func (e clientIDParseError) Error() string {
 
 func ParseClientID(text string) (ClientID, error) {
 	var ret ClientID
-	var flag string
-
-	if strings.HasPrefix(text, "@") || strings.HasPrefix(text, "+") {
-		buf := []byte(text)
-		flag = string(buf[:1])
-		text = string(buf[1:])
-	}
 
 	nickHostParts := strings.Split(text, "@")
 	switch len(nickHostParts) {
@@ -84,6 +69,5 @@ func ParseClientID(text string) (ClientID, error) {
 		return ClientID{}, clientIDParseError("User but no host in client ID.")
 	}
 
-	ret.Flag = flag
 	return ret, nil
 }
@@ -12,11 +12,9 @@ type testCase struct {
 
 var cases = []testCase{
 	{"", ClientID{}, true},
-	{"nick!user@host", ClientID{"", "nick", "user", "host"}, false},
-	{"nick", ClientID{"", "nick", "", ""}, false},
-	{"@nick", ClientID{"@", "nick", "", ""}, false},
-	{"+nick", ClientID{"+", "nick", "", ""}, false},
-	{"^nick", ClientID{"", "^nick", "", ""}, false},
+	{"nick!user@host", ClientID{"nick", "user", "host"}, false},
+	{"nick", ClientID{"nick", "", ""}, false},
+	{"^nick", ClientID{"^nick", "", ""}, false},
 }
 
 // For each of our test cases, verify that:
@@ -27,9 +25,9 @@ var cases = []testCase{
 //    string yields the input string
 func TestParse(t *testing.T) {
 	for _, v := range cases {
-		t.Logf("TestParse: {%q, {%q, %q, %q, %q}, %v}",
+		t.Logf("TestParse: {%q, {%q, %q, %q}, %v}",
 			v.text,
-			v.ClientID.Flag, v.ClientID.Nick, v.ClientID.User, v.ClientID.Host,
+			v.ClientID.Nick, v.ClientID.User, v.ClientID.Host,
 			v.err,
 		)
 
@@ -51,10 +49,10 @@ func TestParse(t *testing.T) {
 		if clientID != v.ClientID {
 			t.Fatalf(
 				"ParseClientID() test failed: expected "+
-					"ClientID{%q, %q, %q, %q} but got "+
-					"ClientID{%q, %q, %q, %q}.",
-				v.ClientID.Flag, v.ClientID.Nick, v.ClientID.User, v.ClientID.Host,
-				clientID.Flag, clientID.Nick, clientID.User, clientID.Host,
+					"ClientID{%q, %q, %q} but got "+
+					"ClientID{%q, %q, %q}.",
+				v.ClientID.Nick, v.ClientID.User, v.ClientID.Host,
+				clientID.Nick, clientID.User, clientID.Host,
 			)
 		}
 
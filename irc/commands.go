@@ -0,0 +1,445 @@
+package irc
+
+// This file defines typed representations of the commands we deal with most,
+// so that code handling them can use named fields rather than indexing
+// Message.Params by hand.
+
+import (
+	"strings"
+)
+
+// A Command is a Message with a specific command, with its parameters in
+// named fields.
+type Command interface {
+	// ToMessage converts the command to a Message.
+	ToMessage() *Message
+
+	// FromMessage sets the command's fields from `msg`. If msg has a
+	// different command, or lacks required parameters, it returns a
+	// *MessageError suitable as a reply, and leaves the fields unchanged.
+	FromMessage(msg *Message) error
+}
+
+// Check that msg has the command `command`, and at least `min` parameters.
+func checkCommand(msg *Message, min int, command ...string) error {
+	found := false
+	for _, c := range command {
+		found = found || msg.Command == c
+	}
+	if !found {
+		return errUnknownCommand("*", msg.Command, "Expected "+strings.Join(command, " or "))
+	}
+	if len(msg.Params) < min {
+		return errNeedMoreParams("*", msg.Command)
+	}
+	return nil
+}
+
+// Return the i'th parameter of msg, or "" if there aren't that many.
+func param(msg *Message, i int) string {
+	if i < len(msg.Params) {
+		return msg.Params[i]
+	}
+	return ""
+}
+
+// Split a comma-separated list parameter. The empty string yields an empty
+// list.
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+// A Privmsg is a PRIVMSG or NOTICE message.
+type Privmsg struct {
+	Prefix string
+
+	// True for a NOTICE, false for a PRIVMSG.
+	Notice bool
+
+	// The recipient. This may be a channel (possibly with a STATUSMSG
+	// prefix; see ISupport.ChannelTarget), a nick, or a comma-separated
+	// list of those.
+	Target string
+
+	Text string
+}
+
+func (c *Privmsg) ToMessage() *Message {
+	command := "PRIVMSG"
+	if c.Notice {
+		command = "NOTICE"
+	}
+	return &Message{Prefix: c.Prefix, Command: command, Params: []string{c.Target, c.Text}}
+}
+
+func (c *Privmsg) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 2, "PRIVMSG", "NOTICE"); err != nil {
+		return err
+	}
+	*c = Privmsg{
+		Prefix: msg.Prefix,
+		Notice: msg.Command == "NOTICE",
+		Target: msg.Params[0],
+		Text:   msg.Params[1],
+	}
+	return nil
+}
+
+// A Join is a JOIN message. From a client, it requests to join channels;
+// from the server, it says someone has joined one.
+type Join struct {
+	Prefix   string
+	Channels []string
+
+	// Channel keys, corresponding to the first len(Keys) channels.
+	Keys []string
+}
+
+func (c *Join) ToMessage() *Message {
+	params := []string{strings.Join(c.Channels, ",")}
+	if len(c.Keys) != 0 {
+		params = append(params, strings.Join(c.Keys, ","))
+	}
+	return &Message{Prefix: c.Prefix, Command: "JOIN", Params: params}
+}
+
+func (c *Join) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 1, "JOIN"); err != nil {
+		return err
+	}
+	// Only clients send keys. With the extended-join capability, servers
+	// send extra parameters (account and real name) instead, which we
+	// ignore. We tell the two apart by the prefix, which clients don't
+	// send.
+	keys := []string{}
+	if msg.Prefix == "" {
+		keys = splitList(param(msg, 1))
+	}
+	*c = Join{
+		Prefix:   msg.Prefix,
+		Channels: splitList(msg.Params[0]),
+		Keys:     keys,
+	}
+	return nil
+}
+
+// A Part is a PART message.
+type Part struct {
+	Prefix   string
+	Channels []string
+	Reason   string // Optional.
+}
+
+func (c *Part) ToMessage() *Message {
+	params := []string{strings.Join(c.Channels, ",")}
+	if c.Reason != "" {
+		params = append(params, c.Reason)
+	}
+	return &Message{Prefix: c.Prefix, Command: "PART", Params: params}
+}
+
+func (c *Part) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 1, "PART"); err != nil {
+		return err
+	}
+	*c = Part{
+		Prefix:   msg.Prefix,
+		Channels: splitList(msg.Params[0]),
+		Reason:   param(msg, 1),
+	}
+	return nil
+}
+
+// A Kick is a KICK message.
+type Kick struct {
+	Prefix  string
+	Channel string
+	Nick    string // The user being kicked.
+	Reason  string // Optional.
+}
+
+func (c *Kick) ToMessage() *Message {
+	params := []string{c.Channel, c.Nick}
+	if c.Reason != "" {
+		params = append(params, c.Reason)
+	}
+	return &Message{Prefix: c.Prefix, Command: "KICK", Params: params}
+}
+
+func (c *Kick) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 2, "KICK"); err != nil {
+		return err
+	}
+	*c = Kick{
+		Prefix:  msg.Prefix,
+		Channel: msg.Params[0],
+		Nick:    msg.Params[1],
+		Reason:  param(msg, 2),
+	}
+	return nil
+}
+
+// A Nick is a NICK message. From the server, Prefix is the user's old nick
+// and Nick the new one.
+type Nick struct {
+	Prefix string
+	Nick   string
+}
+
+func (c *Nick) ToMessage() *Message {
+	return &Message{Prefix: c.Prefix, Command: "NICK", Params: []string{c.Nick}}
+}
+
+func (c *Nick) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 1, "NICK"); err != nil {
+		return err
+	}
+	*c = Nick{Prefix: msg.Prefix, Nick: msg.Params[0]}
+	return nil
+}
+
+// A Quit is a QUIT message. Note that it doesn't say which channels the
+// user was in; it applies to all of them.
+type Quit struct {
+	Prefix string
+	Reason string // Optional.
+}
+
+func (c *Quit) ToMessage() *Message {
+	params := []string{}
+	if c.Reason != "" {
+		params = append(params, c.Reason)
+	}
+	return &Message{Prefix: c.Prefix, Command: "QUIT", Params: params}
+}
+
+func (c *Quit) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 0, "QUIT"); err != nil {
+		return err
+	}
+	*c = Quit{Prefix: msg.Prefix, Reason: param(msg, 0)}
+	return nil
+}
+
+// A Mode is a MODE message, for either a channel or a user.
+type Mode struct {
+	Prefix string
+	Target string
+
+	// The mode changes, e.g. "+o-v". Empty for a query of the current
+	// modes.
+	Modes string
+
+	// Arguments for those modes which take one.
+	Args []string
+}
+
+func (c *Mode) ToMessage() *Message {
+	params := []string{c.Target}
+	if c.Modes != "" {
+		params = append(append(params, c.Modes), c.Args...)
+	}
+	return &Message{Prefix: c.Prefix, Command: "MODE", Params: params}
+}
+
+func (c *Mode) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 1, "MODE"); err != nil {
+		return err
+	}
+	args := []string{}
+	if len(msg.Params) > 2 {
+		args = append(args, msg.Params[2:]...)
+	}
+	*c = Mode{
+		Prefix: msg.Prefix,
+		Target: msg.Params[0],
+		Modes:  param(msg, 1),
+		Args:   args,
+	}
+	return nil
+}
+
+// A Topic is a TOPIC message, which either queries or sets (or, from the
+// server, reports a change to) a channel's topic.
+type Topic struct {
+	Prefix  string
+	Channel string
+
+	// If false, this is a query, and Topic is ignored. Otherwise this
+	// sets the topic; an empty Topic clears it.
+	Set   bool
+	Topic string
+}
+
+func (c *Topic) ToMessage() *Message {
+	params := []string{c.Channel}
+	if c.Set {
+		params = append(params, c.Topic)
+	}
+	return &Message{Prefix: c.Prefix, Command: "TOPIC", Params: params}
+}
+
+func (c *Topic) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 1, "TOPIC"); err != nil {
+		return err
+	}
+	*c = Topic{
+		Prefix:  msg.Prefix,
+		Channel: msg.Params[0],
+		Set:     len(msg.Params) > 1,
+		Topic:   param(msg, 1),
+	}
+	return nil
+}
+
+// A Numeric is a numeric reply, e.g. RPL_WELCOME.
+type Numeric struct {
+	Prefix string
+	Code   string // e.g. RPL_WELCOME ("001").
+
+	// The client the reply is addressed to. This is "*" if the client
+	// has not yet registered.
+	Target string
+
+	// The remaining parameters.
+	Params []string
+}
+
+func (c *Numeric) ToMessage() *Message {
+	return &Message{
+		Prefix:  c.Prefix,
+		Command: c.Code,
+		Params:  append([]string{c.Target}, c.Params...),
+	}
+}
+
+func (c *Numeric) FromMessage(msg *Message) error {
+	if !IsNumeric(msg.Command) {
+		return errUnknownCommand("*", msg.Command, "Expected a numeric reply")
+	}
+	if err := checkCommand(msg, 1, msg.Command); err != nil {
+		return err
+	}
+	*c = Numeric{
+		Prefix: msg.Prefix,
+		Code:   msg.Command,
+		Target: msg.Params[0],
+		Params: append([]string{}, msg.Params[1:]...),
+	}
+	return nil
+}
+
+// IsNumeric reports whether `command` is a numeric reply, e.g. "001".
+func IsNumeric(command string) bool {
+	return len(command) == 3 && strings.Trim(command, "0123456789") == ""
+}
+
+// A TopicReply is an RPL_TOPIC reply, giving a channel's topic.
+type TopicReply struct {
+	Prefix  string
+	Target  string
+	Channel string
+	Topic   string
+}
+
+func (c *TopicReply) ToMessage() *Message {
+	return &Message{
+		Prefix:  c.Prefix,
+		Command: RPL_TOPIC,
+		Params:  []string{c.Target, c.Channel, c.Topic},
+	}
+}
+
+func (c *TopicReply) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 3, RPL_TOPIC); err != nil {
+		return err
+	}
+	*c = TopicReply{
+		Prefix:  msg.Prefix,
+		Target:  msg.Params[0],
+		Channel: msg.Params[1],
+		Topic:   msg.Params[2],
+	}
+	return nil
+}
+
+// A NamReply is an RPL_NAMEREPLY reply, listing (some of) the users in a
+// channel.
+type NamReply struct {
+	Prefix string
+	Target string
+
+	// "=" for a public channel, "*" for a private one, and "@" for a
+	// secret one.
+	Symbol string
+
+	Channel string
+
+	// The users, each with any membership prefixes (e.g. "@alice").
+	Nicks []string
+}
+
+func (c *NamReply) ToMessage() *Message {
+	return &Message{
+		Prefix:  c.Prefix,
+		Command: RPL_NAMEREPLY,
+		Params:  []string{c.Target, c.Symbol, c.Channel, strings.Join(c.Nicks, " ")},
+	}
+}
+
+func (c *NamReply) FromMessage(msg *Message) error {
+	if err := checkCommand(msg, 4, RPL_NAMEREPLY); err != nil {
+		return err
+	}
+	*c = NamReply{
+		Prefix:  msg.Prefix,
+		Target:  msg.Params[0],
+		Symbol:  msg.Params[1],
+		Channel: msg.Params[2],
+		Nicks:   strings.Fields(msg.Params[3]),
+	}
+	return nil
+}
+
+// ParseCommand converts `msg` to the corresponding Command type: a *Privmsg
+// for PRIVMSG or NOTICE, a *Join for JOIN, and so on. RPL_TOPIC and
+// RPL_NAMEREPLY yield a *TopicReply and *NamReply respectively, and other
+// numeric replies a *Numeric. For commands without a type of their own, it
+// returns (nil, nil).
+func ParseCommand(msg *Message) (Command, error) {
+	var cmd Command
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		cmd = &Privmsg{}
+	case "JOIN":
+		cmd = &Join{}
+	case "PART":
+		cmd = &Part{}
+	case "KICK":
+		cmd = &Kick{}
+	case "NICK":
+		cmd = &Nick{}
+	case "QUIT":
+		cmd = &Quit{}
+	case "MODE":
+		cmd = &Mode{}
+	case "TOPIC":
+		cmd = &Topic{}
+	case RPL_TOPIC:
+		cmd = &TopicReply{}
+	case RPL_NAMEREPLY:
+		cmd = &NamReply{}
+	default:
+		if !IsNumeric(msg.Command) {
+			return nil, nil
+		}
+		cmd = &Numeric{}
+	}
+	if err := cmd.FromMessage(msg); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
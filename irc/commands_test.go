@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Each of these should survive a trip through ParseCommand and ToMessage
+// unchanged.
+var sampleCommands = []struct {
+	msg *Message
+	cmd Command
+}{
+	{
+		&Message{Prefix: "bob", Command: "PRIVMSG", Params: []string{"#chan", "hi there"}},
+		&Privmsg{Prefix: "bob", Target: "#chan", Text: "hi there"},
+	},
+	{
+		&Message{Command: "NOTICE", Params: []string{"alice", ""}},
+		&Privmsg{Notice: true, Target: "alice"},
+	},
+	{
+		&Message{Command: "JOIN", Params: []string{"#a,#b,#c", "key1,key2"}},
+		&Join{Channels: []string{"#a", "#b", "#c"}, Keys: []string{"key1", "key2"}},
+	},
+	{
+		&Message{Prefix: "bob", Command: "JOIN", Params: []string{"#a"}},
+		&Join{Prefix: "bob", Channels: []string{"#a"}, Keys: []string{}},
+	},
+	{
+		&Message{Command: "PART", Params: []string{"#a,#b", "Going home"}},
+		&Part{Channels: []string{"#a", "#b"}, Reason: "Going home"},
+	},
+	{
+		&Message{Prefix: "op", Command: "KICK", Params: []string{"#a", "bob", "Spam"}},
+		&Kick{Prefix: "op", Channel: "#a", Nick: "bob", Reason: "Spam"},
+	},
+	{
+		&Message{Prefix: "bob", Command: "NICK", Params: []string{"bobby"}},
+		&Nick{Prefix: "bob", Nick: "bobby"},
+	},
+	{
+		&Message{Prefix: "bob", Command: "QUIT", Params: []string{}},
+		&Quit{Prefix: "bob"},
+	},
+	{
+		&Message{Command: "MODE", Params: []string{"#a", "+ov-b", "alice", "bob", "*!*@spam"}},
+		&Mode{Target: "#a", Modes: "+ov-b", Args: []string{"alice", "bob", "*!*@spam"}},
+	},
+	{
+		&Message{Command: "MODE", Params: []string{"#a"}},
+		&Mode{Target: "#a", Args: []string{}},
+	},
+	{
+		&Message{Command: "TOPIC", Params: []string{"#a"}},
+		&Topic{Channel: "#a"},
+	},
+	{
+		&Message{Command: "TOPIC", Params: []string{"#a", ""}},
+		&Topic{Channel: "#a", Set: true},
+	},
+	{
+		&Message{Prefix: "server", Command: RPL_WELCOME, Params: []string{"alice", "Welcome"}},
+		&Numeric{Prefix: "server", Code: RPL_WELCOME, Target: "alice", Params: []string{"Welcome"}},
+	},
+	{
+		&Message{Command: RPL_TOPIC, Params: []string{"alice", "#a", "The topic"}},
+		&TopicReply{Target: "alice", Channel: "#a", Topic: "The topic"},
+	},
+	{
+		&Message{Command: RPL_NAMEREPLY, Params: []string{"alice", "=", "#a", "@alice +bob carol"}},
+		&NamReply{Target: "alice", Symbol: "=", Channel: "#a", Nicks: []string{"@alice", "+bob", "carol"}},
+	},
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	for _, c := range sampleCommands {
+		cmd, err := ParseCommand(c.msg)
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", c.msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd, c.cmd) {
+			t.Errorf("ParseCommand(%q) = %#v, expected %#v.", c.msg, cmd, c.cmd)
+		}
+		if msg := cmd.ToMessage(); !reflect.DeepEqual(msg, c.msg) {
+			t.Errorf("%#v.ToMessage() = %q, expected %q.", cmd, msg, c.msg)
+		}
+	}
+}
+
+// Servers send extra parameters with JOIN under extended-join; these are not
+// keys.
+func TestJoinExtended(t *testing.T) {
+	join := &Join{}
+	err := join.FromMessage(&Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "JOIN",
+		Params:  []string{"#a", "bobsaccount", "Bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(join.Keys) != 0 {
+		t.Fatalf("Unexpected keys: %q", join.Keys)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	cases := []struct {
+		cmd  Command
+		msg  *Message
+		code string
+	}{
+		{&Privmsg{}, &Message{Command: "PRIVMSG", Params: []string{"#a"}}, ERR_NEEDMOREPARAMS},
+		{&Kick{}, &Message{Command: "KICK", Params: []string{"#a"}}, ERR_NEEDMOREPARAMS},
+		{&NamReply{}, &Message{Command: RPL_NAMEREPLY, Params: []string{"alice", "=", "#a"}}, ERR_NEEDMOREPARAMS},
+		{&Numeric{}, &Message{Command: RPL_WELCOME, Params: []string{}}, ERR_NEEDMOREPARAMS},
+		{&Join{}, &Message{Command: "PART", Params: []string{"#a"}}, ERR_UNKNOWNCOMMAND},
+		{&Numeric{}, &Message{Command: "PING", Params: []string{"x"}}, ERR_UNKNOWNCOMMAND},
+	}
+	for _, c := range cases {
+		before := reflect.ValueOf(c.cmd).Elem().Interface()
+		err := c.cmd.FromMessage(c.msg)
+		msgErr, ok := err.(*MessageError)
+		if !ok || msgErr.Command != c.code {
+			t.Errorf("%T.FromMessage(%q) = %v, expected a %s error.", c.cmd, c.msg, err, c.code)
+		}
+		if after := reflect.ValueOf(c.cmd).Elem().Interface(); !reflect.DeepEqual(before, after) {
+			t.Errorf("%T.FromMessage(%q) modified the command on error.", c.cmd, c.msg)
+		}
+	}
+}
+
+func TestParseCommandUntyped(t *testing.T) {
+	cmd, err := ParseCommand(&Message{Command: "PING", Params: []string{"x"}})
+	if cmd != nil || err != nil {
+		t.Fatalf("ParseCommand(PING) = (%#v, %v), expected (nil, nil).", cmd, err)
+	}
+}
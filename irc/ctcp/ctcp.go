@@ -0,0 +1,79 @@
+// Package ctcp handles the Client-To-Client Protocol, which is embedded in
+// the text of PRIVMSG and NOTICE messages. See:
+//
+// https://tools.ietf.org/html/draft-oakley-irc-ctcp-02
+//
+// A CTCP message is delimited by \x01 characters, and consists of a command,
+// optionally followed by a space and parameters, e.g. "\x01ACTION waves\x01".
+// Queries are sent via PRIVMSG and replies via NOTICE.
+//
+// The (long obsolete) low-level and CTCP-level quoting schemes from the
+// original specification are not implemented; modern clients don't use them.
+package ctcp
+
+import (
+	"strings"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+const delim = "\x01"
+
+// A Message is a decoded CTCP message.
+type Message struct {
+	Command string
+	Params  string
+}
+
+// Decode the CTCP message in `text`, which is the text of a PRIVMSG or
+// NOTICE. ok is false if `text` is not a CTCP message.
+//
+// Per the spec, the trailing delimiter is optional, since some clients
+// omit it. The command is converted to upper case.
+func Decode(text string) (msg *Message, ok bool) {
+	if !strings.HasPrefix(text, delim) {
+		return nil, false
+	}
+	text = strings.TrimSuffix(text[1:], delim)
+	parts := strings.SplitN(text, " ", 2)
+	if parts[0] == "" {
+		return nil, false
+	}
+	msg = &Message{Command: strings.ToUpper(parts[0])}
+	if len(parts) == 2 {
+		msg.Params = parts[1]
+	}
+	return msg, true
+}
+
+// Parse returns the CTCP message carried by `msg`, which must be a PRIVMSG
+// (for queries) or a NOTICE (for replies). ok is false if there isn't one.
+func Parse(msg *irc.Message) (ctcpMsg *Message, ok bool) {
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) < 2 {
+		return nil, false
+	}
+	return Decode(msg.Params[1])
+}
+
+// Encode returns `m` in the form it takes in the text of an IRC message.
+func (m *Message) Encode() string {
+	if m.Params == "" {
+		return delim + m.Command + delim
+	}
+	return delim + m.Command + " " + m.Params + delim
+}
+
+// Query returns a PRIVMSG sending the CTCP message `m` to `target`.
+func Query(target string, m *Message) *irc.Message {
+	return &irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{target, m.Encode()},
+	}
+}
+
+// Reply returns a NOTICE sending the CTCP message `m` to `target`.
+func Reply(target string, m *Message) *irc.Message {
+	return &irc.Message{
+		Command: "NOTICE",
+		Params:  []string{target, m.Encode()},
+	}
+}
@@ -0,0 +1,53 @@
+package ctcp
+
+import (
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		text    string
+		ok      bool
+		command string
+		params  string
+	}{
+		{"\x01ACTION waves\x01", true, "ACTION", "waves"},
+		{"\x01version\x01", true, "VERSION", ""},
+		{"\x01PING 12345", true, "PING", "12345"},
+		{"\x01ACTION waves at  bob \x01", true, "ACTION", "waves at  bob "},
+		{"hello", false, "", ""},
+		{"\x01\x01", false, "", ""},
+		{"", false, "", ""},
+	}
+	for _, c := range cases {
+		msg, ok := Decode(c.text)
+		if ok != c.ok {
+			t.Errorf("Decode(%q): expected ok = %v.", c.text, c.ok)
+			continue
+		}
+		if ok && (msg.Command != c.command || msg.Params != c.params) {
+			t.Errorf("Decode(%q) = %+v, expected (%q, %q).",
+				c.text, msg, c.command, c.params)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, m := range []*Message{
+		{Command: "ACTION", Params: "waves"},
+		{Command: "VERSION"},
+	} {
+		query := Query("bob", m)
+		if query.Command != "PRIVMSG" {
+			t.Fatalf("Query produced a %s.", query.Command)
+		}
+		decoded, ok := Parse(query)
+		if !ok || *decoded != *m {
+			t.Fatalf("Round trip of %+v gave %+v.", m, decoded)
+		}
+	}
+	if _, ok := Parse(&irc.Message{Command: "JOIN", Params: []string{"#a", "\x01X\x01"}}); ok {
+		t.Fatal("Parse should only accept PRIVMSG and NOTICE.")
+	}
+}
@@ -0,0 +1,132 @@
+package filters
+
+// This file defines the Filter interface, and ways of combining filters.
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// A Filter is a stage in a pipeline of messages.
+//
+// Run reads messages from `in` and sends messages (not necessarily the same
+// ones) on `out`. It returns nil once `in` is closed and it has sent
+// everything it means to, ctx.Err() if `ctx` is done first, or some other
+// error if it fails. It must not close `out`; whoever called Run does that
+// once it returns.
+type Filter interface {
+	Run(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error
+
+func (f FilterFunc) Run(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+	return f(ctx, in, out)
+}
+
+// A StageError is returned by a Chain when one of its stages fails.
+type StageError struct {
+	Stage int // The index of the stage in the chain.
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("Filter stage %d: %v", e.Stage, e.Err)
+}
+
+type chain []Filter
+
+// Chain returns a Filter which passes messages through each of `stages` in
+// turn. If a stage fails, Run cancels the others and returns a *StageError
+// describing the failure. An empty chain passes messages through unchanged.
+func Chain(stages ...Filter) Filter {
+	return chain(stages)
+}
+
+func (c chain) Run(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+	if len(c) == 0 {
+		return Map(nil).Run(ctx, in, out)
+	}
+	stageCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		stage int
+		err   error
+	}
+	results := make(chan result, len(c))
+	src := in
+	for i, stage := range c {
+		var next chan *irc.Message
+		dst := out
+		if i != len(c)-1 {
+			next = make(chan *irc.Message)
+			dst = next
+		}
+		go func(i int, stage Filter, src <-chan *irc.Message, dst chan<- *irc.Message) {
+			err := stage.Run(stageCtx, src, dst)
+			if next != nil {
+				close(next)
+			}
+			results <- result{i, err}
+		}(i, stage, src, dst)
+		src = next
+	}
+
+	var firstErr *StageError
+	for range c {
+		r := <-results
+		if r.err != nil && firstErr == nil {
+			firstErr = &StageError{Stage: r.stage, Err: r.err}
+			cancel()
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+	if ctx.Err() != nil && firstErr.Err == ctx.Err() {
+		// Not a failure of the stage; we were just cancelled.
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// Map returns a Filter which replaces each message with the result of
+// calling `f` on it, dropping it if that is nil. If `f` is nil, messages are
+// passed through unchanged.
+func Map(f func(*irc.Message) *irc.Message) Filter {
+	return FilterFunc(func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg, ok := <-in:
+				if !ok {
+					return nil
+				}
+				if f != nil {
+					msg = f(msg)
+				}
+				if msg == nil {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case out <- msg:
+				}
+			}
+		}
+	})
+}
+
+// Tap returns a Filter which calls `f` on each message before passing it
+// through unchanged, e.g. to log it.
+func Tap(f func(*irc.Message)) Filter {
+	return Map(func(msg *irc.Message) *irc.Message {
+		f(msg)
+		return msg
+	})
+}
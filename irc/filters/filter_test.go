@@ -0,0 +1,113 @@
+package filters
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// Run `f` on `msgs`, returning the messages it sends and the error it
+// returns.
+func runFilter(f Filter, msgs ...*irc.Message) ([]*irc.Message, error) {
+	in := make(chan *irc.Message, len(msgs))
+	for _, msg := range msgs {
+		in <- msg
+	}
+	close(in)
+	out := make(chan *irc.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f.Run(context.Background(), in, out)
+		close(out)
+	}()
+	ret := []*irc.Message{}
+	for msg := range out {
+		ret = append(ret, msg)
+	}
+	return ret, <-errs
+}
+
+func TestChain(t *testing.T) {
+	suffix := func(s string) Filter {
+		return Map(func(msg *irc.Message) *irc.Message {
+			return &irc.Message{Command: msg.Command + s}
+		})
+	}
+	dropB := Map(func(msg *irc.Message) *irc.Message {
+		if msg.Command == "B1" {
+			return nil
+		}
+		return msg
+	})
+	out, err := runFilter(Chain(suffix("1"), dropB, suffix("2")),
+		&irc.Message{Command: "A"},
+		&irc.Message{Command: "B"},
+		&irc.Message{Command: "C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].Command != "A12" || out[1].Command != "C12" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+
+	out, err = runFilter(Chain(), &irc.Message{Command: "A"})
+	if err != nil || len(out) != 1 || out[0].Command != "A" {
+		t.Fatalf("Empty chain: got (%q, %v).", out, err)
+	}
+}
+
+// When a stage fails, the chain should stop the rest and report which stage
+// it was.
+func TestChainError(t *testing.T) {
+	failure := errors.New("failure")
+	fail := FilterFunc(func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+		<-in
+		return failure
+	})
+	// The first stage would pass messages along forever, if it weren't
+	// stopped:
+	forever := FilterFunc(func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case out <- &irc.Message{Command: "PING"}:
+			}
+		}
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := runFilter(Chain(forever, Map(nil), fail))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		stageErr, ok := err.(*StageError)
+		if !ok || stageErr.Stage != 2 || stageErr.Err != failure {
+			t.Fatalf("Expected a StageError for stage 2, but got %v.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The chain didn't stop.")
+	}
+}
+
+// Cancelling the context should stop the chain, and it should report the
+// context's error rather than a stage's.
+func TestChainCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Chain(Map(nil), Map(nil)).Run(ctx, make(chan *irc.Message), make(chan *irc.Message))
+	}()
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, but got %v.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The chain didn't stop.")
+	}
+}
@@ -1,4 +1,9 @@
 // Package filters provides "filters" for IRC messages, useful for common processing tasks.
+//
+// Filters implement the Filter interface, and can be combined with Chain and
+// applied to a connection with Pipeline. RateLimit, AutoPong and AutoPing
+// predate these, and run as standalone goroutines instead; Throttle and
+// Keepalive are their Filter counterparts.
 package filters
 
 import (
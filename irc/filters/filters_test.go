@@ -59,7 +59,7 @@ func TestAutoPong(t *testing.T) {
 	in <- &irc.Message{Command: "PING", Params: []string{"One"}}
 	msgReply := <-reply
 	if !msgReply.Eq(&irc.Message{Command: "PONG", Params: []string{"One"}}) {
-		t.Fatal("Unexpected message on reply channel: %q\n")
+		t.Fatalf("Unexpected message on reply channel: %q\n", msgReply)
 	}
 
 	// More things other than PINGs:
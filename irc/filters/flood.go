@@ -0,0 +1,138 @@
+package filters
+
+// This file provides Throttle, which keeps us from sending messages faster
+// than a server will accept them.
+
+import (
+	"golang.org/x/net/context"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// FloodControl configures Throttle's token bucket. Like most servers' flood
+// protection, it is measured in bytes rather than messages, so that a burst
+// of short JOINs goes through faster than a paste of long lines.
+type FloodControl struct {
+	// The maximum number of bytes that may be sent at once, after a
+	// period of quiet.
+	Burst int
+
+	// The number of bytes per second that may be sent in the long run.
+	// If zero or negative, there is no limit.
+	Rate int
+}
+
+// DefaultFloodControl is conservative enough for common servers, which allow
+// a client roughly a kilobyte of unprocessed input.
+var DefaultFloodControl = FloodControl{Burst: 1024, Rate: 128}
+
+// Throttle returns a Filter which passes messages through only as fast as
+// `fc` allows, queueing the rest. It always reads from its input promptly, so
+// writers feeding it are never held up. PONGs are the exception to the limit:
+// they jump the queue and are passed on immediately (though they still count
+// against it), so that a long queue can't make us miss a server's PING
+// timeout.
+//
+// When its input is closed, Throttle sends the rest of the queue before
+// returning.
+func Throttle(fc FloodControl) Filter {
+	if fc.Rate <= 0 {
+		return Map(nil)
+	}
+	return FilterFunc(func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+		b := &bucket{fc: fc, tokens: float64(fc.Burst), last: time.Now()}
+		queue := []*irc.Message{}
+		for {
+			// Work out whether we can send the head of the queue now,
+			// or else how long we need to wait:
+			var (
+				sendC  chan<- *irc.Message
+				next   *irc.Message
+				timer  *time.Timer
+				timerC <-chan time.Time
+			)
+			if len(queue) != 0 {
+				next = queue[0]
+				if wait := b.wait(next); wait == 0 {
+					sendC = out
+				} else {
+					timer = time.NewTimer(wait)
+					timerC = timer.C
+				}
+			} else if in == nil {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg, ok := <-in:
+				if !ok {
+					in = nil
+				} else if msg.Command != "PONG" {
+					queue = append(queue, msg)
+				} else {
+					b.charge(msg)
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case out <- msg:
+					}
+				}
+			case sendC <- next:
+				b.charge(next)
+				queue = queue[1:]
+			case <-timerC:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	})
+}
+
+// A token bucket, where each token allows us to send a byte.
+type bucket struct {
+	fc     FloodControl
+	tokens float64
+	last   time.Time // When tokens was last refilled.
+}
+
+// Add the tokens accumulated since the last refill.
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.fc.Rate)
+	if b.tokens > float64(b.fc.Burst) {
+		b.tokens = float64(b.fc.Burst)
+	}
+	b.last = now
+}
+
+// Return how long we must wait until we can send `msg`; 0 if we can send it
+// now.
+func (b *bucket) wait(msg *irc.Message) time.Duration {
+	b.refill()
+	missing := b.cost(msg) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(b.fc.Rate) * float64(time.Second))
+}
+
+// Deduct the cost of sending `msg`. This may leave the bucket in debt, if
+// the message was sent without waiting for it.
+func (b *bucket) charge(msg *irc.Message) {
+	b.refill()
+	b.tokens -= b.cost(msg)
+}
+
+// The number of tokens it costs to send `msg`. This is its length, but no more
+// than the burst size, so that a message longer than that can still be sent
+// (from a full bucket).
+func (b *bucket) cost(msg *irc.Message) float64 {
+	cost := msg.Len()
+	if cost > b.fc.Burst {
+		cost = b.fc.Burst
+	}
+	return float64(cost)
+}
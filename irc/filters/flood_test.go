@@ -0,0 +1,82 @@
+package filters
+
+import (
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// A PRIVMSG which is `n` bytes long, including the CRLF.
+func msgOfLen(n int) *irc.Message {
+	prefix := "PRIVMSG #a "
+	return &irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#a", strings.Repeat("x", n-len(prefix)-2)},
+	}
+}
+
+// Start `f` in the background, returning its input and output.
+func startFilter(f Filter) (in chan<- *irc.Message, out <-chan *irc.Message, cancel context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inC, outC := make(chan *irc.Message), make(chan *irc.Message, 100)
+	go f.Run(ctx, inC, outC)
+	return inC, outC, cancel
+}
+
+// Messages within the burst should go through right away; the rest should
+// wait for the bucket to refill.
+func TestThrottle(t *testing.T) {
+	start := time.Now()
+	in, out, cancel := startFilter(Throttle(FloodControl{Burst: 200, Rate: 1000}))
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		in <- msgOfLen(100)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Throttle took %v to accept its input.", elapsed)
+	}
+	for i := 0; i < 6; i++ {
+		<-out
+		if i == 1 && time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("Messages within the burst took %v to send.", time.Since(start))
+		}
+	}
+	// 600 bytes, 200 of which are covered by the burst:
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Sent 600 bytes in %v; that's too fast.", elapsed)
+	}
+}
+
+// PONGs shouldn't wait behind queued messages.
+func TestThrottlePong(t *testing.T) {
+	in, out, cancel := startFilter(Throttle(FloodControl{Burst: 100, Rate: 10}))
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		in <- msgOfLen(100)
+	}
+	<-out
+	pong := &irc.Message{Command: "PONG", Params: []string{"x"}}
+	in <- pong
+	select {
+	case msg := <-out:
+		if !msg.Eq(pong) {
+			t.Fatalf("Expected the PONG, but got %q.", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The PONG was delayed.")
+	}
+}
+
+// Once its input is closed, Throttle should send the rest of the queue and
+// then return.
+func TestThrottleFlush(t *testing.T) {
+	msgs := []*irc.Message{msgOfLen(100), msgOfLen(100), msgOfLen(100)}
+	out, err := runFilter(Throttle(FloodControl{Burst: 100, Rate: 10000}), msgs...)
+	if err != nil || len(out) != len(msgs) {
+		t.Fatalf("Expected %d messages and no error, but got (%q, %v).", len(msgs), out, err)
+	}
+}
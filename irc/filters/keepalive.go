@@ -0,0 +1,71 @@
+package filters
+
+// This file provides Keepalive, which answers PINGs and detects dead
+// connections.
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// ErrPingTimeout is returned by a Keepalive filter when the peer doesn't
+// answer a PING in time.
+var ErrPingTimeout = errors.New("Ping timeout")
+
+// Keepalive returns a Filter, for messages received from a peer, which keeps
+// the connection alive and notices when it has died.
+//
+// It answers PINGs itself, by writing PONGs to `reply`, and swallows PONGs.
+// If it doesn't see a message for `pingTime`, it writes a PING with the
+// parameter `token`, and if it doesn't see one for that long again, it fails
+// with ErrPingTimeout. It also fails if writing to `reply` does.
+func Keepalive(pingTime time.Duration, token string, reply irc.Writer) Filter {
+	return FilterFunc(func(ctx context.Context, in <-chan *irc.Message, out chan<- *irc.Message) error {
+		pingSent := false
+		timer := time.NewTimer(pingTime)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				if pingSent {
+					return ErrPingTimeout
+				}
+				err := reply.WriteMessage(&irc.Message{Command: "PING", Params: []string{token}})
+				if err != nil {
+					return err
+				}
+				pingSent = true
+				timer.Reset(pingTime)
+			case msg, ok := <-in:
+				if !ok {
+					return nil
+				}
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(pingTime)
+				pingSent = false
+
+				switch msg.Command {
+				case "PING":
+					err := reply.WriteMessage(&irc.Message{Command: "PONG", Params: msg.Params})
+					if err != nil {
+						return err
+					}
+					continue
+				case "PONG":
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case out <- msg:
+				}
+			}
+		}
+	})
+}
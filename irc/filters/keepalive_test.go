@@ -0,0 +1,63 @@
+package filters
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// A Writer which sends messages on a channel.
+type chanWriter chan *irc.Message
+
+func (w chanWriter) WriteMessage(msg *irc.Message) error {
+	w <- msg
+	return nil
+}
+
+func TestKeepalive(t *testing.T) {
+	const pingTime = 50 * time.Millisecond
+	replies := make(chanWriter, 10)
+	in, out, cancel := startFilter(Keepalive(pingTime, "token", replies))
+	defer cancel()
+
+	// PINGs should be answered, and neither they nor PONGs passed on:
+	in <- &irc.Message{Command: "PING", Params: []string{"abc"}}
+	in <- &irc.Message{Command: "PONG", Params: []string{"token"}}
+	privmsg := &irc.Message{Command: "PRIVMSG", Params: []string{"#a", "hi"}}
+	in <- privmsg
+	if msg := <-out; !msg.Eq(privmsg) {
+		t.Fatalf("Expected the PRIVMSG, but got %q.", msg)
+	}
+	if msg := <-replies; !msg.Eq(&irc.Message{Command: "PONG", Params: []string{"abc"}}) {
+		t.Fatalf("Expected a PONG, but got %q.", msg)
+	}
+
+	// After a quiet period, it should PING:
+	select {
+	case msg := <-replies:
+		if !msg.Eq(&irc.Message{Command: "PING", Params: []string{"token"}}) {
+			t.Fatalf("Expected a PING, but got %q.", msg)
+		}
+	case <-time.After(10 * pingTime):
+		t.Fatal("No PING was sent.")
+	}
+}
+
+// If the peer doesn't answer a PING, the filter should fail.
+func TestKeepaliveTimeout(t *testing.T) {
+	replies := make(chanWriter, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Keepalive(10*time.Millisecond, "token", replies).
+			Run(context.Background(), make(chan *irc.Message), make(chan *irc.Message))
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrPingTimeout {
+			t.Fatalf("Expected ErrPingTimeout, but got %v.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The keepalive didn't time out.")
+	}
+}
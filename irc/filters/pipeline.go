@@ -0,0 +1,175 @@
+package filters
+
+// This file defines Pipeline, which runs a connection's messages through
+// filters.
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"sync"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// ErrPipelineClosed is reported by Pipeline.Err after Close.
+var ErrPipelineClosed = errors.New("Pipeline closed")
+
+// A WriteError is reported by Pipeline.Err when writing to the underlying
+// connection failed.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "Write failed: " + e.Err.Error()
+}
+
+// A Pipeline wraps a connection, passing the messages read from it through
+// one filter and, optionally, those written to it through another.
+//
+// When anything goes wrong -- the connection fails in either direction, or a
+// filter fails -- the Pipeline closes the connection and C, and Err reports
+// what happened.
+type Pipeline struct {
+	// Messages read from the connection, after filtering. This is closed
+	// when the pipeline ends, after which Err reports why.
+	C <-chan *irc.Message
+
+	conn     irc.ReadWriteCloser
+	received chan *irc.Message
+
+	// Messages to pass to the outgoing filter; nil if there isn't one.
+	toSend chan *irc.Message
+
+	// Serializes writes to conn, if there is no outgoing filter.
+	writeLock sync.Mutex
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	lock sync.Mutex // Protects err.
+	err  error
+}
+
+// NewPipeline returns a Pipeline for `conn`. It does nothing until Start is
+// called; in the meantime, the Pipeline can be passed to filters which need
+// to write to the connection themselves, e.g. a Keepalive.
+func NewPipeline(conn irc.ReadWriteCloser) *Pipeline {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan *irc.Message)
+	return &Pipeline{
+		C:        received,
+		conn:     conn,
+		received: received,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start starts passing received messages through `in`, and sent messages
+// through `out`. If `out` is nil, messages are written to the connection
+// directly, and WriteMessage reports any error in doing so. Otherwise, they
+// are written in the background, and errors are only reported via Err.
+//
+// Start must be called exactly once, before WriteMessage.
+func (p *Pipeline) Start(in, out Filter) {
+	stream := irc.NewStream(p.ctx, p.conn)
+	go func() {
+		err := in.Run(p.ctx, stream.C, p.received)
+		if err == nil {
+			// The filter finished because the stream did:
+			err = stream.Err()
+		}
+		p.fail(err)
+		close(p.received)
+	}()
+	if out == nil {
+		return
+	}
+
+	p.toSend = make(chan *irc.Message)
+	sink := make(chan *irc.Message)
+	go func() {
+		// Nothing closes toSend, so this only returns on failure or
+		// cancellation:
+		if err := out.Run(p.ctx, p.toSend, sink); err != nil {
+			p.fail(err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case msg := <-sink:
+				if p.write(msg) != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// WriteMessage sends `msg` on its way to the connection; see Start. It
+// returns an error right away if the message fails msg.CheckWritable, or if
+// the pipeline has ended.
+func (p *Pipeline) WriteMessage(msg *irc.Message) error {
+	if err := msg.CheckWritable(); err != nil {
+		return err
+	}
+	if p.toSend == nil {
+		if err := p.Err(); err != nil {
+			return err
+		}
+		return p.write(msg)
+	}
+	select {
+	case <-p.ctx.Done():
+		return p.Err()
+	case p.toSend <- msg:
+		return nil
+	}
+}
+
+// Write `msg` to the connection, ending the pipeline on failure.
+func (p *Pipeline) write(msg *irc.Message) error {
+	p.writeLock.Lock()
+	err := p.conn.WriteMessage(msg)
+	p.writeLock.Unlock()
+	if err != nil {
+		p.fail(&WriteError{Err: err})
+	}
+	return err
+}
+
+// Err returns the error that ended the pipeline, or nil if it hasn't ended.
+// Besides ErrPipelineClosed and *WriteError, this may be a *StageError if one
+// of the filters failed, or whatever ended the stream of received messages
+// (see irc.Stream.Err); notably, io.EOF if the peer closed the connection.
+func (p *Pipeline) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// Close ends the pipeline, discarding any messages still on their way
+// through the outgoing filter, and closes the connection.
+func (p *Pipeline) Close() error {
+	p.fail(ErrPipelineClosed)
+	return nil
+}
+
+// End the pipeline because of `err`, unless it has already ended.
+func (p *Pipeline) fail(err error) {
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.lock.Unlock()
+	p.closeOnce.Do(func() {
+		p.cancel()
+		// Closing the connection unblocks any read or write in
+		// progress.
+		p.conn.Close()
+	})
+}
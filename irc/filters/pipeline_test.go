@@ -0,0 +1,97 @@
+package filters
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// Returns a Pipeline on one end of a net.Pipe, and the other end.
+func newTestPipeline() (*Pipeline, irc.ReadWriteCloser) {
+	a, b := net.Pipe()
+	return NewPipeline(irc.NewReadWriteCloser(a)), irc.NewReadWriteCloser(b)
+}
+
+// Messages should pass through the filters in both directions, and the
+// pipeline should report the peer closing the connection.
+func TestPipeline(t *testing.T) {
+	p, peer := newTestPipeline()
+	defer p.Close()
+	upcase := func(command string) Filter {
+		return Map(func(msg *irc.Message) *irc.Message {
+			return &irc.Message{Command: command, Params: msg.Params}
+		})
+	}
+	p.Start(upcase("RECEIVED"), upcase("SENT"))
+
+	go peer.WriteMessage(&irc.Message{Command: "PING", Params: []string{"a"}})
+	if msg := <-p.C; msg.Command != "RECEIVED" {
+		t.Fatalf("Expected a RECEIVED, but got %q.", msg)
+	}
+	if err := p.WriteMessage(&irc.Message{Command: "PING", Params: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := peer.ReadMessage(); err != nil || msg.Command != "SENT" {
+		t.Fatalf("Expected a SENT, but got (%q, %v).", msg, err)
+	}
+
+	peer.Close()
+	for range p.C {
+	}
+	if p.Err() != io.EOF {
+		t.Fatalf("Expected io.EOF, but got %v.", p.Err())
+	}
+}
+
+// Without an outgoing filter, WriteMessage should report write errors
+// directly. Either way, they should end the pipeline.
+func TestPipelineWriteError(t *testing.T) {
+	p, peer := newTestPipeline()
+	p.Start(Chain(), nil)
+	peer.Close()
+
+	msg := &irc.Message{Command: "PING", Params: []string{"a"}}
+	if err := p.WriteMessage(msg); err == nil {
+		t.Fatal("Writing to a closed connection should fail.")
+	}
+	select {
+	case _, ok := <-p.C:
+		if ok {
+			t.Fatal("Unexpected message.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The pipeline didn't end.")
+	}
+	if p.WriteMessage(msg) == nil {
+		t.Fatal("Writing to an ended pipeline should fail.")
+	}
+}
+
+// A failing filter should end the pipeline, which should report it.
+func TestPipelineFilterError(t *testing.T) {
+	p, peer := newTestPipeline()
+	defer peer.Close()
+	p.Start(Keepalive(10*time.Millisecond, "token", chanWriter(make(chan *irc.Message, 10))), nil)
+	for range p.C {
+	}
+	if p.Err() != ErrPingTimeout {
+		t.Fatalf("Expected ErrPingTimeout, but got %v.", p.Err())
+	}
+}
+
+func TestPipelineClose(t *testing.T) {
+	p, peer := newTestPipeline()
+	defer peer.Close()
+	p.Start(Chain(), Chain())
+	p.Close()
+	for range p.C {
+	}
+	if p.Err() != ErrPipelineClosed {
+		t.Fatalf("Expected ErrPipelineClosed, but got %v.", p.Err())
+	}
+	if _, err := peer.ReadMessage(); err == nil {
+		t.Fatal("The connection should have been closed.")
+	}
+}
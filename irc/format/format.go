@@ -0,0 +1,325 @@
+// Package format handles the (mIRC-derived) formatting codes used in the
+// text of IRC messages: bold, italics, colors and so on. See:
+//
+// https://modern.ircdocs.horse/formatting.html
+//
+// Parse splits text into spans of uniformly formatted text. Strip and HTML
+// build on that to remove the formatting entirely or render it as HTML,
+// respectively.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Control characters which affect formatting.
+const (
+	Bold          = '\x02'
+	Color         = '\x03'
+	HexColor      = '\x04'
+	Monospace     = '\x11'
+	Reverse       = '\x16'
+	Italic        = '\x1d'
+	Strikethrough = '\x1e'
+	Underline     = '\x1f'
+	Reset         = '\x0f'
+)
+
+// The mIRC color palette. Colors 0-15 are the "classic" colors, whose exact
+// appearance varies between clients; 16-98 are the extended colors. 99 means
+// "default color", and is not in the table.
+var palette = [99][3]byte{
+	{0xff, 0xff, 0xff}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x7f}, {0x00, 0x93, 0x00},
+	{0xff, 0x00, 0x00}, {0x7f, 0x00, 0x00}, {0x9c, 0x00, 0x9c}, {0xfc, 0x7f, 0x00},
+	{0xff, 0xff, 0x00}, {0x00, 0xfc, 0x00}, {0x00, 0x93, 0x93}, {0x00, 0xff, 0xff},
+	{0x00, 0x00, 0xfc}, {0xff, 0x00, 0xff}, {0x7f, 0x7f, 0x7f}, {0xd2, 0xd2, 0xd2},
+
+	{0x47, 0x00, 0x00}, {0x47, 0x21, 0x00}, {0x47, 0x47, 0x00}, {0x32, 0x47, 0x00},
+	{0x00, 0x47, 0x00}, {0x00, 0x47, 0x2c}, {0x00, 0x47, 0x47}, {0x00, 0x27, 0x47},
+	{0x00, 0x00, 0x47}, {0x2e, 0x00, 0x47}, {0x47, 0x00, 0x47}, {0x47, 0x00, 0x2a},
+
+	{0x74, 0x00, 0x00}, {0x74, 0x3a, 0x00}, {0x74, 0x74, 0x00}, {0x51, 0x74, 0x00},
+	{0x00, 0x74, 0x00}, {0x00, 0x74, 0x49}, {0x00, 0x74, 0x74}, {0x00, 0x40, 0x74},
+	{0x00, 0x00, 0x74}, {0x4b, 0x00, 0x74}, {0x74, 0x00, 0x74}, {0x74, 0x00, 0x45},
+
+	{0xb5, 0x00, 0x00}, {0xb5, 0x63, 0x00}, {0xb5, 0xb5, 0x00}, {0x7d, 0xb5, 0x00},
+	{0x00, 0xb5, 0x00}, {0x00, 0xb5, 0x71}, {0x00, 0xb5, 0xb5}, {0x00, 0x63, 0xb5},
+	{0x00, 0x00, 0xb5}, {0x75, 0x00, 0xb5}, {0xb5, 0x00, 0xb5}, {0xb5, 0x00, 0x6b},
+
+	{0xff, 0x00, 0x00}, {0xff, 0x8c, 0x00}, {0xff, 0xff, 0x00}, {0xb2, 0xff, 0x00},
+	{0x00, 0xff, 0x00}, {0x00, 0xff, 0xa0}, {0x00, 0xff, 0xff}, {0x00, 0x8c, 0xff},
+	{0x00, 0x00, 0xff}, {0xa5, 0x00, 0xff}, {0xff, 0x00, 0xff}, {0xff, 0x00, 0x98},
+
+	{0xff, 0x59, 0x59}, {0xff, 0xb4, 0x59}, {0xff, 0xff, 0x71}, {0xcf, 0xff, 0x60},
+	{0x6f, 0xff, 0x6f}, {0x65, 0xff, 0xc9}, {0x6d, 0xff, 0xff}, {0x59, 0xb4, 0xff},
+	{0x59, 0x59, 0xff}, {0xc4, 0x59, 0xff}, {0xff, 0x66, 0xff}, {0xff, 0x59, 0xbc},
+
+	{0xff, 0x9c, 0x9c}, {0xff, 0xd3, 0x9c}, {0xff, 0xff, 0x9c}, {0xe2, 0xff, 0x9c},
+	{0x9c, 0xff, 0x9c}, {0x9c, 0xff, 0xdb}, {0x9c, 0xff, 0xff}, {0x9c, 0xd3, 0xff},
+	{0x9c, 0x9c, 0xff}, {0xdc, 0x9c, 0xff}, {0xff, 0x9c, 0xff}, {0xff, 0x94, 0xd3},
+
+	{0x00, 0x00, 0x00}, {0x13, 0x13, 0x13}, {0x28, 0x28, 0x28}, {0x36, 0x36, 0x36},
+	{0x4d, 0x4d, 0x4d}, {0x65, 0x65, 0x65}, {0x81, 0x81, 0x81}, {0x9f, 0x9f, 0x9f},
+	{0xbc, 0xbc, 0xbc}, {0xe2, 0xe2, 0xe2}, {0xff, 0xff, 0xff},
+}
+
+// A TextColor is a foreground or background color. The zero value is the
+// default color (i.e. whatever the client would otherwise use).
+type TextColor struct {
+	set   bool
+	index int // Palette index, or -1 for a color given in hex.
+	rgb   [3]byte
+}
+
+// PaletteColor returns the color with index `i` in the mIRC palette. Index 99
+// (or any other out of range value) is the default color.
+func PaletteColor(i int) TextColor {
+	if i < 0 || i >= len(palette) {
+		return TextColor{}
+	}
+	return TextColor{set: true, index: i, rgb: palette[i]}
+}
+
+// RGBColor returns the color with the given red, green and blue components.
+func RGBColor(r, g, b byte) TextColor {
+	return TextColor{set: true, index: -1, rgb: [3]byte{r, g, b}}
+}
+
+// IsDefault returns true if c is the default color.
+func (c TextColor) IsDefault() bool {
+	return !c.set
+}
+
+// Index returns c's index in the mIRC palette. ok is false if c is the
+// default color, or was specified in hex rather than via the palette.
+func (c TextColor) Index() (i int, ok bool) {
+	if !c.set || c.index < 0 {
+		return 0, false
+	}
+	return c.index, true
+}
+
+// CSS returns c as a CSS color, e.g. "#ff0000". For the default color,
+// returns "".
+func (c TextColor) CSS() string {
+	if !c.set {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.rgb[0], c.rgb[1], c.rgb[2])
+}
+
+// A Style is the formatting in effect for a piece of text.
+type Style struct {
+	Bold, Italic, Underline, Strikethrough, Monospace bool
+
+	// Swap the foreground and background colors.
+	Reverse bool
+
+	Foreground, Background TextColor
+}
+
+// A Span is a piece of text with uniform formatting.
+type Span struct {
+	Style
+	Text string
+}
+
+// Parse splits `text` into spans, according to the formatting codes it
+// contains. The codes themselves are not included in the spans' text. Empty
+// spans are omitted, so plain text yields a single span with the zero Style
+// (and the empty string yields no spans).
+func Parse(text string) []Span {
+	spans := []Span{}
+	cur := Style{}
+	buf := &bytes.Buffer{}
+	flush := func() {
+		if buf.Len() != 0 {
+			spans = append(spans, Span{Style: cur, Text: buf.String()})
+			buf.Reset()
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case Bold, Italic, Underline, Strikethrough, Monospace, Reverse, Reset:
+			flush()
+			switch c {
+			case Bold:
+				cur.Bold = !cur.Bold
+			case Italic:
+				cur.Italic = !cur.Italic
+			case Underline:
+				cur.Underline = !cur.Underline
+			case Strikethrough:
+				cur.Strikethrough = !cur.Strikethrough
+			case Monospace:
+				cur.Monospace = !cur.Monospace
+			case Reverse:
+				cur.Reverse = !cur.Reverse
+			case Reset:
+				cur = Style{}
+			}
+		case Color:
+			flush()
+			n := parseColor(text[i+1:], &cur)
+			i += n
+		case HexColor:
+			flush()
+			n := parseHexColor(text[i+1:], &cur)
+			i += n
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+	return spans
+}
+
+// Parse the arguments to a \x03 color code from the start of `text`, and
+// update `style` accordingly. Returns the number of bytes consumed.
+func parseColor(text string, style *Style) int {
+	fg, n := parseDigits(text)
+	if n == 0 {
+		// A bare color code resets the colors.
+		style.Foreground = TextColor{}
+		style.Background = TextColor{}
+		return 0
+	}
+	style.Foreground = PaletteColor(fg)
+	if n+1 < len(text) && text[n] == ',' {
+		if bg, m := parseDigits(text[n+1:]); m != 0 {
+			style.Background = PaletteColor(bg)
+			n += 1 + m
+		}
+	}
+	return n
+}
+
+// Parse up to two decimal digits from the start of `text`. Returns the value
+// and the number of digits.
+func parseDigits(text string) (value, n int) {
+	for n < 2 && n < len(text) && text[n] >= '0' && text[n] <= '9' {
+		value = value*10 + int(text[n]-'0')
+		n++
+	}
+	return value, n
+}
+
+// Like parseColor, but for \x04 (hex) color codes, which take the form
+// RRGGBB[,RRGGBB].
+func parseHexColor(text string, style *Style) int {
+	fg, ok := parseRGB(text)
+	if !ok {
+		style.Foreground = TextColor{}
+		style.Background = TextColor{}
+		return 0
+	}
+	style.Foreground = fg
+	if len(text) > 7 && text[6] == ',' {
+		if bg, ok := parseRGB(text[7:]); ok {
+			style.Background = bg
+			return 13
+		}
+	}
+	return 6
+}
+
+func parseRGB(text string) (TextColor, bool) {
+	if len(text) < 6 {
+		return TextColor{}, false
+	}
+	value, err := strconv.ParseUint(text[:6], 16, 32)
+	if err != nil {
+		return TextColor{}, false
+	}
+	return RGBColor(byte(value>>16), byte(value>>8), byte(value)), true
+}
+
+// CodeLen returns the length in bytes of the formatting code (including any
+// color arguments) at the start of `text`, or 0 if `text` doesn't start with
+// one. This is useful for splitting text without cutting a code in half.
+func CodeLen(text string) int {
+	if text == "" {
+		return 0
+	}
+	switch text[0] {
+	case Bold, Italic, Underline, Strikethrough, Monospace, Reverse, Reset:
+		return 1
+	case Color:
+		return 1 + parseColor(text[1:], &Style{})
+	case HexColor:
+		return 1 + parseHexColor(text[1:], &Style{})
+	default:
+		return 0
+	}
+}
+
+// Strip returns `text` with all formatting codes removed.
+func Strip(text string) string {
+	buf := &bytes.Buffer{}
+	for _, span := range Parse(text) {
+		buf.WriteString(span.Text)
+	}
+	return buf.String()
+}
+
+// HTML renders `text` as HTML, with formatting converted to inline CSS. The
+// text itself is escaped, so the result is safe to embed in a page.
+//
+// Reversed text with a default color assumes the default is black text on a
+// white background, since we can't know what the viewer's actually is.
+func HTML(text string) string {
+	buf := &bytes.Buffer{}
+	for _, span := range Parse(text) {
+		css := span.css()
+		if css == "" {
+			buf.WriteString(html.EscapeString(span.Text))
+			continue
+		}
+		fmt.Fprintf(buf, `<span style="%s">%s</span>`, css, html.EscapeString(span.Text))
+	}
+	return buf.String()
+}
+
+// Return the CSS declarations for the style, or "" if it's the default.
+func (s Style) css() string {
+	decls := []string{}
+	if s.Bold {
+		decls = append(decls, "font-weight: bold")
+	}
+	if s.Italic {
+		decls = append(decls, "font-style: italic")
+	}
+	if s.Monospace {
+		decls = append(decls, "font-family: monospace")
+	}
+	switch {
+	case s.Underline && s.Strikethrough:
+		decls = append(decls, "text-decoration: underline line-through")
+	case s.Underline:
+		decls = append(decls, "text-decoration: underline")
+	case s.Strikethrough:
+		decls = append(decls, "text-decoration: line-through")
+	}
+	fg, bg := s.Foreground, s.Background
+	if s.Reverse {
+		if fg.IsDefault() {
+			fg = PaletteColor(1)
+		}
+		if bg.IsDefault() {
+			bg = PaletteColor(0)
+		}
+		fg, bg = bg, fg
+	}
+	if !fg.IsDefault() {
+		decls = append(decls, "color: "+fg.CSS())
+	}
+	if !bg.IsDefault() {
+		decls = append(decls, "background-color: "+bg.CSS())
+	}
+	return strings.Join(decls, "; ")
+}
@@ -0,0 +1,89 @@
+package format
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		text  string
+		spans []Span
+	}{
+		{"", []Span{}},
+		{"plain", []Span{{Text: "plain"}}},
+		{"a\x02b\x02c", []Span{
+			{Text: "a"},
+			{Style: Style{Bold: true}, Text: "b"},
+			{Text: "c"},
+		}},
+		{"\x02\x1dboth\x0fnone", []Span{
+			{Style: Style{Bold: true, Italic: true}, Text: "both"},
+			{Text: "none"},
+		}},
+		{"\x034red\x03none", []Span{
+			{Style: Style{Foreground: PaletteColor(4)}, Text: "red"},
+			{Text: "none"},
+		}},
+		{"\x0304,12x\x0399,1y", []Span{
+			{Style: Style{Foreground: PaletteColor(4), Background: PaletteColor(12)}, Text: "x"},
+			{Style: Style{Background: PaletteColor(1)}, Text: "y"},
+		}},
+		// Only two digits are consumed, and a comma without a digit
+		// after it is just text:
+		{"\x03123,", []Span{{Style: Style{Foreground: PaletteColor(12)}, Text: "3,"}}},
+		{"\x03,5", []Span{{Text: ",5"}}},
+		{"\x04FF8000,000000hex", []Span{
+			{Style: Style{Foreground: RGBColor(0xff, 0x80, 0), Background: RGBColor(0, 0, 0)}, Text: "hex"},
+		}},
+	}
+	for _, c := range cases {
+		spans := Parse(c.text)
+		if !reflect.DeepEqual(spans, c.spans) {
+			t.Errorf("Parse(%q) = %+v, expected %+v.", c.text, spans, c.spans)
+		}
+	}
+}
+
+func TestStrip(t *testing.T) {
+	text := "\x02bold\x02 \x0304,01red\x03 \x1ditalic\x0f \x16rev\x16"
+	if plain := Strip(text); plain != "bold red italic rev" {
+		t.Fatalf("Strip(%q) = %q.", text, plain)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	cases := []struct {
+		text, html string
+	}{
+		{"<b>&", "&lt;b&gt;&amp;"},
+		{"\x02x", `<span style="font-weight: bold">x</span>`},
+		{"\x1f\x1eu", `<span style="text-decoration: underline line-through">u</span>`},
+		{"\x034,2c", `<span style="color: #ff0000; background-color: #00007f">c</span>`},
+		{"\x16r", `<span style="color: #ffffff; background-color: #000000">r</span>`},
+	}
+	for _, c := range cases {
+		if html := HTML(c.text); html != c.html {
+			t.Errorf("HTML(%q) = %q, expected %q.", c.text, html, c.html)
+		}
+	}
+}
+
+func TestCodeLen(t *testing.T) {
+	cases := []struct {
+		text string
+		n    int
+	}{
+		{"", 0},
+		{"x\x02", 0},
+		{"\x02x", 1},
+		{"\x03x", 1},
+		{"\x0312,3x", 5},
+		{"\x04ABCDEF,012345x", 14},
+	}
+	for _, c := range cases {
+		if n := CodeLen(c.text); n != c.n {
+			t.Errorf("CodeLen(%q) = %d, expected %d.", c.text, n, c.n)
+		}
+	}
+}
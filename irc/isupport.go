@@ -0,0 +1,272 @@
+package irc
+
+// This file deals with RPL_ISUPPORT, via which servers advertise the
+// parameters of the protocol they actually speak (channel types, nick length,
+// case mapping, etc.). The de-facto spec is:
+//
+// https://tools.ietf.org/html/draft-brocklesby-irc-isupport-03
+//
+// with additional tokens documented at http://www.irc.org/tech_docs/005.html
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Maximum number of tokens in a single RPL_ISUPPORT message. Along with
+	// the nick at the start and the text at the end, this comes to 15
+	// parameters.
+	maxISupportTokens = 13
+)
+
+// Defaults for tokens that have them, per the spec. These apply if the server
+// doesn't say otherwise.
+var isupportDefaults = map[string]string{
+	"CASEMAPPING": "rfc1459",
+	"CHANMODES":   "beI,k,l,imnpst",
+	"CHANTYPES":   "#&",
+	"NICKLEN":     "9",
+	"PREFIX":      "(ov)@+",
+}
+
+// An ISupport holds the parameters a server has advertised via RPL_ISUPPORT.
+// The zero value is not useful; use NewISupport.
+type ISupport struct {
+	tokens map[string]string
+
+	// Token names in the order we first saw them, so we can reproduce the
+	// server's messages faithfully.
+	order []string
+}
+
+// NewISupport returns an ISupport with no tokens set.
+func NewISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// Update the parameters from an RPL_ISUPPORT message. Servers send several of
+// these, each of which adds to (or, via "-TOKEN", removes from) the set.
+// Messages with other commands are ignored.
+func (is *ISupport) Update(msg *Message) {
+	if msg.Command != RPL_ISUPPORT || len(msg.Params) < 3 {
+		return
+	}
+	// The first parameter is our nick, and the last is the
+	// human-readable "are supported by this server".
+	for _, token := range msg.Params[1 : len(msg.Params)-1] {
+		if strings.HasPrefix(token, "-") {
+			is.remove(token[1:])
+			continue
+		}
+		kv := strings.SplitN(token, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = unescapeISupportValue(kv[1])
+		}
+		if _, ok := is.tokens[kv[0]]; !ok {
+			is.order = append(is.order, kv[0])
+		}
+		is.tokens[kv[0]] = value
+	}
+}
+
+func (is *ISupport) remove(name string) {
+	if _, ok := is.tokens[name]; !ok {
+		return
+	}
+	delete(is.tokens, name)
+	for i, v := range is.order {
+		if v == name {
+			is.order = append(is.order[:i], is.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get returns the value of the token `name`, and whether the server sent it
+// at all. Tokens sent without a value have a value of "". Defaults are not
+// applied; use the more specific methods for that.
+func (is *ISupport) Get(name string) (value string, ok bool) {
+	value, ok = is.tokens[name]
+	return
+}
+
+// Like Get, but falls back to the default for the token, if any.
+func (is *ISupport) getDefault(name string) string {
+	if value, ok := is.tokens[name]; ok && value != "" {
+		return value
+	}
+	return isupportDefaults[name]
+}
+
+// Messages returns RPL_ISUPPORT messages conveying the same parameters, with
+// the given prefix, addressed to `nick`. This is useful for replaying the
+// parameters to a client, since the server only sends them once.
+func (is *ISupport) Messages(prefix, nick string) []*Message {
+	ret := []*Message{}
+	tokens := make([]string, len(is.order))
+	for i, name := range is.order {
+		tokens[i] = name
+		if value := is.tokens[name]; value != "" {
+			tokens[i] += "=" + escapeISupportValue(value)
+		}
+	}
+	for len(tokens) != 0 {
+		n := len(tokens)
+		if n > maxISupportTokens {
+			n = maxISupportTokens
+		}
+		params := append([]string{nick}, tokens[:n]...)
+		ret = append(ret, &Message{
+			Prefix:  prefix,
+			Command: RPL_ISUPPORT,
+			Params:  append(params, "are supported by this server"),
+		})
+		tokens = tokens[n:]
+	}
+	return ret
+}
+
+// ChanTypes returns the characters which may start a channel name.
+func (is *ISupport) ChanTypes() string {
+	if value, ok := is.tokens["CHANTYPES"]; ok {
+		// An empty value is meaningful here: no channels at all.
+		return value
+	}
+	return isupportDefaults["CHANTYPES"]
+}
+
+// IsChannel returns true if `name` is a channel name, false otherwise.
+func (is *ISupport) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(is.ChanTypes(), name[0]) != -1
+}
+
+// ChannelTarget interprets `target`, the target of a PRIVMSG or NOTICE. If
+// it denotes a channel, possibly with a STATUSMSG prefix (as in "@#channel",
+// meaning "ops in #channel"), it returns the channel name and true.
+// Otherwise, it returns ("", false).
+func (is *ISupport) ChannelTarget(target string) (string, bool) {
+	statusMsg, _ := is.Get("STATUSMSG")
+	name := strings.TrimLeft(target, statusMsg)
+	if !is.IsChannel(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// Prefix returns the channel membership modes, and the corresponding prefix
+// characters used in e.g. RPL_NAMEREPLY, in order from most to least
+// powerful. For the default, these are ("ov", "@+").
+func (is *ISupport) Prefix() (modes, prefixes string) {
+	value, ok := is.tokens["PREFIX"]
+	if ok && value == "" {
+		// Explicitly no prefixes.
+		return "", ""
+	}
+	if modes, prefixes, ok := parsePrefix(value); ok {
+		return modes, prefixes
+	}
+	modes, prefixes, _ = parsePrefix(isupportDefaults["PREFIX"])
+	return modes, prefixes
+}
+
+// Parse the value of a PREFIX token, e.g. "(ov)@+".
+func parsePrefix(value string) (modes, prefixes string, ok bool) {
+	if !strings.HasPrefix(value, "(") {
+		return "", "", false
+	}
+	end := strings.IndexByte(value, ')')
+	if end == -1 {
+		return "", "", false
+	}
+	modes, prefixes = value[1:end], value[end+1:]
+	if len(modes) != len(prefixes) {
+		return "", "", false
+	}
+	return modes, prefixes, true
+}
+
+// CaseMapping returns the name of the case mapping the server uses for nicks
+// and channel names, e.g. "rfc1459" or "ascii".
+func (is *ISupport) CaseMapping() string {
+	return is.getDefault("CASEMAPPING")
+}
+
+// NickLen returns the maximum length of a nick.
+func (is *ISupport) NickLen() int {
+	n, err := strconv.Atoi(is.getDefault("NICKLEN"))
+	if err != nil {
+		n, _ = strconv.Atoi(isupportDefaults["NICKLEN"])
+	}
+	return n
+}
+
+// ChanModes returns the four classes of channel modes from the CHANMODES
+// token:
+//
+// * A: modes that add or remove an address to or from a list (e.g. bans).
+// * B: modes that always take a parameter.
+// * C: modes that take a parameter only when set.
+// * D: modes that never take a parameter.
+//
+// Membership modes (see Prefix) are not included in any of these.
+func (is *ISupport) ChanModes() (a, b, c, d string) {
+	classes := strings.Split(is.getDefault("CHANMODES"), ",")
+	for len(classes) < 4 {
+		classes = append(classes, "")
+	}
+	return classes[0], classes[1], classes[2], classes[3]
+}
+
+// TargMax returns the maximum number of targets allowed for `command`, per
+// the TARGMAX token. ok is false if the server doesn't impose a limit (or
+// doesn't tell us about it).
+func (is *ISupport) TargMax(command string) (max int, ok bool) {
+	value, _ := is.Get("TARGMAX")
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], command) {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// Escape an ISUPPORT value. The spec only requires escaping characters that
+// would otherwise be ambiguous (space, '=' and backslash), using \xHH.
+func escapeISupportValue(value string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case ' ', '=', '\\':
+			buf.WriteString("\\x")
+			buf.WriteString(strings.ToUpper(strconv.FormatInt(int64(c), 16)))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// Inverse of escapeISupportValue. Malformed escapes are left alone.
+func unescapeISupportValue(value string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if c, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				buf.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(value[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,130 @@
+package irc
+
+import (
+	"testing"
+)
+
+func isupportMsg(tokens ...string) *Message {
+	params := append([]string{"alice"}, tokens...)
+	return &Message{
+		Command: RPL_ISUPPORT,
+		Params:  append(params, "are supported by this server"),
+	}
+}
+
+// With no tokens, we should get the defaults from the spec.
+func TestISupportDefaults(t *testing.T) {
+	is := NewISupport()
+	if is.ChanTypes() != "#&" {
+		t.Errorf("Unexpected default CHANTYPES: %q", is.ChanTypes())
+	}
+	if modes, prefixes := is.Prefix(); modes != "ov" || prefixes != "@+" {
+		t.Errorf("Unexpected default PREFIX: (%q, %q)", modes, prefixes)
+	}
+	if is.CaseMapping() != "rfc1459" {
+		t.Errorf("Unexpected default CASEMAPPING: %q", is.CaseMapping())
+	}
+	if is.NickLen() != 9 {
+		t.Errorf("Unexpected default NICKLEN: %d", is.NickLen())
+	}
+	if _, ok := is.TargMax("PRIVMSG"); ok {
+		t.Errorf("TargMax should not report a limit by default.")
+	}
+}
+
+func TestISupportUpdate(t *testing.T) {
+	is := NewISupport()
+	is.Update(isupportMsg("CHANTYPES=#", "PREFIX=(qaohv)~&@%+", "NICKLEN=30",
+		"CASEMAPPING=ascii", "STATUSMSG=@+", "EXCEPTS"))
+	is.Update(isupportMsg("CHANMODES=eIbq,k,flj,CFLMPQScgimnprstz",
+		"TARGMAX=NAMES:1,PRIVMSG:4,NOTICE:", "NETWORK=Example\\x20Net", "-EXCEPTS"))
+
+	if !is.IsChannel("#foo") || is.IsChannel("&foo") || is.IsChannel("foo") {
+		t.Errorf("IsChannel doesn't respect CHANTYPES=#")
+	}
+	if name, ok := is.ChannelTarget("@#foo"); !ok || name != "#foo" {
+		t.Errorf("ChannelTarget(\"@#foo\") = (%q, %v)", name, ok)
+	}
+	if modes, prefixes := is.Prefix(); modes != "qaohv" || prefixes != "~&@%+" {
+		t.Errorf("Unexpected PREFIX: (%q, %q)", modes, prefixes)
+	}
+	if is.NickLen() != 30 {
+		t.Errorf("Unexpected NICKLEN: %d", is.NickLen())
+	}
+	if is.CaseMapping() != "ascii" {
+		t.Errorf("Unexpected CASEMAPPING: %q", is.CaseMapping())
+	}
+	if a, b, c, d := is.ChanModes(); a != "eIbq" || b != "k" || c != "flj" || d != "CFLMPQScgimnprstz" {
+		t.Errorf("Unexpected CHANMODES: %q %q %q %q", a, b, c, d)
+	}
+	if n, ok := is.TargMax("privmsg"); !ok || n != 4 {
+		t.Errorf("Unexpected TARGMAX for PRIVMSG: (%d, %v)", n, ok)
+	}
+	if _, ok := is.TargMax("NOTICE"); ok {
+		t.Errorf("NOTICE should have no TARGMAX limit")
+	}
+	if network, _ := is.Get("NETWORK"); network != "Example Net" {
+		t.Errorf("Unexpected NETWORK: %q", network)
+	}
+	if _, ok := is.Get("EXCEPTS"); ok {
+		t.Errorf("EXCEPTS should have been removed")
+	}
+}
+
+// Messages() should produce messages that reconstruct the same state.
+func TestISupportMessages(t *testing.T) {
+	is := NewISupport()
+	tokens := []string{
+		"A=1", "B=2", "C=3", "D=4", "E=5", "F=6", "G=7", "H=8", "I=9",
+		"J=10", "K=11", "L=12", "M=13", "N=14", "NETWORK=Example\\x20Net", "FLAG",
+	}
+	is.Update(isupportMsg(tokens...))
+
+	msgs := is.Messages("irc.example.com", "bob")
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages but got %d", len(msgs))
+	}
+	is2 := NewISupport()
+	for _, msg := range msgs {
+		if len(msg.Params) > 15 {
+			t.Fatalf("Too many parameters in %q", msg)
+		}
+		if msg.Params[0] != "bob" {
+			t.Fatalf("Message %q not addressed to bob", msg)
+		}
+		is2.Update(msg)
+	}
+	for _, name := range []string{"A", "N", "NETWORK", "FLAG"} {
+		v1, _ := is.Get(name)
+		v2, ok := is2.Get(name)
+		if !ok || v1 != v2 {
+			t.Errorf("Token %s: expected %q but got %q", name, v1, v2)
+		}
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	cases := []struct {
+		caseMapping, name, folded string
+	}{
+		{CaseMappingASCII, "#Foo[]", "#foo[]"},
+		{CaseMappingRFC1459, "Nick[A]\\^", "nick{a}|~"},
+		{CaseMappingStrictRFC1459, "Nick[A]\\^", "nick{a}|^"},
+		{"unknown", "ÄBC", "Äbc"},
+	}
+	for _, c := range cases {
+		if folded := FoldName(c.caseMapping, c.name); folded != c.folded {
+			t.Errorf("FoldName(%q, %q) = %q, expected %q.",
+				c.caseMapping, c.name, folded, c.folded)
+		}
+	}
+
+	is := NewISupport()
+	if !is.EqualNames("Alice[m]", "alice{M}") {
+		t.Errorf("Names should be equal under the default (rfc1459) mapping.")
+	}
+	is.Update(isupportMsg("CASEMAPPING=ascii"))
+	if is.EqualNames("Alice[m]", "alice{M}") {
+		t.Errorf("Names should differ under the ascii mapping.")
+	}
+}
@@ -4,18 +4,34 @@ package mask
 import (
 	"bytes"
 	"regexp"
+	"zenhack.net/go/irc-idler/irc"
 )
 
 // Convert the mask to a regexp pattern matching the same set of strings, as
 // recognized by go's regexp package.
 func ToRegexp(mask string) string {
+	return toRegexp(mask, func(s string) string { return s })
+}
+
+// ToFoldedRegexp is like ToRegexp, but the pattern matches the folded forms
+// (see irc.FoldName) of the strings the mask matches case insensitively. The
+// mask's literal characters are folded only after escapes are processed, so
+// e.g. under rfc1459 the mask `a\*` still matches "a*", rather than "a|"
+// followed by anything.
+func ToFoldedRegexp(mask, caseMapping string) string {
+	return toRegexp(mask, func(s string) string {
+		return irc.FoldName(caseMapping, s)
+	})
+}
+
+func toRegexp(mask string, fold func(string) string) string {
 	rePat := &bytes.Buffer{}
 	nextChunk := &bytes.Buffer{}
 	input := []byte(mask)
 
 	flush := func() {
 		if nextChunk.Len() != 0 {
-			rePat.WriteString(regexp.QuoteMeta(nextChunk.String()))
+			rePat.WriteString(regexp.QuoteMeta(fold(nextChunk.String())))
 			nextChunk.Reset()
 		}
 	}
@@ -0,0 +1,218 @@
+package mask
+
+// This file provides compiled masks, which match users rather than strings.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// A User is what a Matcher matches against. Only ID is needed for ordinary
+// masks; the other fields are for extended bans.
+type User struct {
+	ID irc.ClientID
+
+	// The account the user is logged in to, or "" if they aren't.
+	Account string
+
+	// The user's real name (the "gecos" field).
+	RealName string
+}
+
+// A Matcher is a compiled mask. Besides ordinary nick!user@host masks, it
+// understands the following extended bans, in the syntax used by charybdis
+// and its descendants:
+//
+// * $a - matches users logged in to any account.
+// * $a:<mask> - matches users whose account matches <mask>.
+// * $r:<mask> - matches users whose real name matches <mask>.
+// * $x:<mask> - matches users for whom nick!user@host#realname matches <mask>.
+//
+// Any of these can be negated with a '~', e.g. "$~a" matches users who are
+// not logged in.
+type Matcher struct {
+	mask        string
+	caseMapping string
+
+	// The extended ban type, or 0 for an ordinary mask.
+	extban byte
+	negate bool
+
+	// nil for "$a" with no argument.
+	re *regexp.Regexp
+}
+
+type badMaskError string
+
+func (e badMaskError) Error() string {
+	return fmt.Sprintf("Invalid mask: %q", string(e))
+}
+
+// Compile compiles `mask`. Matching is case insensitive according to
+// `caseMapping` (see irc.FoldName).
+//
+// Like servers, Compile fills in missing parts of an ordinary mask, so that
+// e.g. "alice" is equivalent to "alice!*@*" and "*.example.com" to
+// "*!*@*.example.com".
+func Compile(mask, caseMapping string) (*Matcher, error) {
+	m := &Matcher{mask: mask, caseMapping: caseMapping}
+	if !strings.HasPrefix(mask, "$") {
+		m.re = compileGlob(normalize(mask), caseMapping)
+		return m, nil
+	}
+
+	ext := mask[1:]
+	if strings.HasPrefix(ext, "~") {
+		m.negate = true
+		ext = ext[1:]
+	}
+	if ext == "" {
+		return nil, badMaskError(mask)
+	}
+	m.extban, ext = ext[0], ext[1:]
+	arg, hasArg := "", false
+	if strings.HasPrefix(ext, ":") {
+		arg, hasArg = ext[1:], true
+	} else if ext != "" {
+		return nil, badMaskError(mask)
+	}
+	switch m.extban {
+	case 'a':
+		if hasArg {
+			m.re = compileGlob(arg, caseMapping)
+		}
+	case 'r', 'x':
+		if !hasArg {
+			return nil, badMaskError(mask)
+		}
+		m.re = compileGlob(arg, caseMapping)
+	default:
+		return nil, badMaskError(mask)
+	}
+	return m, nil
+}
+
+// MustCompile is like Compile, but panics if the mask is invalid.
+func MustCompile(mask, caseMapping string) *Matcher {
+	m, err := Compile(mask, caseMapping)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Fill in the missing parts of an ordinary mask.
+func normalize(mask string) string {
+	hasBang, hasAt := strings.Contains(mask, "!"), strings.Contains(mask, "@")
+	switch {
+	case !hasBang && !hasAt:
+		if strings.Contains(mask, ".") {
+			// Looks like a host.
+			return "*!*@" + mask
+		}
+		return mask + "!*@*"
+	case !hasBang:
+		return "*!" + mask
+	case !hasAt:
+		return mask + "@*"
+	}
+	return mask
+}
+
+func compileGlob(glob, caseMapping string) *regexp.Regexp {
+	pattern := ToFoldedRegexp(glob, caseMapping)
+	return regexp.MustCompile("^(?s:" + pattern + ")$")
+}
+
+// String returns the mask the Matcher was compiled from.
+func (m *Matcher) String() string {
+	return m.mask
+}
+
+// Match returns true if the mask matches the user with client ID `id`. Since
+// that's all we know about the user, extended bans which need more
+// information never match (even if negated).
+func (m *Matcher) Match(id irc.ClientID) bool {
+	if m.extban != 0 {
+		return false
+	}
+	return m.MatchUser(User{ID: id})
+}
+
+// MatchUser returns true if the mask matches `u`.
+func (m *Matcher) MatchUser(u User) bool {
+	var subject string
+	switch m.extban {
+	case 0:
+		return m.matchString(hostmask(u.ID))
+	case 'a':
+		if m.re == nil {
+			return (u.Account != "") != m.negate
+		}
+		if u.Account == "" {
+			return m.negate
+		}
+		subject = u.Account
+	case 'r':
+		subject = u.RealName
+	case 'x':
+		subject = hostmask(u.ID) + "#" + u.RealName
+	}
+	return m.matchString(subject) != m.negate
+}
+
+func (m *Matcher) matchString(s string) bool {
+	return m.re.MatchString(irc.FoldName(m.caseMapping, s))
+}
+
+// Format `id` as nick!user@host, regardless of which parts are missing.
+func hostmask(id irc.ClientID) string {
+	return id.Nick + "!" + id.User + "@" + id.Host
+}
+
+// A List is a list of masks, e.g. a channel's ban list.
+type List []*Matcher
+
+// CompileList compiles each of `masks`; see Compile.
+func CompileList(masks []string, caseMapping string) (List, error) {
+	ret := make(List, 0, len(masks))
+	for _, mask := range masks {
+		m, err := Compile(mask, caseMapping)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// MatchUser returns the first mask in the list that matches `u`, or nil if
+// none does.
+func (l List) MatchUser(u User) *Matcher {
+	for _, m := range l {
+		if m.MatchUser(u) {
+			return m
+		}
+	}
+	return nil
+}
+
+// A channel's access lists: the ban list (mode +b), exception list (+e) and
+// invite exception list (+I).
+type AccessLists struct {
+	Bans, Excepts, Invexes List
+}
+
+// Banned returns true if `u` is banned: that is, if they match a ban and
+// don't match an exception.
+func (l AccessLists) Banned(u User) bool {
+	return l.Bans.MatchUser(u) != nil && l.Excepts.MatchUser(u) == nil
+}
+
+// Invited returns true if `u` may join the channel without an invitation
+// when it is invite only (mode +i).
+func (l AccessLists) Invited(u User) bool {
+	return l.Invexes.MatchUser(u) != nil
+}
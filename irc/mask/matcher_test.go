@@ -0,0 +1,107 @@
+package mask
+
+import (
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+var (
+	alice = User{
+		ID:       irc.ClientID{Nick: "Alice", User: "~alice", Host: "host.Example.com"},
+		Account:  "alice",
+		RealName: "Alice Liddell",
+	}
+	bob = User{
+		ID:       irc.ClientID{Nick: "bob[m]", User: "bob", Host: "matrix.org"},
+		RealName: "Bob",
+	}
+	star = User{ID: irc.ClientID{Nick: "a*b", User: "star", Host: "example.com"}}
+	pipe = User{ID: irc.ClientID{Nick: "a|xb", User: "pipe", Host: "example.com"}}
+)
+
+func TestMatcher(t *testing.T) {
+	cases := []struct {
+		mask        string
+		caseMapping string
+		user        User
+		shouldMatch bool
+	}{
+		{"alice!*@*", "ascii", alice, true},
+		{"*!*@*.example.COM", "ascii", alice, true},
+		{"*!alice@*", "ascii", alice, false},
+		{"*!~alice@*", "ascii", alice, true},
+		// Missing parts are filled in:
+		{"alice", "ascii", alice, true},
+		{"*.example.com", "ascii", alice, true},
+		{"~alice@host.example.com", "ascii", alice, true},
+		{"bob[m]!bob", "ascii", bob, true},
+		// Case mapping:
+		{"BOB{M}!*@*", "rfc1459", bob, true},
+		{"BOB{M}!*@*", "ascii", bob, false},
+		// Escapes are processed before case folding, so the `\` isn't
+		// folded to '|':
+		{`a\*b!*@*`, "rfc1459", star, true},
+		{`a\*b!*@*`, "rfc1459", pipe, false},
+		// The whole string must match:
+		{"ali!*@*", "ascii", alice, false},
+		// Extended bans:
+		{"$a", "ascii", alice, true},
+		{"$a", "ascii", bob, false},
+		{"$~a", "ascii", alice, false},
+		{"$~a", "ascii", bob, true},
+		{"$a:ALI*", "ascii", alice, true},
+		{"$a:bob", "ascii", bob, false},
+		{"$~a:bob", "ascii", bob, true},
+		{"$r:*liddell", "ascii", alice, true},
+		{"$~r:*liddell", "ascii", alice, false},
+		{"$r:*liddell", "ascii", bob, false},
+		{"$x:alice!*@*#alice*", "ascii", alice, true},
+		{"$x:alice!*@*#bob", "ascii", alice, false},
+	}
+	for _, c := range cases {
+		m, err := Compile(c.mask, c.caseMapping)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", c.mask, err)
+			continue
+		}
+		if m.MatchUser(c.user) != c.shouldMatch {
+			t.Errorf("Compile(%q, %q).MatchUser(%v) should be %v.",
+				c.mask, c.caseMapping, c.user, c.shouldMatch)
+		}
+	}
+}
+
+// Match only knows the client ID, so extended bans never match.
+func TestMatchClientID(t *testing.T) {
+	if !MustCompile("alice", "ascii").Match(alice.ID) {
+		t.Errorf("Mask \"alice\" should match %v.", alice.ID)
+	}
+	if MustCompile("$~a", "ascii").Match(alice.ID) {
+		t.Errorf("Extended ban should not match a bare client ID.")
+	}
+}
+
+func TestBadMasks(t *testing.T) {
+	for _, mask := range []string{"$", "$~", "$q:foo", "$r", "$afoo"} {
+		if _, err := Compile(mask, "ascii"); err == nil {
+			t.Errorf("Compile(%q) should have failed.", mask)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	lists := AccessLists{
+		Bans:    List{MustCompile("*!*@*.example.com", "ascii"), MustCompile("$~a", "ascii")},
+		Excepts: List{MustCompile("$a:alice", "ascii")},
+		Invexes: List{MustCompile("*!*@matrix.org", "ascii")},
+	}
+	if lists.Banned(alice) {
+		t.Errorf("alice matches an exception, and so should not be banned.")
+	}
+	if !lists.Banned(bob) {
+		t.Errorf("bob is not logged in, and so should be banned.")
+	}
+	if lists.Invited(alice) || !lists.Invited(bob) {
+		t.Errorf("Only bob should match the invite exception list.")
+	}
+}
@@ -0,0 +1,114 @@
+package irc
+
+// This file deals with channel membership prefixes (e.g. "@" for channel
+// operators), which are defined by the PREFIX RPL_ISUPPORT token, and with
+// the MODE changes that grant and revoke them.
+
+import (
+	"strings"
+)
+
+// A Membership is a user's presence in a channel, as listed in RPL_NAMEREPLY.
+type Membership struct {
+	// The user's membership prefixes (e.g. "@" for an operator), from
+	// most to least powerful. Servers only list more than the first of
+	// these if the multi-prefix capability is enabled.
+	Prefixes string
+
+	// The user. Only the nick is known, unless the userhost-in-names
+	// capability is enabled or we've seen the user join.
+	ID ClientID
+}
+
+// Format formats the membership for RPL_NAMEREPLY, as a server would for a
+// client with (or without) the multi-prefix and userhost-in-names
+// capabilities.
+func (m Membership) Format(multiPrefix, userhostInNames bool) string {
+	prefixes := m.Prefixes
+	if !multiPrefix && len(prefixes) > 1 {
+		prefixes = prefixes[:1]
+	}
+	if userhostInNames {
+		return prefixes + m.ID.String()
+	}
+	return prefixes + m.ID.Nick
+}
+
+// ParseMembership parses an entry in RPL_NAMEREPLY, which consists of any
+// number of membership prefixes followed by a nick (or, with
+// userhost-in-names, a full client ID).
+func (is *ISupport) ParseMembership(text string) (Membership, error) {
+	_, prefixes := is.Prefix()
+	i := 0
+	for i < len(text) && strings.IndexByte(prefixes, text[i]) != -1 {
+		i++
+	}
+	id, err := ParseClientID(text[i:])
+	if err != nil {
+		return Membership{}, err
+	}
+	return Membership{Prefixes: is.SortPrefixes(text[:i]), ID: id}, nil
+}
+
+// SortPrefixes returns the membership prefixes in `prefixes` in order from
+// most to least powerful, without duplicates. Characters which aren't
+// membership prefixes are dropped.
+func (is *ISupport) SortPrefixes(prefixes string) string {
+	_, all := is.Prefix()
+	ret := make([]byte, 0, len(prefixes))
+	for i := 0; i < len(all); i++ {
+		if strings.IndexByte(prefixes, all[i]) != -1 {
+			ret = append(ret, all[i])
+		}
+	}
+	return string(ret)
+}
+
+// MembershipPrefix returns the prefix corresponding to the membership mode
+// `mode` (e.g. '@' for 'o'), and true. If `mode` is not a membership mode,
+// it returns (0, false).
+func (is *ISupport) MembershipPrefix(mode byte) (prefix byte, ok bool) {
+	modes, prefixes := is.Prefix()
+	i := strings.IndexByte(modes, mode)
+	if i == -1 {
+		return 0, false
+	}
+	return prefixes[i], true
+}
+
+// A ModeChange is a single change in a MODE message, e.g. "+o alice".
+type ModeChange struct {
+	Add  bool
+	Mode byte
+	Arg  string // "" if the mode doesn't take an argument.
+}
+
+// ParseModeChanges splits the channel mode changes `modes` (e.g. "+ov-k")
+// into individual changes, pairing each with its argument from `args`
+// as appropriate. Which modes take arguments is determined by the PREFIX and
+// CHANMODES tokens; unknown modes are assumed not to.
+func (is *ISupport) ParseModeChanges(modes string, args []string) []ModeChange {
+	prefixModes, _ := is.Prefix()
+	a, b, c, _ := is.ChanModes()
+	ret := []ModeChange{}
+	add := true
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch mode {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		change := ModeChange{Add: add, Mode: mode}
+		takesArg := strings.IndexByte(prefixModes+a+b, mode) != -1 ||
+			(add && strings.IndexByte(c, mode) != -1)
+		if takesArg && len(args) > 0 {
+			change.Arg, args = args[0], args[1:]
+		}
+		ret = append(ret, change)
+	}
+	return ret
+}
@@ -0,0 +1,79 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMembership(t *testing.T) {
+	is := NewISupport()
+	is.Update(isupportMsg("PREFIX=(qaohv)~&@%+"))
+	cases := []struct {
+		text       string
+		membership Membership
+	}{
+		{"alice", Membership{ID: ClientID{Nick: "alice"}}},
+		{"@alice", Membership{Prefixes: "@", ID: ClientID{Nick: "alice"}}},
+		// Out of order prefixes get sorted:
+		{"+~alice", Membership{Prefixes: "~+", ID: ClientID{Nick: "alice"}}},
+		{"%alice!al@example.com", Membership{
+			Prefixes: "%",
+			ID:       ClientID{Nick: "alice", User: "al", Host: "example.com"},
+		}},
+	}
+	for _, c := range cases {
+		m, err := is.ParseMembership(c.text)
+		if err != nil {
+			t.Errorf("ParseMembership(%q): %v", c.text, err)
+		} else if m != c.membership {
+			t.Errorf("ParseMembership(%q) = %+v, expected %+v.", c.text, m, c.membership)
+		}
+	}
+	if _, err := is.ParseMembership("@"); err == nil {
+		t.Errorf("ParseMembership(\"@\") should have failed.")
+	}
+}
+
+func TestMembershipFormat(t *testing.T) {
+	m := Membership{Prefixes: "@+", ID: ClientID{Nick: "alice", User: "al", Host: "example.com"}}
+	cases := []struct {
+		multiPrefix, userhostInNames bool
+		text                         string
+	}{
+		{false, false, "@alice"},
+		{true, false, "@+alice"},
+		{false, true, "@alice!al@example.com"},
+		{true, true, "@+alice!al@example.com"},
+	}
+	for _, c := range cases {
+		if text := m.Format(c.multiPrefix, c.userhostInNames); text != c.text {
+			t.Errorf("Format(%v, %v) = %q, expected %q.",
+				c.multiPrefix, c.userhostInNames, text, c.text)
+		}
+	}
+}
+
+func TestParseModeChanges(t *testing.T) {
+	is := NewISupport()
+	is.Update(isupportMsg("PREFIX=(ohv)@%+", "CHANMODES=beI,k,l,imnpst"))
+	changes := is.ParseModeChanges("+ob-v+lk-lm+x", []string{"alice", "*!*@spam", "bob", "10", "key"})
+	expected := []ModeChange{
+		{Add: true, Mode: 'o', Arg: "alice"},
+		{Add: true, Mode: 'b', Arg: "*!*@spam"},
+		{Add: false, Mode: 'v', Arg: "bob"},
+		{Add: true, Mode: 'l', Arg: "10"},
+		{Add: true, Mode: 'k', Arg: "key"},
+		{Add: false, Mode: 'l'},
+		{Add: false, Mode: 'm'},
+		{Add: true, Mode: 'x'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("ParseModeChanges() = %+v, expected %+v.", changes, expected)
+	}
+	if prefix, ok := is.MembershipPrefix('h'); !ok || prefix != '%' {
+		t.Errorf("MembershipPrefix('h') = (%q, %v)", prefix, ok)
+	}
+	if _, ok := is.MembershipPrefix('b'); ok {
+		t.Errorf("'b' should not be a membership mode.")
+	}
+}
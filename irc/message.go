@@ -17,6 +17,9 @@
 // * Be robust
 // * Have the low-level components be usable even if the high-level stuff doesn't fit your
 //   application. E.g. message parsing should work regardless of what you're building.
+//
+// For the high-level stuff, see the client subpackage, which handles
+// registration, keepalive and channel state for bots and the like.
 package irc
 
 // This files defines the basic type for messages, interfaces for
@@ -26,18 +29,35 @@ package irc
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+	"zenhack.net/go/irc-idler/irc/charset"
 )
 
 const (
 	MaxMessageLen = 512 // Maximum IRC message length, including CLRF.
+
+	// Maximum length of the IRCv3 tags section of a message, including
+	// the leading '@' and the trailing space. This does not count against
+	// MaxMessageLen.
+	MaxTagsLen = 8191
+)
+
+var (
+	ErrMessageTooLong = errors.New("Message too long")
 )
 
 // An IRC protocol message
 type Message struct {
+	// IRCv3 message tags. Tags without a value map to the empty string.
+	// nil or empty if the message has no tags.
+	Tags map[string]string
+
 	Prefix  string // Empty string if absent.
 	Command string
 	Params  []string
@@ -78,41 +98,225 @@ type ioReadWriteCloser struct {
 	io.Closer
 }
 
+// Options control how Readers and Writers convert between Messages and the
+// bytes on the wire. The zero value gives the default behavior.
+type Options struct {
+	// The character encoding used on the wire. Readers decode incoming
+	// messages to UTF-8, and writers encode outgoing ones. If nil, bytes
+	// are passed through unchanged, so messages may contain invalid UTF-8.
+	Charset charset.Charset
+
+	// If true, readers reject anything that doesn't follow the grammar in
+	// RFC 1459 to the letter, returning a *ParseError. Otherwise they
+	// accept common deviations: lines ending in a bare LF, runs of more
+	// than one space between parameters, trailing spaces and blank lines
+	// (which are skipped).
+	Strict bool
+
+	// If non-zero, the longest a reader will wait for a message, or a
+	// writer for a message to be sent, before failing with a timeout
+	// error. These only have an effect if the underlying io.Reader or
+	// io.Writer has a SetReadDeadline or SetWriteDeadline method
+	// respectively (as does a net.Conn).
+	//
+	// Note that a reader which has timed out can't be used again.
+	ReadTimeout, WriteTimeout time.Duration
+
+	// If non-zero, writers send messages (not counting tags) up to this
+	// many bytes long, rather than MaxMessageLen. This is for peers known
+	// to accept longer lines, e.g. clients to which we relay text that
+	// grew when it was converted from a server's charset to UTF-8.
+	MaxLineLen int
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 func NewReadWriter(rw io.ReadWriter) ReadWriter {
-	return ioReadWriter{NewReader(rw), NewWriter(rw)}
+	return NewReadWriterOptions(rw, Options{})
+}
+
+// Like NewReadWriter, but with the given options.
+func NewReadWriterOptions(rw io.ReadWriter, opts Options) ReadWriter {
+	return ioReadWriter{NewReaderOptions(rw, opts), NewWriterOptions(rw, opts)}
 }
 
 func NewReadWriteCloser(rwc io.ReadWriteCloser) ReadWriteCloser {
+	return NewReadWriteCloserOptions(rwc, Options{})
+}
+
+// Like NewReadWriteCloser, but with the given options.
+func NewReadWriteCloserOptions(rwc io.ReadWriteCloser, opts Options) ReadWriteCloser {
 	return ioReadWriteCloser{
-		ReadWriter: NewReadWriter(rwc),
+		ReadWriter: NewReadWriterOptions(rwc, opts),
 		Closer:     rwc,
 	}
 }
 
 type ioWriter struct {
-	lock sync.Mutex
-	w    io.Writer
+	lock       sync.Mutex
+	w          io.Writer
+	charset    charset.Charset
+	timeout    time.Duration
+	maxLineLen int
 }
 
 func NewWriter(w io.Writer) Writer {
-	return &ioWriter{w: w}
+	return NewWriterOptions(w, Options{})
+}
+
+// Like NewWriter, but with the given options.
+func NewWriterOptions(w io.Writer, opts Options) Writer {
+	maxLineLen := opts.MaxLineLen
+	if maxLineLen == 0 {
+		maxLineLen = MaxMessageLen
+	}
+	return &ioWriter{
+		w:          w,
+		charset:    opts.Charset,
+		timeout:    opts.WriteTimeout,
+		maxLineLen: maxLineLen,
+	}
 }
 
 func (w *ioWriter) WriteMessage(m *Message) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	_, err := m.WriteTo(w.w)
+	if d, ok := w.w.(writeDeadliner); ok && w.timeout != 0 {
+		if err := d.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+			return err
+		}
+	}
+	if w.charset == nil && w.maxLineLen == MaxMessageLen {
+		_, err := m.WriteTo(w.w)
+		return err
+	}
+	if err := m.checkSyntaxError(); err != nil {
+		return err
+	}
+	// What counts against the limits is the bytes on the wire, which
+	// with a charset may be more or fewer than in the UTF-8 form:
+	line, tags := []byte(m.String()), []byte{}
+	if len(m.Tags) != 0 {
+		tags = []byte("@" + m.tagString() + " ")
+	}
+	if w.charset != nil {
+		line, tags = w.charset.Encode(string(line)), w.charset.Encode(string(tags))
+	}
+	if err := checkLen(len(line), len(tags), w.maxLineLen); err != nil {
+		return err
+	}
+	_, err := w.w.Write(line)
 	return err
 }
 
+// An InvalidMessageError is returned when trying to write a message which
+// can't be serialized faithfully, e.g. because a parameter contains a line
+// break, which would let whoever supplied it inject a message of their own.
+type InvalidMessageError struct {
+	Command string // The command of the message, if that isn't the problem.
+	Reason  string
+}
+
+func (e *InvalidMessageError) Error() string {
+	if e.Command == "" {
+		return "Invalid message: " + e.Reason
+	}
+	return fmt.Sprintf("Invalid %s message: %s", e.Command, e.Reason)
+}
+
+// CheckWritable returns an error if the message can't be serialized such
+// that it will be parsed back the same way: either an *InvalidMessageError
+// describing the problem, or ErrMessageTooLong if it would exceed
+// MaxMessageLen (or its tags MaxTagsLen).
+func (m *Message) CheckWritable() error {
+	if err := m.checkSyntaxError(); err != nil {
+		return err
+	}
+	tagsLen := 0
+	if len(m.Tags) != 0 {
+		tagsLen = len(m.tagString()) + 2
+	}
+	return checkLen(m.Len(), tagsLen, MaxMessageLen)
+}
+
+// Like CheckWritable, but without the length checks.
+func (m *Message) checkSyntaxError() error {
+	if !isValidCommand(m.Command) {
+		return &InvalidMessageError{Reason: fmt.Sprintf("bad command %q", m.Command)}
+	}
+	if reason := m.checkSyntax(); reason != "" {
+		return &InvalidMessageError{Command: m.Command, Reason: reason}
+	}
+	return nil
+}
+
+// Return ErrMessageTooLong if a serialized message of `lineLen` bytes, of
+// which `tagsLen` are its tags section, is over MaxTagsLen or (not counting
+// the tags) `max`.
+func checkLen(lineLen, tagsLen, max int) error {
+	if tagsLen > MaxTagsLen || lineLen-tagsLen > max {
+		return ErrMessageTooLong
+	}
+	return nil
+}
+
+// Check the parts of the message other than the command for things that
+// can't be serialized. Returns a description of the first problem found, or
+// "" if there is none.
+func (m *Message) checkSyntax() string {
+	for k := range m.Tags {
+		if k == "" || strings.ContainsAny(k, " ;=\r\n\x00") {
+			return fmt.Sprintf("bad tag name %q", k)
+		}
+	}
+	if strings.ContainsAny(m.Prefix, " \r\n\x00") {
+		return fmt.Sprintf("bad prefix %q", m.Prefix)
+	}
+	for i, param := range m.Params {
+		switch {
+		case strings.ContainsAny(param, "\r\n\x00"):
+			return fmt.Sprintf("parameter %d contains CR, LF or NUL", i+1)
+		case i == len(m.Params)-1:
+			// Anything else goes in the last parameter.
+		case param == "":
+			return fmt.Sprintf("parameter %d is empty, but not last", i+1)
+		case param[0] == ':':
+			return fmt.Sprintf("parameter %d starts with ':', but is not last", i+1)
+		case strings.Contains(param, " "):
+			return fmt.Sprintf("parameter %d contains a space, but is not last", i+1)
+		}
+	}
+	return ""
+}
+
+// WriteTo writes the serialized form of the message, including the trailing
+// CRLF, to `w`. It refuses to write anything if the message fails
+// CheckWritable, returning that error instead.
 func (msg *Message) WriteTo(w io.Writer) (n int64, err error) {
+	if err := msg.CheckWritable(); err != nil {
+		return 0, err
+	}
+	return msg.writeTo(w)
+}
+
+// Like WriteTo, but without checking the message first.
+func (msg *Message) writeTo(w io.Writer) (n int64, err error) {
 	n = 0
 	checkErr := func(sz int, e error) {
-		if err != nil {
+		if err == nil {
 			err = e
 		}
 		n += int64(sz)
 	}
+	if len(msg.Tags) != 0 {
+		checkErr(fmt.Fprintf(w, "@%s ", msg.tagString()))
+	}
 	if msg.Prefix != "" {
 		checkErr(fmt.Fprintf(w, ":%s ", msg.Prefix))
 	}
@@ -123,7 +327,7 @@ func (msg *Message) WriteTo(w io.Writer) (n int64, err error) {
 			checkErr(fmt.Fprintf(w, " %s", param))
 		}
 		lastParam := msg.Params[lastIndex]
-		if strings.Contains(lastParam, " ") {
+		if needsTrailingMarker(lastParam) {
 			checkErr(fmt.Fprintf(w, " :%s", lastParam))
 		} else {
 			checkErr(fmt.Fprintf(w, " %s", lastParam))
@@ -133,18 +337,36 @@ func (msg *Message) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// Return true if `param`, as the last parameter of a message, must be
+// preceded by ':' in order to be parsed back correctly.
+func needsTrailingMarker(param string) bool {
+	return param == "" || param[0] == ':' || strings.Contains(param, " ")
+}
+
+// String returns the serialized form of the message. Unlike WriteTo, it
+// doesn't check that the message is valid, so it is suitable for debugging
+// output but not for sending.
 func (msg *Message) String() string {
 	buf := &bytes.Buffer{}
-	msg.WriteTo(buf)
+	msg.writeTo(buf)
 	return buf.String()
 }
 
 // Compare m1 and m2 for equality. We can't just use (==), as it
-// doesn't work on string slices (Message.Params).
+// doesn't work on string slices (Message.Params) or maps (Message.Tags).
+// A nil Tags field is considered equal to an empty one.
 func (m1 *Message) Eq(m2 *Message) bool {
 	if m1.Prefix != m2.Prefix || m1.Command != m2.Command {
 		return false
 	}
+	if len(m1.Tags) != len(m2.Tags) {
+		return false
+	}
+	for k, v := range m1.Tags {
+		if v2, ok := m2.Tags[k]; !ok || v != v2 {
+			return false
+		}
+	}
 	if len(m1.Params) != len(m2.Params) {
 		return false
 	}
@@ -157,8 +379,14 @@ func (m1 *Message) Eq(m2 *Message) bool {
 }
 
 // Return the length in bytes of the serialized form of the message.
+//
+// This includes the tags section, if any, even though it does not count
+// against MaxMessageLen.
 func (m *Message) Len() int {
 	total := 0
+	if len(m.Tags) != 0 {
+		total += len(m.tagString()) + 2 // Leading "@" and trailing space.
+	}
 	if m.Prefix != "" {
 		total += len(m.Prefix) + 2 // Leading ":" and trailing space.
 	}
@@ -167,7 +395,7 @@ func (m *Message) Len() int {
 	// Spaces before each parameter, including the space between the
 	// command and the first parameter.
 	total += len(m.Params)
-	if len(m.Params) != 0 && strings.Contains(m.Params[len(m.Params)-1], " ") {
+	if len(m.Params) != 0 && needsTrailingMarker(m.Params[len(m.Params)-1]) {
 		// Colon before last argument:
 		total += 1
 	}
@@ -182,39 +410,121 @@ func (m *Message) Len() int {
 type ioReader struct {
 	lock    sync.Mutex
 	scanner *bufio.Scanner
+	charset charset.Charset
+	strict  bool
+
+	// Set if the io.Reader supports deadlines and we want one.
+	deadliner readDeadliner
+	timeout   time.Duration
 }
 
 // Return a new Reader reading from r.
 func NewReader(r io.Reader) Reader {
-	ret := &ioReader{scanner: bufio.NewScanner(r)}
-	ret.scanner.Buffer(make([]byte, MaxMessageLen), MaxMessageLen)
+	return NewReaderOptions(r, Options{})
+}
+
+// Like NewReader, but with the given options.
+func NewReaderOptions(r io.Reader, opts Options) Reader {
+	ret := &ioReader{
+		scanner: bufio.NewScanner(r),
+		charset: opts.Charset,
+		strict:  opts.Strict,
+	}
+	if d, ok := r.(readDeadliner); ok && opts.ReadTimeout != 0 {
+		ret.deadliner, ret.timeout = d, opts.ReadTimeout
+	}
+	ret.scanner.Buffer(make([]byte, MaxMessageLen), MaxTagsLen+MaxMessageLen)
+	ret.scanner.Split(scanLines)
 	return ret
 }
 
+// A bufio.SplitFunc which, unlike bufio.ScanLines, leaves the line
+// terminator (if any) in the token, so we can tell what it was.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) != 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
 // Read a message and return it.
 //
-// TODO: document errors. Right now just underlying IO errors.
+// Errors are either those of the underlying io.Reader, ErrMessageTooLong if
+// either the tags or the rest of the message exceed their respective
+// limits, or a *ParseError if the message is malformed. After a
+// ErrMessageTooLong or *ParseError, the next call will read the next message,
+// unless the line was too long to even buffer (longer than MaxTagsLen +
+// MaxMessageLen), in which case the reader is no longer usable.
 //
-// TODO: document the extent to which we validate the input.
+// The amount of validation done depends on the Strict option; see Options.
+// Either way, callers should use Message.Validate to check that the
+// message makes sense.
 func (r *ioReader) ReadMessage() (*Message, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	// We use bufio.Scanner to get each line, then parse the line from
-	// a buffer.
-	if !r.scanner.Scan() {
-		err := r.scanner.Err()
-		if err == nil {
-			err = io.EOF
+	for {
+		// We use bufio.Scanner to get each line, then parse the line
+		// from a string.
+		if r.deadliner != nil {
+			if err := r.deadliner.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+				return nil, err
+			}
 		}
-		return nil, err
+		if !r.scanner.Scan() {
+			err := r.scanner.Err()
+			switch err {
+			case nil:
+				err = io.EOF
+			case bufio.ErrTooLong:
+				err = ErrMessageTooLong
+			}
+			return nil, err
+		}
+		line, err := r.trimLine(r.scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 && !r.strict {
+			continue
+		}
+		if err := checkLineLen(line); err != nil {
+			return nil, err
+		}
+		text := string(line)
+		if r.charset != nil {
+			// The length limits apply to the bytes on the wire, so
+			// we only decode after checking them.
+			text = r.charset.Decode(line)
+		}
+		return parseMessage(text, r.strict)
 	}
-	buf := bytes.NewBuffer(r.scanner.Bytes())
-	return parseMessage(buf)
+}
+
+// Remove the line terminator from `line`. In strict mode, it must be CRLF.
+func (r *ioReader) trimLine(line []byte) ([]byte, error) {
+	if r.strict {
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			return nil, &ParseError{
+				Offset: len(bytes.TrimSuffix(line, []byte("\n"))),
+				Reason: "line not terminated by CRLF",
+			}
+		}
+		return line[:len(line)-2], nil
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
 }
 
 // Parse a message from a string. The string must contain exactly one message.
 func ParseMessage(input string) (*Message, error) {
-	r := NewReader(strings.NewReader(input))
+	return ParseMessageOptions(input, Options{})
+}
+
+// Like ParseMessage, but with the given options.
+func ParseMessageOptions(input string, opts Options) (*Message, error) {
+	r := NewReaderOptions(strings.NewReader(input), opts)
 	msg, err := r.ReadMessage()
 	if err != nil {
 		return nil, err
@@ -228,69 +538,247 @@ func ParseMessage(input string) (*Message, error) {
 	return msg, nil
 }
 
-// parse the message in input
-func parseMessage(input *bytes.Buffer) (*Message, error) {
-	result := &Message{}
-	output := &bytes.Buffer{}
+// Verify that line (not including the trailing CRLF) respects MaxTagsLen and
+// MaxMessageLen.
+func checkLineLen(line []byte) error {
+	if len(line) != 0 && line[0] == '@' {
+		end := bytes.IndexByte(line, ' ')
+		if end == -1 {
+			end = len(line) - 1
+		}
+		// Include the trailing space:
+		if end+1 > MaxTagsLen {
+			return ErrMessageTooLong
+		}
+		line = line[end+1:]
+	}
+	if len(line)+2 > MaxMessageLen {
+		return ErrMessageTooLong
+	}
+	return nil
+}
 
-	c, err := input.ReadByte()
-	if err != nil {
-		return nil, err
+// A ParseError indicates a malformed message.
+type ParseError struct {
+	// Byte offset within the line at which the problem was found. Note
+	// that if the reader has a Charset, this is an offset into the
+	// decoded line.
+	Offset int
+
+	// Description of the problem.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Parse error at byte %d: %s", e.Offset, e.Reason)
+}
+
+// State of parseMessage.
+type parser struct {
+	line   string
+	pos    int
+	strict bool
+}
+
+func (p *parser) errorAt(offset int, reason string) error {
+	return &ParseError{Offset: offset, Reason: reason}
+}
+
+// Read a word, i.e. everything up to the next space or the end of the line.
+func (p *parser) word() string {
+	start := p.pos
+	for p.pos < len(p.line) && p.line[p.pos] != ' ' {
+		p.pos++
+	}
+	return p.line[start:p.pos]
+}
+
+// Skip the spaces separating two words. Only strict mode cares how many
+// there are.
+func (p *parser) skipSpaces() error {
+	start := p.pos
+	for p.pos < len(p.line) && p.line[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.strict && p.pos-start > 1 {
+		return p.errorAt(start+1, "unexpected space")
+	}
+	return nil
+}
+
+// Return true if `command` is a valid command: either letters or a three
+// digit numeric.
+func isValidCommand(command string) bool {
+	if IsNumeric(command) {
+		return true
 	}
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return command != ""
+}
 
-	if c == ':' {
+// Parse the message in `line` (which does not include the line
+// terminator). If `strict` is true, be pedantic; see Options.
+func parseMessage(line string, strict bool) (*Message, error) {
+	p := &parser{line: line, strict: strict}
+	result := &Message{Params: []string{}}
+
+	if strict {
+		if i := strings.IndexByte(line, 0); i != -1 {
+			return nil, p.errorAt(i, "NUL character in message")
+		}
+	}
+	if err := p.skipSpaces(); err != nil {
+		return nil, err
+	}
+	if strict && p.pos != 0 {
+		return nil, p.errorAt(0, "unexpected space")
+	}
+	if p.pos < len(line) && line[p.pos] == '@' {
+		// Tags. These run up to the next space:
+		p.pos++
+		result.Tags = parseTags(p.word())
+		if err := p.skipSpaces(); err != nil {
+			return nil, err
+		}
+	}
+	if p.pos < len(line) && line[p.pos] == ':' {
 		// It's a prefix
-		err = parseWord(output, input)
-		if err != nil {
+		p.pos++
+		result.Prefix = p.word()
+		if strict && result.Prefix == "" {
+			return nil, p.errorAt(p.pos, "empty prefix")
+		}
+		if err := p.skipSpaces(); err != nil {
 			return nil, err
 		}
-		result.Prefix = output.String()
-		output.Reset()
-	} else {
-		// No prefix. That byte is part of the command, so put it back:
-		input.UnreadByte()
 	}
 
-	err = parseWord(output, input)
-	if err != nil {
-		// no command
-		return nil, err
+	commandStart := p.pos
+	result.Command = p.word()
+	if result.Command == "" {
+		return nil, p.errorAt(commandStart, "missing command")
+	}
+	if strict && !isValidCommand(result.Command) {
+		return nil, p.errorAt(commandStart, "invalid command")
 	}
-	result.Command = output.String()
-	output.Reset()
 
-	result.Params = []string{}
-	for parseWord(output, input) == nil {
-		result.Params = append(result.Params, output.String())
-		output.Reset()
+	for p.pos < len(line) {
+		spaceStart := p.pos
+		if err := p.skipSpaces(); err != nil {
+			return nil, err
+		}
+		if p.pos == len(line) {
+			if strict {
+				return nil, p.errorAt(spaceStart, "trailing space")
+			}
+			break
+		}
+		if line[p.pos] == ':' {
+			// Trailing parameter; this runs to the end of the line:
+			result.Params = append(result.Params, line[p.pos+1:])
+			break
+		}
+		result.Params = append(result.Params, p.word())
 	}
 	return result, nil
 }
 
-// Parse the next word (either space separated or a trailing argument starting
-// with ':'), from input, and write it to output. May consume 1 additional
-// character (typically a space), but otherwise leaves the remainder of input
-// where it is.
-func parseWord(output, input *bytes.Buffer) error {
-	c, err := input.ReadByte()
-	if err != nil {
-		return err
+// Parse the tags section of a message (without the leading '@').
+func parseTags(text string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(text, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = unescapeTagValue(kv[1])
+		}
+		// Per the spec, if a key appears more than once the last
+		// value wins, which is what we get for free here:
+		tags[kv[0]] = value
 	}
-	if c == ':' {
-		// End of the line; copy the whole thing:
-		c, err = input.ReadByte()
-		for err == nil {
-			output.WriteByte(c)
-			c, err = input.ReadByte()
+	return tags
+}
+
+// Return the serialized tags section of the message, without the leading '@'
+// or the trailing space. Tags are emitted sorted by key, so the output is
+// deterministic.
+func (m *Message) tagString() string {
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	for i, k := range keys {
+		if i != 0 {
+			buf.WriteByte(';')
 		}
-	} else {
-		for err == nil && c != ' ' {
-			output.WriteByte(c)
-			c, err = input.ReadByte()
+		buf.WriteString(k)
+		if v := m.Tags[k]; v != "" {
+			buf.WriteByte('=')
+			buf.WriteString(escapeTagValue(v))
+		}
+	}
+	return buf.String()
+}
+
+// Escape a tag value, as described in the IRCv3 message-tags spec.
+func escapeTagValue(value string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case ';':
+			buf.WriteString("\\:")
+		case ' ':
+			buf.WriteString("\\s")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\n':
+			buf.WriteString("\\n")
+		default:
+			buf.WriteByte(c)
 		}
 	}
-	if err == io.EOF {
-		err = nil
+	return buf.String()
+}
+
+// Inverse of escapeTagValue. Per the spec, an unknown escape sequence
+// stands for the escaped character itself, and a trailing lone backslash
+// is dropped.
+func unescapeTagValue(value string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch c = value[i]; c {
+		case ':':
+			buf.WriteByte(';')
+		case 's':
+			buf.WriteByte(' ')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(c)
+		}
 	}
-	return err
+	return buf.String()
 }
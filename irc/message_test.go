@@ -3,15 +3,25 @@ package irc
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 	"testing/quick"
+	"zenhack.net/go/irc-idler/irc/charset"
 )
 
 // example data for the tests
 var sampleMessages = []*Message{
 	{Command: "PRIVMSG", Params: []string{"##cool_topic", "Hello!"}},
+	{Command: "PRIVMSG", Params: []string{"##cool_topic", ""}},
+	{Command: "PRIVMSG", Params: []string{"##cool_topic", ":-)"}},
 	{Command: "PING", Params: []string{}},
 	{Prefix: "bob", Command: "STUFF", Params: []string{"THINGS"}},
+	{
+		Tags:    map[string]string{"time": "2016-10-01T12:00:00.000Z", "flag": ""},
+		Prefix:  "alice",
+		Command: "PRIVMSG",
+		Params:  []string{"bob", "Hello; there!"},
+	},
 }
 
 var sampleUnparsedMessages = []string{
@@ -19,6 +29,7 @@ var sampleUnparsedMessages = []string{
 	":bob PRIVMSG ##crypto :Hey!\r\n",
 	":bob PRIVMSG ##crypto Hey!\r\n",
 	"x\r\n",
+	"@a=b;c :bob PRIVMSG ##crypto :Hey!\r\n",
 }
 
 // Verify that writing out msg and reading it back results in the same value.
@@ -119,3 +130,240 @@ func TestParseStringOneMessageOnly(t *testing.T) {
 			"with two messages.")
 	}
 }
+
+// Check that we parse tags correctly, including escape sequences.
+func TestParseTags(t *testing.T) {
+	msg, err := ParseMessage(
+		"@time=2016-10-01T12:00:00.000Z;+example.com/k=a\\sb\\:c\\\\d\\r\\n;flag;bogus=\\x\\ " +
+			":bob!b@example.com PRIVMSG #chan :Hi there\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Message{
+		Tags: map[string]string{
+			"time":           "2016-10-01T12:00:00.000Z",
+			"+example.com/k": "a b;c\\d\r\n",
+			"flag":           "",
+			"bogus":          "x",
+		},
+		Prefix:  "bob!b@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#chan", "Hi there"},
+	}
+	if !expected.Eq(msg) {
+		t.Fatalf("Expected %q but got %q.", expected, msg)
+	}
+}
+
+// Tags are allowed to exceed MaxMessageLen, but the rest of the message isn't.
+func TestTagsLength(t *testing.T) {
+	longValue := strings.Repeat("a", MaxMessageLen)
+	msg := &Message{
+		Tags:    map[string]string{"long": longValue},
+		Command: "PING",
+		Params:  []string{"x"},
+	}
+	if !checkReadBack(msg) {
+		t.Fatal("Could not read back a message with long tags.")
+	}
+
+	msg.Tags["long"] = strings.Repeat("a", MaxTagsLen)
+	_, err := NewReader(strings.NewReader(msg.String())).ReadMessage()
+	if err == nil {
+		t.Fatal("Reading a message with oversized tags should fail.")
+	}
+
+	msg = &Message{Command: "PING", Params: []string{longValue}}
+	_, err = NewReader(strings.NewReader(msg.String())).ReadMessage()
+	if err != ErrMessageTooLong {
+		t.Fatalf("Expected ErrMessageTooLong but got %v.", err)
+	}
+}
+
+// A Reader/Writer with a Charset should transcode the text of messages.
+func TestCharsetOption(t *testing.T) {
+	opts := Options{Charset: charset.Fallback(charset.CP1251)}
+	r := NewReaderOptions(strings.NewReader(
+		"PRIVMSG #chan :\xcf\xf0\xe8\xe2\xe5\xf2\r\n"+
+			"PRIVMSG #chan :caf\xc3\xa9\r\n"), opts)
+	for _, text := range []string{"Привет", "café"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Params[1] != text {
+			t.Fatalf("Expected %q but got %q.", text, msg.Params[1])
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewWriterOptions(buf, Options{Charset: charset.CP1251})
+	if err := w.WriteMessage(&Message{Command: "PRIVMSG", Params: []string{"#chan", "Привет"}}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "PRIVMSG #chan \xcf\xf0\xe8\xe2\xe5\xf2\r\n" {
+		t.Fatalf("Unexpected output: %q", buf.String())
+	}
+}
+
+// Check what strict and lenient mode accept, and what they parse it to.
+func TestParseModes(t *testing.T) {
+	cases := []struct {
+		input string
+
+		// Expected result in lenient mode:
+		lenient *Message
+
+		// Offset of the error in strict mode, or -1 if the input should
+		// parse the same as in lenient mode.
+		strictErr int
+	}{
+		{
+			"PRIVMSG #chan :hello \r\n",
+			&Message{Command: "PRIVMSG", Params: []string{"#chan", "hello "}},
+			-1,
+		},
+		{
+			"PRIVMSG #chan hello\n",
+			&Message{Command: "PRIVMSG", Params: []string{"#chan", "hello"}},
+			19,
+		},
+		{
+			":bob  PRIVMSG  #chan  :hi\r\n",
+			&Message{Prefix: "bob", Command: "PRIVMSG", Params: []string{"#chan", "hi"}},
+			5,
+		},
+		{
+			"PING foo   \r\n",
+			&Message{Command: "PING", Params: []string{"foo"}},
+			9,
+		},
+		{
+			"@a=b :bob 001 alice :hi\r\n",
+			&Message{
+				Tags:    map[string]string{"a": "b"},
+				Prefix:  "bob",
+				Command: "001",
+				Params:  []string{"alice", "hi"},
+			},
+			-1,
+		},
+		{
+			"PR1VMSG #chan\r\n",
+			&Message{Command: "PR1VMSG", Params: []string{"#chan"}},
+			0,
+		},
+	}
+	for _, c := range cases {
+		msg, err := ParseMessage(c.input)
+		if err != nil {
+			t.Errorf("Lenient: unexpected error parsing %q: %v", c.input, err)
+		} else if !msg.Eq(c.lenient) {
+			t.Errorf("Lenient: parsed %q as %q, expected %q.", c.input, msg, c.lenient)
+		}
+
+		msg, err = ParseMessageOptions(c.input, Options{Strict: true})
+		if c.strictErr == -1 {
+			if err != nil {
+				t.Errorf("Strict: unexpected error parsing %q: %v", c.input, err)
+			} else if !msg.Eq(c.lenient) {
+				t.Errorf("Strict: parsed %q as %q, expected %q.", c.input, msg, c.lenient)
+			}
+			continue
+		}
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Strict: expected a *ParseError for %q, but got %v.", c.input, err)
+		} else if perr.Offset != c.strictErr {
+			t.Errorf("Strict: error for %q at offset %d, expected %d (%v).",
+				c.input, perr.Offset, c.strictErr, perr)
+		}
+	}
+}
+
+// Lenient mode skips blank lines; strict mode doesn't.
+func TestBlankLines(t *testing.T) {
+	input := "\r\n\nPING x\r\n"
+	msg, err := NewReader(strings.NewReader(input)).ReadMessage()
+	if err != nil || msg.Command != "PING" {
+		t.Fatalf("Lenient: got (%q, %v).", msg, err)
+	}
+	_, err = NewReaderOptions(strings.NewReader(input), Options{Strict: true}).ReadMessage()
+	if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("Strict: expected a *ParseError but got %v.", err)
+	}
+}
+
+// WriteTo should refuse to write messages that wouldn't be read back as
+// written, rather than letting e.g. a newline in a parameter start a new
+// message.
+func TestWriteInjection(t *testing.T) {
+	cases := []*Message{
+		{Command: "PRIVMSG", Params: []string{"#a", "hi\r\nQUIT :bye"}},
+		{Command: "PRIVMSG", Params: []string{"#a", "hi\nQUIT"}},
+		{Command: "PRIVMSG", Params: []string{"#a", "hi\x00"}},
+		{Command: "PRIVMSG", Params: []string{"#a #b", "hi"}},
+		{Command: "PRIVMSG", Params: []string{":#a", "hi"}},
+		{Command: "PRIVMSG", Params: []string{"", "hi"}},
+		{Command: "PRIVMSG\r\nQUIT", Params: []string{"#a", "hi"}},
+		{Command: "PRIV MSG", Params: []string{"#a", "hi"}},
+		{Prefix: "alice PRIVMSG", Command: "PRIVMSG", Params: []string{"#a", "hi"}},
+		{Tags: map[string]string{"a;b": "c"}, Command: "PRIVMSG", Params: []string{"#a", "hi"}},
+	}
+	for _, msg := range cases {
+		buf := &bytes.Buffer{}
+		_, err := msg.WriteTo(buf)
+		if _, ok := err.(*InvalidMessageError); !ok {
+			t.Errorf("WriteTo(%q): expected an *InvalidMessageError, but got %v.", msg, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("WriteTo(%q) wrote %q despite failing.", msg, buf.String())
+		}
+		if msg.Validate() == nil {
+			t.Errorf("Validate(%q) should have failed.", msg)
+		}
+	}
+}
+
+// WriteTo should refuse to write messages that are too long.
+func TestWriteTooLong(t *testing.T) {
+	buf := &bytes.Buffer{}
+	msg := &Message{Command: "PRIVMSG", Params: []string{"#a", strings.Repeat("a", MaxMessageLen)}}
+	if _, err := msg.WriteTo(buf); err != ErrMessageTooLong {
+		t.Errorf("Expected ErrMessageTooLong, but got %v.", err)
+	}
+	msg = &Message{
+		Tags:    map[string]string{"long": strings.Repeat("a", MaxTagsLen)},
+		Command: "PING",
+		Params:  []string{"x"},
+	}
+	if _, err := msg.WriteTo(buf); err != ErrMessageTooLong {
+		t.Errorf("Expected ErrMessageTooLong for long tags, but got %v.", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteTo wrote %q despite failing.", buf.String())
+	}
+
+	// Right at the limit is fine:
+	msg = &Message{Command: "PING", Params: []string{strings.Repeat("a", MaxMessageLen-len("PING \r\n"))}}
+	if _, err := msg.WriteTo(buf); err != nil {
+		t.Errorf("Unexpected error writing a message of maximum length: %v", err)
+	}
+}
+
+// Writers should apply the length limit to the bytes they actually write.
+func TestWriterLineLength(t *testing.T) {
+	// 400 characters is 800 bytes of UTF-8, but only 400 of CP1251:
+	msg := &Message{Command: "PRIVMSG", Params: []string{"#a", strings.Repeat("ж", 400)}}
+	buf := &bytes.Buffer{}
+	if err := NewWriterOptions(buf, Options{Charset: charset.CP1251}).WriteMessage(msg); err != nil {
+		t.Errorf("Unexpected error writing as CP1251: %v", err)
+	}
+	if err := NewWriterOptions(buf, Options{Charset: charset.UTF8}).WriteMessage(msg); err != ErrMessageTooLong {
+		t.Errorf("Expected ErrMessageTooLong writing as UTF-8, but got %v.", err)
+	}
+	opts := Options{Charset: charset.UTF8, MaxLineLen: 3 * MaxMessageLen}
+	if err := NewWriterOptions(buf, opts).WriteMessage(msg); err != nil {
+		t.Errorf("Unexpected error writing with MaxLineLen: %v", err)
+	}
+}
@@ -6,8 +6,9 @@ const (
 	//
 	// * RFC 2812
 	// * https://www.alien.net.au/irc/irc2numerics.html
+	// * The IRCv3 specifications (https://ircv3.net/irc/)
 	//
-	// The latter includes some codes that are not in the rfc, but
+	// The latter two include some codes that are not in the rfc, but
 	// that we've seen in the wild. These are called out in the
 	// definitions below.
 
@@ -16,6 +17,7 @@ const (
 	RPL_CREATED         = "003"
 	RPL_MYINFO          = "004"
 	RPL_BOUNCE          = "005"
+	RPL_ISUPPORT        = "005" // RFC 2812 says RPL_BOUNCE, but nobody uses it that way.
 	RPL_YOURID          = "042" // Not in the spec, but seen from oftc.
 	RPL_TRACELINK       = "200"
 	RPL_TRACECONNECTING = "201"
@@ -179,4 +181,18 @@ const (
 	ERR_NOSERVICEHOST       = "492"
 	ERR_UMODEUNKNOWNFLAG    = "501"
 	ERR_USERSDONTMATCH      = "502"
+
+	// From the IRCv3 capability negotiation spec:
+	ERR_INVALIDCAPCMD = "410"
+
+	// SASL, from the IRCv3 sasl capability spec:
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	ERR_NICKLOCKED  = "902"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+	RPL_SASLMECHS   = "908"
 )
@@ -0,0 +1,143 @@
+// Package sasl implements client-side SASL authentication, as used by the
+// IRCv3 sasl capability.
+//
+// Supported mechanisms are PLAIN, EXTERNAL and SCRAM-SHA-256. Besides the
+// mechanisms themselves, the package handles the framing of SASL messages
+// in IRC AUTHENTICATE commands (base64 encoding and splitting into 400 byte
+// chunks).
+package sasl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+const (
+	// Maximum length of the argument to a single AUTHENTICATE message.
+	chunkLen = 400
+)
+
+// A Mechanism is the client side of a SASL mechanism.
+type Mechanism interface {
+	// Name returns the name of the mechanism, as sent to the server in
+	// the initial AUTHENTICATE message.
+	Name() string
+
+	// Next returns the response to the server's challenge. For the first
+	// call, challenge is the (always empty) initial challenge.
+	Next(challenge []byte) (response []byte, err error)
+}
+
+// Credentials specify how to authenticate.
+type Credentials struct {
+	// The mechanism to use: one of "PLAIN", "EXTERNAL" or "SCRAM-SHA-256".
+	Mechanism string
+
+	// Account name and password. These are ignored by EXTERNAL, which
+	// relies on the client certificate presented during the TLS handshake.
+	Username, Password string
+}
+
+type unknownMechanismError string
+
+func (e unknownMechanismError) Error() string {
+	return fmt.Sprintf("Unknown SASL mechanism: %q", string(e))
+}
+
+// NewMechanism returns a fresh Mechanism for the credentials. Mechanisms are
+// stateful, so a new one is needed for each authentication attempt.
+func (c *Credentials) NewMechanism() (Mechanism, error) {
+	switch c.Mechanism {
+	case "PLAIN":
+		return NewPlain(c.Username, c.Password), nil
+	case "EXTERNAL":
+		return NewExternal(""), nil
+	case "SCRAM-SHA-256":
+		return NewScramSHA256(c.Username, c.Password), nil
+	default:
+		return nil, unknownMechanismError(c.Mechanism)
+	}
+}
+
+type plain struct {
+	user, pass string
+}
+
+// NewPlain returns a Mechanism implementing PLAIN (RFC 4616).
+func NewPlain(user, pass string) Mechanism {
+	return &plain{user: user, pass: pass}
+}
+
+func (m *plain) Name() string {
+	return "PLAIN"
+}
+
+func (m *plain) Next(challenge []byte) ([]byte, error) {
+	// The authorization identity is left empty, meaning "same as the
+	// authentication identity".
+	return []byte("\x00" + m.user + "\x00" + m.pass), nil
+}
+
+type external struct {
+	authzid string
+}
+
+// NewExternal returns a Mechanism implementing EXTERNAL (RFC 4422, appendix
+// A). The actual authentication happens outside of SASL, typically via a TLS
+// client certificate. authzid may be empty.
+func NewExternal(authzid string) Mechanism {
+	return &external{authzid: authzid}
+}
+
+func (m *external) Name() string {
+	return "EXTERNAL"
+}
+
+func (m *external) Next(challenge []byte) ([]byte, error) {
+	return []byte(m.authzid), nil
+}
+
+// EncodeResponse returns the AUTHENTICATE messages needed to send `response`
+// to the server.
+func EncodeResponse(response []byte) []*irc.Message {
+	text := base64.StdEncoding.EncodeToString(response)
+	ret := []*irc.Message{}
+	for len(text) >= chunkLen {
+		ret = append(ret, authenticate(text[:chunkLen]))
+		text = text[chunkLen:]
+	}
+	if text == "" {
+		// Either the response is empty, or it was an exact multiple of
+		// the chunk length; either way we need a "+" to finish it.
+		text = "+"
+	}
+	return append(ret, authenticate(text))
+}
+
+func authenticate(arg string) *irc.Message {
+	return &irc.Message{Command: "AUTHENTICATE", Params: []string{arg}}
+}
+
+// A ChallengeBuffer reassembles challenges sent by the server, which may be
+// split across several AUTHENTICATE messages. The zero value is ready to use.
+type ChallengeBuffer struct {
+	buf bytes.Buffer
+}
+
+// Add the argument of an AUTHENTICATE message sent by the server. If this
+// completes a challenge, Add returns the decoded challenge and done = true,
+// and the buffer is reset for the next one.
+func (b *ChallengeBuffer) Add(arg string) (challenge []byte, done bool, err error) {
+	if arg != "+" {
+		b.buf.WriteString(arg)
+	}
+	if len(arg) == chunkLen {
+		return nil, false, nil
+	}
+	text := b.buf.String()
+	b.buf.Reset()
+	challenge, err = base64.StdEncoding.DecodeString(text)
+	return challenge, err == nil, err
+}
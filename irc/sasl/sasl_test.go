@@ -0,0 +1,98 @@
+package sasl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Check SCRAM-SHA-256 against the example exchange in RFC 7677, section 3.
+func TestScramSHA256(t *testing.T) {
+	m := NewScramSHA256("user", "pencil").(*scramSHA256)
+	m.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	steps := []struct {
+		challenge, response string
+	}{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+				"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+				"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		},
+		{"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", ""},
+	}
+	for i, step := range steps {
+		resp, err := m.Next([]byte(step.challenge))
+		if err != nil {
+			t.Fatalf("Step %d: unexpected error: %v", i, err)
+		}
+		if string(resp) != step.response {
+			t.Fatalf("Step %d: expected response %q but got %q.",
+				i, step.response, resp)
+		}
+	}
+}
+
+// A server that doesn't know the password must not be able to convince us
+// that authentication succeeded.
+func TestScramBadServerSignature(t *testing.T) {
+	m := NewScramSHA256("user", "pencil").(*scramSHA256)
+	m.nonce = "rOprNGfwEbeRWgbNEkqO"
+	m.Next(nil)
+	m.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	_, err := m.Next([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != errBadServerSignature {
+		t.Fatalf("Expected errBadServerSignature but got %v.", err)
+	}
+}
+
+func TestPlain(t *testing.T) {
+	resp, _ := NewPlain("alice", "secret").Next(nil)
+	if string(resp) != "\x00alice\x00secret" {
+		t.Fatalf("Unexpected PLAIN response: %q", resp)
+	}
+}
+
+// Check that EncodeResponse and ChallengeBuffer agree with each other, and
+// with the chunking rules in the spec.
+func TestChunking(t *testing.T) {
+	cases := []struct {
+		response  []byte
+		numChunks int
+	}{
+		{[]byte{}, 1},
+		{[]byte("hello"), 1},
+		{bytes.Repeat([]byte{'x'}, 300), 2}, // exactly 400 base64 chars, then "+"
+		{bytes.Repeat([]byte{'x'}, 500), 2},
+	}
+	for _, c := range cases {
+		msgs := EncodeResponse(c.response)
+		if len(msgs) != c.numChunks {
+			t.Errorf("Expected %d chunks for a %d byte response, but got %d.",
+				c.numChunks, len(c.response), len(msgs))
+			continue
+		}
+		var buf ChallengeBuffer
+		for i, msg := range msgs {
+			result, done, err := buf.Add(msg.Params[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done != (i == len(msgs)-1) {
+				t.Fatalf("Chunk %d of %d: done = %v.", i, len(msgs), done)
+			}
+			if done && !bytes.Equal(result, c.response) {
+				t.Fatalf("Expected %q but got %q.", c.response, result)
+			}
+		}
+	}
+	if arg := EncodeResponse(nil)[0].Params[0]; arg != "+" {
+		t.Fatalf("Empty response should be sent as \"+\", not %q.", arg)
+	}
+	if arg := EncodeResponse([]byte("x"))[0].Params[0]; strings.Contains(arg, "+") {
+		t.Fatalf("Unexpected \"+\" in %q.", arg)
+	}
+}
@@ -0,0 +1,296 @@
+package irc
+
+// This file describes the parameters of the commands and numeric replies we
+// know about, for use by Message.Validate.
+
+// A ParamKind says what a parameter holds.
+type ParamKind int
+
+const (
+	// Free-form text, e.g. a reason or the trailing text of a reply.
+	// This may be empty.
+	ParamText ParamKind = iota
+
+	// The client a numeric reply is addressed to. This is "*" if the
+	// client has not yet registered.
+	ParamClient
+
+	// A channel name.
+	ParamChannel
+
+	// A comma-separated list of channel names, as for JOIN and PART.
+	ParamChannelList
+
+	// A nickname.
+	ParamNick
+
+	// The recipient of a message: a channel or nick, or a comma-separated
+	// list of those.
+	ParamTarget
+)
+
+// A Schema describes the parameters of a command.
+type Schema struct {
+	// The minimum and maximum number of parameters. A MaxParams of 0
+	// means there is no limit beyond the protocol's own (15).
+	MinParams, MaxParams int
+
+	// The kinds of the leading parameters. Any parameters past the end
+	// of this are ParamText.
+	Params []ParamKind
+}
+
+// Kind returns the kind of the i'th parameter.
+func (s Schema) Kind(i int) ParamKind {
+	if i < len(s.Params) {
+		return s.Params[i]
+	}
+	return ParamText
+}
+
+// command returns the schema for a command with exactly the parameters
+// `params`, of which the first `min` are required.
+func command(min int, params ...ParamKind) Schema {
+	return Schema{MinParams: min, MaxParams: len(params), Params: params}
+}
+
+// reply returns the schema for a numeric reply, whose parameters are the
+// client followed by `params`, all required. Servers often tack on extra
+// parameters, so there is no maximum.
+func reply(params ...ParamKind) Schema {
+	kinds := append([]ParamKind{ParamClient}, params...)
+	return Schema{MinParams: len(kinds), Params: kinds}
+}
+
+// replyMin is like reply, but only the first `min` of `params` are required.
+func replyMin(min int, params ...ParamKind) Schema {
+	schema := reply(params...)
+	schema.MinParams = 1 + min
+	return schema
+}
+
+var schemas = map[string]Schema{
+	// Commands. Where the RFC and common practice disagree about the
+	// maximum number of parameters, we leave it unlimited:
+	"PASS":         {MinParams: 1},
+	"NICK":         {MinParams: 1, Params: []ParamKind{ParamNick}},
+	"USER":         command(4, ParamText, ParamText, ParamText, ParamText),
+	"OPER":         command(2, ParamText, ParamText),
+	"QUIT":         command(0, ParamText),
+	"JOIN":         {MinParams: 1, Params: []ParamKind{ParamChannelList}},
+	"PART":         command(1, ParamChannelList, ParamText),
+	"TOPIC":        command(1, ParamChannel, ParamText),
+	"NAMES":        command(0, ParamChannelList, ParamText),
+	"LIST":         command(0, ParamChannelList, ParamText),
+	"INVITE":       command(2, ParamNick, ParamChannel),
+	"KICK":         command(2, ParamChannel, ParamText, ParamText),
+	"MODE":         {MinParams: 1, Params: []ParamKind{ParamTarget}},
+	"PRIVMSG":      command(2, ParamTarget, ParamText),
+	"NOTICE":       command(2, ParamTarget, ParamText),
+	"TAGMSG":       command(1, ParamTarget),
+	"WHO":          command(0, ParamText, ParamText),
+	"WHOIS":        command(1, ParamText, ParamText),
+	"WHOWAS":       command(1, ParamText, ParamText, ParamText),
+	"KILL":         command(2, ParamNick, ParamText),
+	"PING":         command(1, ParamText, ParamText),
+	"PONG":         command(1, ParamText, ParamText),
+	"AWAY":         command(0, ParamText),
+	"ISON":         {MinParams: 1},
+	"USERHOST":     command(1, ParamText, ParamText, ParamText, ParamText, ParamText),
+	"CAP":          {MinParams: 1},
+	"AUTHENTICATE": command(1, ParamText),
+	"ERROR":        command(1, ParamText),
+	"BATCH":        {MinParams: 1},
+
+	// Numeric replies. Those which RFC 2812 lists as reserved or unused
+	// only require the client parameter:
+	RPL_WELCOME:         reply(ParamText),
+	RPL_YOURHOST:        reply(ParamText),
+	RPL_CREATED:         reply(ParamText),
+	RPL_MYINFO:          reply(ParamText, ParamText, ParamText, ParamText),
+	RPL_ISUPPORT:        reply(ParamText),
+	RPL_YOURID:          reply(ParamText, ParamText),
+	RPL_TRACELINK:       reply(ParamText, ParamText, ParamText, ParamText),
+	RPL_TRACECONNECTING: reply(ParamText, ParamText, ParamText),
+	RPL_TRACEHANDSHAKE:  reply(ParamText, ParamText, ParamText),
+	RPL_TRACEOPERATOR:   reply(ParamText, ParamText, ParamNick),
+	RPL_TRACEUSER:       reply(ParamText, ParamText, ParamNick),
+	RPL_TRACESERVER:     reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_TRACESERVICE:    reply(ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_TRACENEWTYPE:    reply(ParamText, ParamText, ParamText),
+	RPL_TRACECLASS:      reply(ParamText, ParamText, ParamText),
+	RPL_TRACECONNECT:    reply(),
+	RPL_STATSLINKINFO:   reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSCOMMANDS:   reply(ParamText, ParamText),
+	RPL_STATSCLINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSNLINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSILINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSKLINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSQLINE:      reply(),
+	RPL_STATSYLINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_ENDOFSTATS:      reply(ParamText, ParamText),
+	RPL_UMODEIS:         reply(ParamText),
+	RPL_SERVICEINFO:     reply(),
+	RPL_ENDOFSERVICES:   reply(),
+	RPL_SERVICE:         reply(),
+	RPL_SERVLIST:        reply(ParamText, ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSVLINE:      reply(),
+	RPL_STATSLLINE:      reply(ParamText, ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSUPTIME:     reply(ParamText),
+	RPL_STATSOLINE:      reply(ParamText, ParamText, ParamText, ParamText),
+	RPL_STATSHLINE:      reply(ParamText, ParamText, ParamText, ParamText), // Also RPL_STATSSLINE.
+	RPL_STATSPING:       reply(),
+	RPL_STATSBLINE:      reply(),
+	RPL_STATSDLINE:      reply(),
+	RPL_LUSERCLIENT:     reply(ParamText),
+	RPL_LUSEROP:         reply(ParamText, ParamText),
+	RPL_LUSERUNKNOWN:    reply(ParamText, ParamText),
+	RPL_LUSERCHANNELS:   reply(ParamText, ParamText),
+	RPL_LUSERME:         reply(ParamText),
+	RPL_ADMINME:         replyMin(1, ParamText, ParamText), // The server is optional.
+	RPL_ADMINLOC1:       reply(ParamText),
+	RPL_ADMINLOC2:       reply(ParamText),
+	RPL_ADMINLOCEMAIL:   reply(ParamText),
+	RPL_TRACELOG:        reply(ParamText, ParamText, ParamText),
+	RPL_TRACEEND:        reply(ParamText, ParamText),
+	RPL_TRYAGAIN:        reply(ParamText, ParamText),
+	RPL_NONE:            reply(),
+	RPL_AWAY:            reply(ParamNick, ParamText),
+	RPL_USERHOST:        reply(ParamText),
+	RPL_ISON:            reply(ParamText),
+	RPL_UNAWAY:          reply(ParamText),
+	RPL_NOWAWAY:         reply(ParamText),
+	RPL_WHOISUSER:       reply(ParamNick, ParamText, ParamText, ParamText, ParamText),
+	RPL_WHOISSERVER:     reply(ParamNick, ParamText, ParamText),
+	RPL_WHOISOPERATOR:   reply(ParamNick, ParamText),
+	RPL_WHOWASUSER:      reply(ParamNick, ParamText, ParamText, ParamText, ParamText),
+	RPL_ENDOFWHO:        reply(ParamText, ParamText),
+	RPL_WHOISCHANOP:     reply(),
+	RPL_WHOISIDLE:       replyMin(2, ParamNick, ParamText, ParamText), // RFC 1459 has no signon time.
+	RPL_ENDOFWHOIS:      reply(ParamNick, ParamText),
+	RPL_WHOISCHANNELS:   reply(ParamNick, ParamText),
+	RPL_LISTSTART:       reply(),
+	RPL_LIST:            reply(ParamChannel, ParamText, ParamText),
+	RPL_LISTEND:         reply(ParamText),
+	RPL_CHANNELMODEIS:   reply(ParamChannel, ParamText),
+	RPL_UNIQOPIS:        reply(ParamChannel, ParamNick),
+	RPL_NOTOPIC:         reply(ParamChannel, ParamText),
+	RPL_TOPIC:           reply(ParamChannel, ParamText),
+	RPL_TOPICWHOTIME:    reply(ParamChannel, ParamText, ParamText),
+	RPL_INVITING:        reply(ParamNick, ParamChannel),
+	RPL_SUMMONING:       reply(ParamText, ParamText),
+	RPL_INVITELIST:      reply(ParamChannel, ParamText),
+	RPL_ENDOFINVITELIST: reply(ParamChannel, ParamText),
+	RPL_EXCEPTLIST:      reply(ParamChannel, ParamText),
+	RPL_ENDOFEXCEPTLIST: reply(ParamChannel, ParamText),
+	RPL_VERSION:         reply(ParamText, ParamText, ParamText),
+	RPL_WHOREPLY:        reply(ParamChannel, ParamText, ParamText, ParamText, ParamNick, ParamText, ParamText),
+	RPL_NAMEREPLY:       reply(ParamText, ParamChannel, ParamText),
+	RPL_KILLDONE:        reply(),
+	RPL_CLOSING:         reply(),
+	RPL_CLOSEEND:        reply(),
+	RPL_LINKS:           reply(ParamText, ParamText, ParamText),
+	RPL_ENDOFLINKS:      reply(ParamText, ParamText),
+	RPL_ENDOFNAMES:      reply(ParamChannel, ParamText),
+	RPL_BANLIST:         reply(ParamChannel, ParamText),
+	RPL_ENDOFBANLIST:    reply(ParamChannel, ParamText),
+	RPL_ENDOFWHOWAS:     reply(ParamNick, ParamText),
+	RPL_INFO:            reply(ParamText),
+	RPL_INFOSTART:       reply(),
+	RPL_ENDOFINFO:       reply(ParamText),
+	RPL_MOTDSTART:       reply(ParamText),
+	RPL_MOTD:            reply(ParamText),
+	RPL_ENDOFMOTD:       reply(ParamText),
+	RPL_YOUREOPER:       reply(ParamText),
+	RPL_REHASHING:       reply(ParamText, ParamText),
+	RPL_YOURESERVICE:    reply(ParamText),
+	RPL_MYPORTIS:        reply(),
+	RPL_TIME:            reply(ParamText, ParamText),
+	RPL_USERSSTART:      reply(ParamText),
+	RPL_USERS:           reply(ParamText),
+	RPL_ENDOFUSERS:      reply(ParamText),
+	RPL_NOUSERS:         reply(ParamText),
+
+	ERR_NOSUCHNICK:          reply(ParamNick, ParamText),
+	ERR_NOSUCHSERVER:        reply(ParamText, ParamText),
+	ERR_NOSUCHCHANNEL:       reply(ParamChannel, ParamText),
+	ERR_CANNOTSENDTOCHAN:    reply(ParamChannel, ParamText),
+	ERR_TOOMANYCHANNELS:     reply(ParamChannel, ParamText),
+	ERR_WASNOSUCHNICK:       reply(ParamNick, ParamText),
+	ERR_TOOMANYTARGETS:      reply(ParamText, ParamText),
+	ERR_NOSUCHSERVICE:       reply(ParamText, ParamText),
+	ERR_NOORIGIN:            reply(ParamText),
+	ERR_NORECIPIENT:         reply(ParamText),
+	ERR_NOTEXTTOSEND:        reply(ParamText),
+	ERR_WILDTOPLEVEL:        reply(ParamText, ParamText),
+	ERR_BADMASK:             reply(ParamText, ParamText),
+	ERR_UNKNOWNCOMMAND:      reply(ParamText, ParamText),
+	ERR_NOMOTD:              reply(ParamText),
+	ERR_NOADMININFO:         reply(ParamText, ParamText),
+	ERR_FILEERROR:           reply(ParamText),
+	ERR_NONICKNAMEGIVEN:     reply(ParamText),
+	ERR_ERRONEUSNICKNAME:    reply(ParamText, ParamText),
+	ERR_NICKNAMEINUSE:       reply(ParamNick, ParamText),
+	ERR_NICKCOLLISION:       reply(ParamNick, ParamText),
+	ERR_UNAVAILABLERESOURCE: reply(ParamText, ParamText),
+	ERR_USERNOTINCHANNEL:    reply(ParamNick, ParamChannel, ParamText),
+	ERR_NOTONCHANNEL:        reply(ParamChannel, ParamText),
+	ERR_USERONCHANNEL:       reply(ParamNick, ParamChannel, ParamText),
+	ERR_NOLOGIN:             reply(ParamText, ParamText),
+	ERR_SUMMONISDISABLED:    reply(ParamText),
+	ERR_USERISDISABLED:      reply(ParamText),
+	ERR_NOTREGISTERED:       reply(ParamText),
+	ERR_NEEDMOREPARAMS:      reply(ParamText, ParamText),
+	ERR_ALREADYREGISTERED:   reply(ParamText),
+	ERR_NOPERMFORHOST:       reply(ParamText),
+	ERR_PASSDWMISMATCH:      reply(ParamText),
+	ERR_YOUREBANNEDCREEP:    reply(ParamText),
+	ERR_YOUWILLBEBANNED:     reply(),
+	ERR_KEYSET:              reply(ParamChannel, ParamText),
+	ERR_CHANNELISFULL:       reply(ParamChannel, ParamText),
+	ERR_UNKNOWNMODE:         reply(ParamText, ParamText),
+	ERR_INVITEONLYCHAN:      reply(ParamChannel, ParamText),
+	ERR_BANNEDFROMCHAN:      reply(ParamChannel, ParamText),
+	ERR_BADCHANNELKEY:       reply(ParamChannel, ParamText),
+	ERR_BADCHANMASK:         reply(ParamText, ParamText),
+	ERR_NOCHANMODES:         reply(ParamChannel, ParamText),
+	ERR_BANLISTISFULL:       reply(ParamChannel, ParamText, ParamText),
+	ERR_NOPRIVILEGES:        reply(ParamText),
+	ERR_CHANOPRIVSNEEDED:    reply(ParamChannel, ParamText),
+	ERR_CANTKILLSERVER:      reply(ParamText),
+	ERR_RESTRICTED:          reply(ParamText),
+	ERR_UNIQOPPRIVSNEEDED:   reply(ParamText),
+	ERR_NOOPERHOST:          reply(ParamText),
+	ERR_NOSERVICEHOST:       reply(),
+	ERR_UMODEUNKNOWNFLAG:    reply(ParamText),
+	ERR_USERSDONTMATCH:      reply(ParamText),
+	ERR_INVALIDCAPCMD:       reply(ParamText, ParamText),
+
+	RPL_LOGGEDIN:    reply(ParamText, ParamText, ParamText),
+	RPL_LOGGEDOUT:   reply(ParamText, ParamText),
+	ERR_NICKLOCKED:  reply(ParamText),
+	RPL_SASLSUCCESS: reply(ParamText),
+	ERR_SASLFAIL:    reply(ParamText),
+	ERR_SASLTOOLONG: reply(ParamText),
+	ERR_SASLABORTED: reply(ParamText),
+	ERR_SASLALREADY: reply(ParamText),
+	RPL_SASLMECHS:   reply(ParamText, ParamText),
+}
+
+// The schema for numeric replies not in the table above (i.e. those not
+// defined in numeric_replies.go); all we know is that they're addressed to a
+// client.
+var unknownNumeric = reply()
+
+// LookupSchema returns the schema for `command`, and whether we know of one.
+// Numeric replies that aren't listed individually get a schema requiring
+// only the client parameter.
+func LookupSchema(command string) (Schema, bool) {
+	if schema, ok := schemas[command]; ok {
+		return schema, true
+	}
+	if IsNumeric(command) {
+		return unknownNumeric, true
+	}
+	return Schema{}, false
+}
@@ -0,0 +1,75 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		msg *Message
+		err *MessageError // nil if valid.
+	}{
+		{&Message{Command: "PRIVMSG", Params: []string{"#a", "hi"}}, nil},
+		{&Message{Command: "FROBNICATE", Params: []string{}}, nil},
+		{&Message{Command: "999", Params: []string{"alice"}}, nil},
+		{&Message{Command: RPL_MYINFO, Params: []string{"alice", "srv", "v1", "i", "o", "b"}}, nil},
+		{
+			&Message{Command: "", Params: []string{}},
+			&MessageError{Command: ERR_UNKNOWNCOMMAND, Params: []string{"alice", "", "Unknown command"}},
+		},
+		{
+			&Message{Command: "PRIVMSG", Params: []string{"#a"}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", "PRIVMSG", "Not enough parameters"}},
+		},
+		{
+			&Message{Command: "PRIVMSG", Params: []string{"", "hi"}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", "PRIVMSG", "Not enough parameters"}},
+		},
+		{
+			&Message{Command: "USER", Params: []string{"a", "0", "*", "A", "extra"}},
+			&MessageError{Command: ERR_UNKNOWNCOMMAND, Params: []string{"alice", "USER", "Too many parameters"}},
+		},
+		{
+			&Message{Command: RPL_NAMEREPLY, Params: []string{"alice", "=", "#a"}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", RPL_NAMEREPLY, "Not enough parameters"}},
+		},
+		{
+			&Message{Command: RPL_TOPIC, Params: []string{"alice", "", "topic"}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", RPL_TOPIC, "Not enough parameters"}},
+		},
+		{
+			&Message{Command: RPL_TRACELINK, Params: []string{"alice", "Link", "2.8"}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", RPL_TRACELINK, "Not enough parameters"}},
+		},
+		{
+			&Message{Command: RPL_ADMINME, Params: []string{"alice", "irc.example.com", "Administrative info"}},
+			nil,
+		},
+		{&Message{Command: RPL_ADMINME, Params: []string{"alice", "Administrative info"}}, nil},
+		{&Message{Command: RPL_WHOISIDLE, Params: []string{"alice", "bob", "42", "seconds idle"}}, nil},
+		{
+			&Message{Command: "999", Params: []string{}},
+			&MessageError{Command: ERR_NEEDMOREPARAMS, Params: []string{"alice", "999", "Not enough parameters"}},
+		},
+	}
+	for _, c := range cases {
+		err := c.msg.ValidateFor("alice")
+		if !reflect.DeepEqual(err, c.err) {
+			t.Errorf("ValidateFor(%q) = %q, expected %q.", c.msg, err, c.err)
+		}
+	}
+}
+
+// Every numeric in the registry should at least require the client
+// parameter.
+func TestNumericSchemas(t *testing.T) {
+	for command, schema := range schemas {
+		if !IsNumeric(command) {
+			continue
+		}
+		if schema.MinParams < 1 || schema.Kind(0) != ParamClient {
+			t.Errorf("Schema for %s doesn't require a client parameter.", command)
+		}
+	}
+}
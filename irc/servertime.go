@@ -0,0 +1,31 @@
+package irc
+
+// This file deals with the time tag, which says when a message was sent. It
+// is defined by the IRCv3 server-time capability.
+
+import (
+	"time"
+)
+
+// ServerTimeLayout is the layout (see time.Time.Format) of the value of a
+// time tag.
+const ServerTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// FormatServerTime returns `t` in the form used by the time tag.
+func FormatServerTime(t time.Time) string {
+	return t.UTC().Format(ServerTimeLayout)
+}
+
+// Time returns the time given by the message's time tag. ok is false if it
+// has no time tag, or its value is malformed.
+func (m *Message) Time() (t time.Time, ok bool) {
+	value, ok := m.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(ServerTimeLayout, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,32 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerTime(t *testing.T) {
+	when := time.Date(2016, 10, 1, 12, 30, 0, 123e6, time.FixedZone("EST", -5*60*60))
+	msg := &Message{
+		Tags:    map[string]string{"time": FormatServerTime(when)},
+		Command: "PRIVMSG",
+		Params:  []string{"#chan", "hi"},
+	}
+	if msg.Tags["time"] != "2016-10-01T17:30:00.123Z" {
+		t.Fatalf("Unexpected time tag: %q", msg.Tags["time"])
+	}
+	if got, ok := msg.Time(); !ok || !got.Equal(when) {
+		t.Fatalf("Time() = (%v, %v), expected (%v, true)", got, ok, when)
+	}
+
+	for _, value := range []string{"", "yesterday", "2016-10-01 17:30:00"} {
+		msg.Tags["time"] = value
+		if _, ok := msg.Time(); ok {
+			t.Fatalf("Time() accepted the malformed time tag %q.", value)
+		}
+	}
+	delete(msg.Tags, "time")
+	if _, ok := msg.Time(); ok {
+		t.Fatal("Time() succeeded without a time tag.")
+	}
+}
@@ -0,0 +1,98 @@
+package irc
+
+// This file deals with splitting long PRIVMSG and NOTICE messages into
+// several that each fit within MaxMessageLen.
+
+import (
+	"strings"
+	"unicode/utf8"
+	"zenhack.net/go/irc-idler/irc/format"
+)
+
+const (
+	ctcpActionStart = "\x01ACTION "
+	ctcpActionEnd   = "\x01"
+)
+
+// SplitMessage splits a PRIVMSG or NOTICE whose text is too long to be
+// relayed to other users into several messages. `prefixLen` is the length
+// of the prefix (usually nick!user@host) the server will add when relaying
+// the message; since it counts against MaxMessageLen, a message can be too
+// long even if it was short enough to send to the server in the first
+// place.
+//
+// Text is split at spaces where possible (the space at the split point is
+// dropped). Failing that, it is split anywhere, but never in the middle of
+// a UTF-8 sequence or formatting code. CTCP ACTIONs (/me) are split into
+// several ACTIONs. Any other message is returned unchanged, as the only
+// element of the result.
+func SplitMessage(msg *Message, prefixLen int) []*Message {
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) != 2 {
+		return []*Message{msg}
+	}
+	// ":<prefix> <command> <target> :<text>\r\n"
+	overhead := 1 + prefixLen + 1 + len(msg.Command) + 1 + len(msg.Params[0]) + 2 + 2
+	text := msg.Params[1]
+
+	start, end := "", ""
+	if strings.HasPrefix(text, ctcpActionStart) {
+		start, end = ctcpActionStart, ctcpActionEnd
+		text = strings.TrimSuffix(text[len(start):], end)
+	} else if strings.HasPrefix(text, "\x01") {
+		// Some other CTCP message; these are never long in practice,
+		// and splitting them wouldn't be meaningful.
+		return []*Message{msg}
+	}
+	budget := MaxMessageLen - overhead - len(start) - len(end)
+	if len(start)+len(text)+len(end) <= MaxMessageLen-overhead || budget <= 0 {
+		return []*Message{msg}
+	}
+
+	ret := []*Message{}
+	for _, chunk := range splitText(text, budget) {
+		part := *msg
+		part.Params = []string{msg.Params[0], start + chunk + end}
+		ret = append(ret, &part)
+	}
+	return ret
+}
+
+// Split `text` into chunks of at most `budget` bytes, as described for
+// SplitMessage.
+func splitText(text string, budget int) []string {
+	ret := []string{}
+	for len(text) > budget {
+		// Find the last safe place to cut, and the last space.
+		cut, space := 0, -1
+		for i := 0; i < budget; {
+			n := format.CodeLen(text[i:])
+			if n == 0 {
+				_, n = utf8.DecodeRuneInString(text[i:])
+			}
+			if i+n > budget {
+				break
+			}
+			if text[i] == ' ' {
+				space = i
+			}
+			i += n
+			cut = i
+		}
+		if space > 0 {
+			ret = append(ret, text[:space])
+			text = text[space+1:]
+		} else if cut > 0 {
+			ret = append(ret, text[:cut])
+			text = text[cut:]
+		} else {
+			// The budget is smaller than a single code or character;
+			// nothing sensible to do but cut it anyway.
+			ret = append(ret, text[:budget])
+			text = text[budget:]
+		}
+	}
+	if text != "" {
+		ret = append(ret, text)
+	}
+	return ret
+}
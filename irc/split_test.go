@@ -0,0 +1,105 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Check that each of `parts` will fit once the server adds a prefix of
+// length prefixLen.
+func checkFits(t *testing.T, parts []*Message, prefixLen int) {
+	for _, part := range parts {
+		if n := part.Len() + 1 + prefixLen + 1; n > MaxMessageLen {
+			t.Errorf("Message %q would be %d bytes long once relayed.", part, n)
+		}
+	}
+}
+
+func TestSplitShort(t *testing.T) {
+	msg := &Message{Command: "PRIVMSG", Params: []string{"#chan", "hello"}}
+	parts := SplitMessage(msg, 100)
+	if len(parts) != 1 || parts[0] != msg {
+		t.Fatalf("Short message was split: %q", parts)
+	}
+	join := &Message{Command: "JOIN", Params: []string{strings.Repeat("x", 500)}}
+	if parts := SplitMessage(join, 100); len(parts) != 1 || parts[0] != join {
+		t.Fatalf("Non-PRIVMSG was split: %q", parts)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	text := strings.Repeat("word ", 100)
+	msg := &Message{Command: "PRIVMSG", Params: []string{"#chan", text}}
+	parts := SplitMessage(msg, 60)
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts but got %d.", len(parts))
+	}
+	checkFits(t, parts, 60)
+	texts := []string{}
+	for _, part := range parts {
+		if strings.HasPrefix(part.Params[1], " ") || !strings.HasPrefix(part.Params[1], "word") {
+			t.Errorf("Part %q wasn't split at a word boundary.", part.Params[1])
+		}
+		texts = append(texts, part.Params[1])
+	}
+	if strings.Join(texts, " ") != text {
+		t.Fatalf("Parts don't add up to the original text.")
+	}
+}
+
+// Without spaces, we have to split mid-word, but must still respect UTF-8
+// sequences and formatting codes.
+func TestSplitNoSpaces(t *testing.T) {
+	cases := []struct {
+		unit string
+
+		// Offsets within unit at which it's OK to split.
+		splitOK []int
+	}{
+		{"é", []int{0}},
+		{"日本", []int{0, 3}},
+		{"\x0304,12x", []int{0, 6}},
+		{"\x04ff0000,00ff00y", []int{0, 14}},
+	}
+	for _, c := range cases {
+		text := strings.Repeat(c.unit, 1000/len(c.unit))
+		msg := &Message{Command: "NOTICE", Params: []string{"bob", text}}
+		parts := SplitMessage(msg, 70)
+		checkFits(t, parts, 70)
+		joined := ""
+		for _, part := range parts {
+			offset := len(joined) % len(c.unit)
+			ok := false
+			for _, n := range c.splitOK {
+				ok = ok || offset == n
+			}
+			if !ok {
+				t.Fatalf("Split %q at offset %d.", c.unit, offset)
+			}
+			if !utf8.ValidString(part.Params[1]) {
+				t.Fatalf("Part %q is not valid UTF-8.", part.Params[1])
+			}
+			joined += part.Params[1]
+		}
+		if joined != text {
+			t.Fatalf("Parts don't add up to the original text.")
+		}
+	}
+}
+
+func TestSplitAction(t *testing.T) {
+	text := "\x01ACTION " + strings.Repeat("waves ", 100) + "\x01"
+	msg := &Message{Command: "PRIVMSG", Params: []string{"#chan", text}}
+	parts := SplitMessage(msg, 60)
+	if len(parts) < 2 {
+		t.Fatalf("Expected the action to be split.")
+	}
+	checkFits(t, parts, 60)
+	for _, part := range parts {
+		chunk := part.Params[1]
+		if !strings.HasPrefix(chunk, "\x01ACTION waves") || !strings.HasSuffix(chunk, "\x01") {
+			t.Errorf("Part %q is not a well-formed ACTION.", chunk)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package irc
+
+// This file defines Stream, which turns a Reader into a channel of messages.
+
+import (
+	"golang.org/x/net/context"
+)
+
+// A Stream reads messages from a Reader in a separate goroutine, delivering
+// them on a channel, and records why it stopped.
+type Stream struct {
+	// The messages read. This is closed when the stream ends, after which
+	// Err reports why.
+	C <-chan *Message
+
+	done chan struct{}
+	err  error
+}
+
+// NewStream starts reading messages from `r`. The stream ends when `r`
+// returns an error, or when `ctx` is done.
+//
+// Cancelling `ctx` means nobody need receive the remaining messages for the
+// goroutine to exit, but it can't interrupt a ReadMessage that is already
+// blocked; to end the stream promptly, also close the underlying connection
+// (or use a read deadline; see Options).
+func NewStream(ctx context.Context, r Reader) *Stream {
+	ch := make(chan *Message)
+	s := &Stream{C: ch, done: make(chan struct{})}
+	go func() {
+		defer close(ch)
+		defer close(s.done)
+		for {
+			msg, err := r.ReadMessage()
+			if err == nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				s.err = err
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Err returns the error that ended the stream, or nil if it hasn't ended.
+// This is io.EOF if the peer closed the connection cleanly, the context's
+// error if it was cancelled, and otherwise whatever the Reader returned:
+// e.g. ErrMessageTooLong, a *ParseError, or a network or TLS error.
+func (s *Stream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
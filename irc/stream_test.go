@@ -0,0 +1,80 @@
+package irc
+
+import (
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Receive everything from the stream, and return the number of messages.
+func drain(s *Stream) int {
+	n := 0
+	for range s.C {
+		n++
+	}
+	return n
+}
+
+func TestStreamEOF(t *testing.T) {
+	s := NewStream(context.Background(), NewReader(strings.NewReader("PING a\r\nPING b\r\n")))
+	if s.Err() != nil {
+		t.Errorf("Err() should be nil before the stream ends, but is %v.", s.Err())
+	}
+	if n := drain(s); n != 2 {
+		t.Errorf("Expected 2 messages, but got %d.", n)
+	}
+	if s.Err() != io.EOF {
+		t.Errorf("Expected io.EOF, but got %v.", s.Err())
+	}
+}
+
+func TestStreamTooLong(t *testing.T) {
+	line := "PING :" + strings.Repeat("x", MaxTagsLen+MaxMessageLen) + "\r\n"
+	s := NewStream(context.Background(), NewReader(strings.NewReader(line)))
+	drain(s)
+	if s.Err() != ErrMessageTooLong {
+		t.Errorf("Expected ErrMessageTooLong, but got %v.", s.Err())
+	}
+}
+
+// Cancelling the context should end the stream even if nobody receives the
+// pending message.
+func TestStreamCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewStream(ctx, NewReader(strings.NewReader("PING a\r\n")))
+	// Give the goroutine a chance to block on sending the message:
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("Stream did not end after cancellation.")
+	}
+	if s.Err() != context.Canceled {
+		t.Errorf("Expected context.Canceled, but got %v.", s.Err())
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	opts := Options{ReadTimeout: 10 * time.Millisecond, WriteTimeout: 10 * time.Millisecond}
+	rw := NewReadWriterOptions(a, opts)
+
+	// Nobody is writing to b, so this should time out:
+	s := NewStream(context.Background(), rw)
+	drain(s)
+	if netErr, ok := s.Err().(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout reading, but got %v.", s.Err())
+	}
+
+	// ...and nobody is reading from b either:
+	err := rw.WriteMessage(&Message{Command: "PING", Params: []string{"a"}})
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout writing, but got %v.", err)
+	}
+}
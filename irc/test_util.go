@@ -12,8 +12,9 @@ import (
 //
 // The returned messages aren't entirely valid; they follow rules
 // about presence/absence of prefixes and commands, message length,
-// and number of arguments, but the values of prefixes, arguments, and
-// commands are just random strings. This may be refined in the future.
+// and number of arguments, and commands are made of letters, but the values
+// of prefixes and arguments are just random strings. This may be refined in
+// the future.
 func (msg *Message) Generate(r *rand.Rand, size int) reflect.Value {
 	return reflect.ValueOf(genMessage(r))
 }
@@ -46,13 +47,65 @@ func genMessage(r *rand.Rand) *Message {
 		spaceLeft -= paramLen
 	}
 
+	if len(params) != 0 {
+		// Exercise the cases where the last parameter needs a ':' in
+		// front of it. Replacing characters keeps the length the same.
+		last := []byte(params[len(params)-1])
+		switch r.Intn(4) {
+		case 0:
+			last[0] = ':'
+		case 1:
+			last[r.Intn(len(last))] = ' '
+		case 2:
+			last = last[:0]
+		}
+		params[len(params)-1] = string(last)
+	}
+
 	return &Message{
+		Tags:    genTags(r),
 		Prefix:  genBase64(prefixLen, r),
-		Command: genBase64(commandLen, r),
+		Command: genCommand(commandLen, r),
 		Params:  params,
 	}
 }
 
+// Characters used for generating tag values. We make sure to include
+// everything that needs escaping.
+const tagValueChars = "abcXYZ019-=/+; \\\r\n"
+
+// generate a random set of message tags. Tags don't count against
+// MaxMessageLen, so we don't need to worry about our budget.
+func genTags(r *rand.Rand) map[string]string {
+	numTags := int(r.Float64() * 4)
+	if numTags == 0 {
+		return nil
+	}
+	tags := make(map[string]string, numTags)
+	for i := 0; i < numTags; i++ {
+		key := fmt.Sprintf("k%d", r.Intn(1000))
+		if r.Intn(2) == 0 {
+			key = "+example.com/" + key
+		}
+		value := &bytes.Buffer{}
+		for j := int(r.Float64() * 16); j > 0; j-- {
+			value.WriteByte(tagValueChars[r.Intn(len(tagValueChars))])
+		}
+		tags[key] = value.String()
+	}
+	return tags
+}
+
+// generate a random command (a string of letters) of the given length.
+func genCommand(length int, r *rand.Rand) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	buf := make([]byte, length)
+	for i := range buf {
+		buf[i] = letters[r.Intn(len(letters))]
+	}
+	return string(buf)
+}
+
 // generate a random base64 string of the given length.
 func genBase64(length int, r *rand.Rand) string {
 	buf := &bytes.Buffer{}
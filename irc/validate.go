@@ -15,53 +15,75 @@ func (me *MessageError) String() string {
 	return m.String()
 }
 
-var minParams = map[string]int{
-	"PASS":         1,
-	"PRIVMSG":      2,
-	"NOTICE":       2,
-	"JOIN":         1,
-	"NICK":         1,
-	"USER":         4,
-	RPL_WELCOME:    2,
-	RPL_YOURHOST:   2,
-	RPL_CREATED:    2,
-	RPL_MYINFO:     5,
-	RPL_TOPIC:      3,
-	RPL_NAMEREPLY:  4,
-	RPL_ENDOFNAMES: 3,
+// Return an ERR_NEEDMOREPARAMS error for `command`, addressed to `target`.
+func errNeedMoreParams(target, command string) *MessageError {
+	return &MessageError{
+		Command: ERR_NEEDMOREPARAMS,
+		Params:  []string{target, command, "Not enough parameters"},
+	}
+}
+
+// Return an ERR_UNKNOWNCOMMAND error for `command`, addressed to `target`.
+func errUnknownCommand(target, command, text string) *MessageError {
+	return &MessageError{
+		Command: ERR_UNKNOWNCOMMAND,
+		Params:  []string{target, command, text},
+	}
+}
+
+// Validate the message m. This is equivalent to m.ValidateFor("*"); see the
+// documentation for ValidateFor.
+func (m *Message) Validate() *MessageError {
+	return m.ValidateFor("*")
 }
 
 // Validate the message m. This performs various checks:
 //
-// * A command is supplied
-// * Minimum number of arguments for the command are supplied, if the command
-//   is known.
+// * A valid command is supplied
 // * The number of parameters does not exceed the limit imposed by the rfc (15).
+// * No parameter contains CR, LF or NUL, and no parameter but the last is
+//   empty, starts with ':' or contains a space (see CheckWritable).
+// * If the command is known (see LookupSchema), the number of parameters is
+//   within the bounds given by its schema, and any channel, nick or
+//   target parameters are non-empty.
 //
 // Returns nil for a valid message. For an invalid message, return a suitable
-// reply error message.
+// reply error message, addressed to `target` (the nick of the client we'd
+// send it to, or "*" if it doesn't have one yet).
 //
 // Note that this method does not check for errors that cannot occur in a message
 // read off the wire, e.g. Params being nil (as opposed to []string{}).
-func (m *Message) Validate() *MessageError {
-	switch {
-	case m.Command == "":
-		return &MessageError{
-			Command: ERR_UNKNOWNCOMMAND,
-			Params:  []string{"Unknown command: \"\""},
-		}
-	case len(m.Params) > 15:
+func (m *Message) ValidateFor(target string) *MessageError {
+	if m.Command == "" {
+		return errUnknownCommand(target, "", "Unknown command")
+	}
+	if !isValidCommand(m.Command) {
+		// Don't echo the command back; it's no more fit to send than
+		// to receive.
+		return errUnknownCommand(target, "*", "Invalid command")
+	}
+	if len(m.Params) > 15 {
 		// XXX: ERR_UNKNOWNCOMMAND isn't really a good fit for this, but the RFC
 		// doesn't seem to define someting obviously better.
-		return &MessageError{
-			Command: ERR_UNKNOWNCOMMAND,
-			Params:  []string{"Too many parameters (max 15)"},
+		return errUnknownCommand(target, m.Command, "Too many parameters (max 15)")
+	}
+	if schema, ok := LookupSchema(m.Command); ok {
+		if len(m.Params) < schema.MinParams {
+			return errNeedMoreParams(target, m.Command)
+		}
+		if schema.MaxParams != 0 && len(m.Params) > schema.MaxParams {
+			return errUnknownCommand(target, m.Command, "Too many parameters")
 		}
-	case len(m.Params) < minParams[m.Command]:
-		return &MessageError{
-			Command: ERR_NEEDMOREPARAMS,
-			Params:  []string{"Not enough parameters"},
+		for i, param := range m.Params {
+			if param == "" && schema.Kind(i) != ParamText {
+				// An empty name is as good as a missing one:
+				return errNeedMoreParams(target, m.Command)
+			}
 		}
 	}
+	if reason := m.checkSyntax(); reason != "" {
+		// XXX: as above, ERR_UNKNOWNCOMMAND isn't a great fit.
+		return errUnknownCommand(target, m.Command, "Invalid message: "+reason)
+	}
 	return nil
 }
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// While the client is away, we should answer CTCP queries ourselves (within
+// reason), and let the client know who asked once it's back.
+func TestCTCPAutoReply(t *testing.T) {
+	query := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "\x01VERSION\x01"},
+	}
+	badQuery := &irc.Message{
+		Prefix:  "bob@example.com@example.net",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "\x01VERSION\x01"},
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		Disconnect(Client),
+		FromServer(query),
+		ToServer(&irc.Message{
+			Command: "NOTICE",
+			Params:  []string{"bob", "\x01VERSION IRC Idler\x01"},
+		}),
+		// Too soon after the last one; shouldn't be answered:
+		FromServer(query),
+		// We can't answer a query from a prefix we can't parse, so it
+		// should be logged like anything else:
+		FromServer(badQuery),
+		reconnect("alice"),
+		ToClient(&irc.Message{
+			Prefix:  idlerPrefix,
+			Command: "NOTICE",
+			Params: []string{
+				"alice",
+				replayedText("Answered CTCP VERSION from bob!bob@example.com while you were away."),
+			},
+		}),
+		ToClient(&irc.Message{
+			Prefix:  idlerPrefix,
+			Command: "NOTICE",
+			Params: []string{
+				"alice",
+				replayedText("CTCP VERSION from bob!bob@example.com (not answered: rate limited)"),
+			},
+		}),
+		ToClient(badQuery),
+	})
+}
+
+// With CTCP replies disabled, queries are logged like anything else.
+func TestCTCPAutoReplyDisabled(t *testing.T) {
+	query := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "\x01PING 1234\x01"},
+	}
+	TraceTestConfig(t, &Config{DisableCTCPReplies: true}, ExpectMany{
+		initialConnect("alice"),
+		Disconnect(Client),
+		FromServer(query),
+		reconnect("alice"),
+		ToClient(query),
+	})
+}
@@ -0,0 +1,146 @@
+package proxy
+
+// End-to-end tests, with real clients talking to a real (if small) server
+// through the proxy.
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net"
+	"testing"
+	"zenhack.net/go/irc-idler/internal/testserver"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/storage/ephemeral"
+)
+
+// A proxy in front of a testserver.Server.
+type e2eProxy struct {
+	t           *testing.T
+	server      *testserver.Server
+	proxy       *Proxy
+	clientConns chan irc.ReadWriteCloser
+
+	// Every client we've connected, so we can close them when we're
+	// done.
+	clients []*testserver.Client
+}
+
+func startE2E(t *testing.T) *e2eProxy {
+	logger := logrus.New()
+	logger.Level = logrus.DebugLevel
+	p := &e2eProxy{
+		t:           t,
+		server:      testserver.New(),
+		clientConns: make(chan irc.ReadWriteCloser),
+	}
+	p.proxy = NewProxy(logger, ephemeral.NewStore(), p.clientConns, p.server, nil)
+	go p.proxy.Run()
+	return p
+}
+
+func (p *e2eProxy) stop() {
+	// The proxy may be blocked writing to a client that the test is no
+	// longer reading from, so close those first:
+	for _, c := range p.clients {
+		c.Close()
+	}
+	p.proxy.Stop()
+	p.server.Close()
+}
+
+// Connect a client to the proxy.
+func (p *e2eProxy) connect() *testserver.Client {
+	clientEnd, proxyEnd := net.Pipe()
+	p.clientConns <- irc.NewReadWriteCloser(proxyEnd)
+	return p.newClient(irc.NewReadWriteCloser(clientEnd))
+}
+
+// Connect a client directly to the server, bypassing the proxy.
+func (p *e2eProxy) connectDirect() *testserver.Client {
+	conn, err := p.server.Connect()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return p.newClient(conn)
+}
+
+func (p *e2eProxy) newClient(conn irc.ReadWriteCloser) *testserver.Client {
+	c := testserver.NewClient(p.t, conn)
+	p.clients = append(p.clients, c)
+	return c
+}
+
+// Messages sent while the client is away should be replayed when it comes
+// back, and the proxy should keep it in its channels meanwhile.
+func TestE2EReplay(t *testing.T) {
+	p := startE2E(t)
+	defer p.stop()
+
+	alice := p.connect()
+	alice.Register("alice")
+	alice.Send("JOIN #chan")
+	alice.Expect("JOIN")
+	alice.SkipTo(irc.RPL_ENDOFNAMES)
+
+	bob := p.connectDirect()
+	bob.Register("bob")
+	bob.Send("JOIN #chan")
+	bob.SkipTo(irc.RPL_ENDOFNAMES)
+	if msg := alice.Expect("JOIN"); msg.Prefix != "bob!bob@localhost" {
+		t.Fatalf("Unexpected JOIN: %q", msg)
+	}
+
+	bob.Send("PRIVMSG #chan :hello")
+	if msg := alice.Expect("PRIVMSG"); msg.Params[1] != "hello" {
+		t.Fatalf("Unexpected message: %q", msg)
+	}
+
+	alice.Close()
+	bob.Send("PRIVMSG #chan :are you there?")
+	bob.Send("PRIVMSG alice :psst")
+
+	// The proxy should have stayed in the channel for alice:
+	bob.Send("NAMES #chan")
+	if msg := bob.Expect(irc.RPL_NAMEREPLY); msg.Params[3] != "@alice bob" && msg.Params[3] != "bob @alice" {
+		t.Fatalf("Unexpected names: %q", msg)
+	}
+	bob.Expect(irc.RPL_ENDOFNAMES)
+
+	// Private messages are replayed right away, and those from channels
+	// when the client rejoins them:
+	alice = p.connect()
+	alice.Register("alice")
+	if msg := alice.SkipTo("PRIVMSG"); msg.Params[1] != replayedText("psst") {
+		t.Fatalf("Expected the private message to be replayed, but got %q.", msg)
+	}
+	alice.Send("JOIN #chan")
+	alice.Expect("JOIN")
+	alice.SkipTo(irc.RPL_ENDOFNAMES)
+	if msg := alice.Expect("PRIVMSG"); msg.Params[1] != replayedText("are you there?") {
+		t.Fatalf("Expected the channel message to be replayed, but got %q.", msg)
+	}
+
+	// And everything should still work:
+	alice.Send("PRIVMSG #chan :sorry, I was out")
+	if msg := bob.Expect("PRIVMSG"); msg.Prefix != "alice!alice@localhost" {
+		t.Fatalf("Unexpected message: %q", msg)
+	}
+}
+
+// A nick that's already taken should be reported to the client, which can
+// then pick another.
+func TestE2ENickInUse(t *testing.T) {
+	p := startE2E(t)
+	defer p.stop()
+
+	bob := p.connectDirect()
+	bob.Register("alice")
+
+	alice := p.connect()
+	alice.Send("NICK alice")
+	alice.Send("USER alice 0 * :Alice")
+	alice.Expect(irc.ERR_NICKNAMEINUSE)
+	alice.Send("NICK alice_")
+	if msg := alice.Expect(irc.RPL_WELCOME); msg.Params[0] != "alice_" {
+		t.Fatalf("Unexpected welcome: %q", msg)
+	}
+}
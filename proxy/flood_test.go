@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/filters"
+)
+
+// When the client sends more than the server will accept at once, we should
+// hold the excess back, but still answer the server's PINGs promptly.
+func TestFloodControl(t *testing.T) {
+	paste := func(i int) *irc.Message {
+		return &irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"#chan", strings.Repeat("x", 60) + strconv.Itoa(i)},
+		}
+	}
+	TraceTestConfig(t, &Config{
+		// Enough for the handshake and one line, but at this rate the
+		// next won't be sent for several seconds.
+		FloodControl: &filters.FloodControl{Burst: 200, Rate: 10},
+	}, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(paste(0)),
+		FromClient(paste(1)),
+		FromClient(paste(2)),
+		FromServer(&irc.Message{Command: "PING", Params: []string{"123"}}),
+		ToServer(&irc.Message{Command: "PONG", Params: []string{"123"}}),
+	})
+}
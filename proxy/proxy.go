@@ -3,14 +3,24 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"zenhack.net/go/irc-idler/internal/netextra"
 	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/charset"
+	"zenhack.net/go/irc-idler/irc/ctcp"
+	"zenhack.net/go/irc-idler/irc/filters"
+	"zenhack.net/go/irc-idler/irc/mask"
+	"zenhack.net/go/irc-idler/irc/sasl"
 	"zenhack.net/go/irc-idler/proxy/state"
 	"zenhack.net/go/irc-idler/storage"
 )
@@ -23,12 +33,110 @@ var (
 	// testing; a reasonable ping time for production is a long time to
 	// wait during a test.
 	pingTime = 30 * time.Second
+
+	// Minimum interval between automatic CTCP replies, so that someone
+	// flooding us with queries can't get us disconnected for flooding the
+	// server in turn. A var for the same reason as pingTime.
+	ctcpReplyInterval = 2 * time.Second
+
+	// How long we wait for a message to be sent before giving up on the
+	// connection. Since we handle both connections from one goroutine, a
+	// peer that stops reading would otherwise stall everything.
+	writeTimeout = 30 * time.Second
+
+	// How long we keep a netsplit or netjoin batch open for more QUITs or
+	// JOINs; see batchNetsplit. Clients may hold back the messages in a
+	// batch until it is closed, so this should be short.
+	splitBatchTime = 500 * time.Millisecond
+
+	// How long we remember a user lost in a netsplit, so that their
+	// return can go in a netjoin batch. Past this, a JOIN is just a JOIN.
+	splitUserTime = time.Hour
+
+	// Returns the current time, for the timestamps we record. A var so
+	// that tests can fix it.
+	now = time.Now
 )
 
 var (
 	errConnectionClosed = errors.New("Connection Closed")
 )
 
+// Capabilities we request from the server, if available.
+//
+// Note that we must be able to cope with any changes these make to the
+// messages the server sends; clients will not have negotiated them.
+var wantedCaps = []string{
+	"server-time",
+
+	// The server's batches are passed through to clients which support
+	// them; the batch tags are stripped for those which don't (see
+	// tagsForClient).
+	"batch",
+
+	// Lets clients which have negotiated message-tags with us exchange
+	// client-only tags and TAGMSGs with the server; see sendServer and
+	// tagsForClient.
+	"message-tags",
+
+	// These let us track all of a user's channel privileges, and their
+	// full client ID; see namReplyForClient.
+	"multi-prefix",
+	"userhost-in-names",
+}
+
+// Capabilities we offer to clients. We implement these ourselves, whatever
+// the server supports.
+var clientCaps = []string{
+	"batch",
+	"draft/chathistory",
+	"echo-message",
+	"message-tags",
+	"multi-prefix",
+	"server-time",
+	"userhost-in-names",
+	"znc.in/playback",
+}
+
+// Tags which clients may see without message-tags, if they have enabled the
+// capabilities they belong to.
+var capTags = map[string]string{
+	"batch": "batch",
+	"time":  "server-time",
+}
+
+// CTCP queries we answer on the user's behalf while no client is attached.
+var ctcpAutoReplies = []string{"CLIENTINFO", "PING", "TIME", "VERSION"}
+
+// Our reply to CTCP VERSION.
+const ctcpVersion = "IRC Idler"
+
+// Upper bounds on the length of the user and host parts of our prefix, as
+// used by maxPrefixLen. Usernames are usually limited to 9 or 10 characters
+// (plus a '~' if ident isn't available), and hostnames to 63.
+const (
+	maxUserLen = 11
+	maxHostLen = 63
+)
+
+// The most messages we send in reply to a CHATHISTORY command, whatever the
+// client asks for.
+const maxChatHistory = 100
+
+// The most messages we play back from each buffer for *playback's PLAY; see
+// handlePlayback.
+const maxPlayback = 1000
+
+// The prefix of replies from the emulated *playback module.
+const playbackPrefix = "*playback"
+
+// DefaultReplayTimeFormat is the default for Config.ReplayTimeFormat.
+const DefaultReplayTimeFormat = "[15:04]"
+
+// The prefix for notices we generate ourselves, rather than relaying from the
+// server. The '*' keeps it from colliding with any real nick.
+const idlerPrefix = "*irc-idler"
+
 // A Connector establishes an IRC connection.
 type Connector interface {
 	Connect() (irc.ReadWriteCloser, error)
@@ -40,6 +148,10 @@ type DialerConnector struct {
 	netextra.Dialer
 	Network string
 	Addr    string
+
+	// The character encoding the server uses. If nil, text is passed
+	// through unchanged.
+	Charset charset.Charset
 }
 
 // Connect establishes a connection by invoking dc.Dialer.Dial(dc.Network, dc.Addr)
@@ -48,7 +160,36 @@ func (dc *DialerConnector) Connect() (irc.ReadWriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return irc.NewReadWriteCloser(conn), err
+	return irc.NewReadWriteCloserOptions(conn, irc.Options{
+		Charset:      dc.Charset,
+		WriteTimeout: writeTimeout,
+	}), err
+}
+
+// Config holds optional settings for a Proxy.
+type Config struct {
+	// Credentials with which to authenticate to the server via SASL during
+	// registration. If nil, we don't use SASL.
+	SASL *sasl.Credentials
+
+	// If true, don't answer CTCP queries (VERSION, PING, etc.) while no
+	// client is attached; instead log them for the client to answer (too
+	// late) when it reconnects.
+	DisableCTCPReplies bool
+
+	// Limits on how fast we send messages to the server, so that it doesn't
+	// disconnect us for flooding when the client pastes a lot of text or
+	// we rejoin many channels. If nil, filters.DefaultFloodControl is used.
+	FloodControl *filters.FloodControl
+
+	// The layout (see time.Time.Format) of the timestamp we add to the
+	// text of messages replayed from the log, for clients which haven't
+	// enabled server-time (those see the time tag instead). If empty,
+	// DefaultReplayTimeFormat is used.
+	ReplayTimeFormat string
+
+	// If true, don't add timestamps to the text of replayed messages.
+	DisableReplayTimestamps bool
 }
 
 // A Proxy is a daemon implementing the core IRC Idler proxying functionality.
@@ -61,6 +202,31 @@ type Proxy struct {
 	serverConnector Connector
 	err             error
 
+	config Config
+
+	// State of an in-progress SASL exchange with the server.
+	saslMech      sasl.Mechanism
+	saslChallenge sasl.ChallengeBuffer
+
+	// When we last answered a CTCP query; see ctcpReplyInterval.
+	lastCTCPReply time.Time
+
+	// The netsplit or netjoin batch we're grouping QUITs or JOINs from the
+	// server in for the client, if any, and when to close it; see
+	// batchNetsplit. splitBatchEnd is nil if there's no batch open.
+	splitBatch    *irc.Batch
+	splitBatchEnd <-chan time.Time
+
+	// The users lost in recent netsplits, by folded nick, so that we can
+	// spot them coming back. Entries expire after splitUserTime.
+	splitUsers map[string]splitUser
+
+	// The number of batches we've opened, for generating reference tags.
+	batchCount int
+
+	// The number of msgids we've generated; see stamp.
+	msgIDCount int
+
 	// Per-channel IRC messages received while client is not in the channel.
 	messagelogs storage.Store
 
@@ -90,20 +256,16 @@ type Proxy struct {
 //
 // Note that a connection may be in a "disconnected" state.
 type connection struct {
-	irc.ReadWriteCloser
+	*filters.Pipeline
 	Chan <-chan *irc.Message
 	*state.Session
 
-	// Disconnect if we don't receive a message first. Only valid if PingSent
-	// is true.
-	DropDeadline time.Time
-
-	// Send PING if we don't receive a message first. Only valid if PingSent
-	// is false.
-	PingDeadline time.Time
+	// Registration messages from the client, held back until it has
+	// finished negotiating capabilities with us.
+	pending []*irc.Message
 
-	// True if we have sent a PING and are waiting on a response.
-	PingSent bool
+	// The reference tags of the batches which are open on the connection.
+	batches map[string]bool
 }
 
 // Return a fresh connection in the "disconnected" state.
@@ -115,14 +277,34 @@ func emptyConnection() *connection {
 
 // Returns true if and only if the connection is closed.
 func (c *connection) IsClosed() bool {
-	return c == nil || c.ReadWriteCloser == nil || c.Chan == nil
+	return c == nil || c.Pipeline == nil || c.Chan == nil
 }
 
-// Update the deadlines for sending PING messages and/or dropping the
-// connection, based on having received a message at time.Now().
-func (c *connection) updateDeadlines() {
-	c.PingDeadline = time.Now().Add(pingTime)
-	c.PingSent = false
+// Describe why the connection's pipeline ended, for logging. Only meaningful
+// once Chan has been closed.
+func (c *connection) closeReason() string {
+	err := c.Err()
+	if stageErr, ok := err.(*filters.StageError); ok {
+		err = stageErr.Err
+	}
+	if writeErr, ok := err.(*filters.WriteError); ok {
+		return "write failed: " + writeErr.Err.Error()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timed out"
+	}
+	switch err {
+	case nil:
+		return "still open"
+	case io.EOF:
+		return "closed by peer"
+	case irc.ErrMessageTooLong:
+		return "peer sent an overlong line"
+	case filters.ErrPingTimeout:
+		return "ping timeout"
+	default:
+		return err.Error()
+	}
 }
 
 // Tear down the connection. If it is not currently active, this is a noop.
@@ -131,12 +313,6 @@ func (c *connection) shutdown() {
 		return
 	}
 	c.Close()
-
-	// Make sure the message queue is empty, otherwise we'll leak the goroutine
-	for ok := true; c.Chan != nil && ok; {
-		_, ok = <-c.Chan
-	}
-
 	*c = *emptyConnection()
 }
 
@@ -148,24 +324,31 @@ func (c *connection) shutdown() {
 // `store` is the Store to use for persistent data.
 // `clientConns` is a channel on which incoming client connections are sent.
 // `serverConnector` is a `Connector` to be used to connect to the server.
+// `config`, if non-nil, supplies optional settings.
 func NewProxy(
 	logger *log.Logger,
 	store storage.Store,
 	clientConns <-chan irc.ReadWriteCloser,
-	serverConnector Connector) *Proxy {
+	serverConnector Connector,
+	config *Config) *Proxy {
 
 	if logger == nil {
 		logger = log.New()
 		logger.Out = ioutil.Discard
 	}
+	if config == nil {
+		config = &Config{}
+	}
 	return &Proxy{
 		clientConns:     clientConns,
 		serverConnector: serverConnector,
+		config:          *config,
 		client:          emptyConnection(),
 		server:          emptyConnection(),
 		logger:          logger,
 		messagelogs:     store,
 		preLogSession:   state.NewSession(),
+		splitUsers:      make(map[string]splitUser),
 		stop:            make(chan struct{}),
 	}
 }
@@ -176,15 +359,43 @@ func (p *Proxy) Stop() {
 	p.stop <- struct{}{}
 }
 
-// Set up the connection, using `conn` as the transport.
-func (c *connection) setup(conn irc.ReadWriteCloser) {
-	c.ReadWriteCloser = conn
-	c.Chan = irc.ReadAll(conn)
+// Set up the connection, using `conn` as the transport. `getFilters` returns
+// the filters for the connection's pipeline (see filters.Pipeline.Start),
+// given the pipeline itself.
+func (c *connection) setup(conn irc.ReadWriteCloser,
+	getFilters func(*filters.Pipeline) (in, out filters.Filter)) {
+
+	c.Pipeline = filters.NewPipeline(conn)
+	c.Pipeline.Start(getFilters(c.Pipeline))
+	c.Chan = c.Pipeline.C
 	c.Session = state.NewSession()
-	c.updateDeadlines()
+	c.batches = make(map[string]bool)
+}
+
+// Note the opening or closing of a batch, if `msg` does either, having sent
+// it over the connection.
+func (c *connection) trackBatch(msg *irc.Message) {
+	if msg.Command != "BATCH" {
+		return
+	}
+	if batch, start, err := irc.ParseBatch(msg); err == nil {
+		if start {
+			c.batches[batch.Ref] = true
+		} else {
+			delete(c.batches, batch.Ref)
+		}
+	}
 }
 
+// The longest line (see irc.Options.MaxLineLen) we'll send to a client. Text
+// from a server using a single-byte charset may take up to three times as
+// many bytes once converted to UTF-8; clients generally cope with such lines,
+// and splitting messages from others isn't ours to do.
+const ClientMaxLineLen = 3 * irc.MaxMessageLen
+
 // AcceptLoop accepts connections from `l`, and sends them on `acceptChan`.
+// Clients are assumed to speak UTF-8; anything else is replaced with U+FFFD,
+// so that we never store or replay invalid text.
 func AcceptLoop(l net.Listener, acceptChan chan<- irc.ReadWriteCloser, logger *log.Logger) {
 	for {
 		conn, err := l.Accept()
@@ -193,19 +404,34 @@ func AcceptLoop(l net.Listener, acceptChan chan<- irc.ReadWriteCloser, logger *l
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		acceptChan <- irc.NewReadWriteCloser(conn)
+		acceptChan <- irc.NewReadWriteCloserOptions(conn, irc.Options{
+			Charset:      charset.UTF8,
+			WriteTimeout: writeTimeout,
+			MaxLineLen:   ClientMaxLineLen,
+		})
 		logger.Debugln("AcceptLoop(): Sent connection.")
 	}
 }
 
-// Send a message to the server. On failure, call p.reset()
+// Send a message to the server. On failure, call p.reset(), unless the message
+// itself was unwritable (see unwritable), in which case it is just skipped.
 func (p *Proxy) sendServer(msg *irc.Message) error {
 	p.logger.Debugf("sendServer(): sending message: %q\n", msg)
-	if p.server.ReadWriteCloser == nil {
+	if p.server.Pipeline == nil {
 		return errConnectionClosed
 	}
+	if len(msg.Tags) != 0 && !p.server.Session.Caps.Enabled.Has("message-tags") {
+		// The client may have sent tags, having negotiated
+		// message-tags with us, but the server hasn't with us.
+		untagged := *msg
+		untagged.Tags = nil
+		msg = &untagged
+	}
 	err := p.server.WriteMessage(msg)
-	if err != nil {
+	if unwritable(err) {
+		// Nothing was sent, so the connection is still fine.
+		p.logger.Warnf("sendServer(): not sending message: %v.\n", err)
+	} else if err != nil {
 		p.logger.Errorf("sendServer(): error: %v.\n", err)
 		p.reset()
 	} else {
@@ -214,17 +440,31 @@ func (p *Proxy) sendServer(msg *irc.Message) error {
 	return err
 }
 
-// Send a message to the client. On failure, call p.dropClient()
+// Returns true if `err` indicates that a message was refused by WriteMessage
+// because it couldn't be serialized, in which case nothing was written.
+func unwritable(err error) bool {
+	if _, ok := err.(*irc.InvalidMessageError); ok {
+		return true
+	}
+	return err == irc.ErrMessageTooLong
+}
+
+// Send a message to the client. On failure, call p.dropClient(), unless the message
+// itself was unwritable (see unwritable), in which case it is just skipped.
 func (p *Proxy) sendClient(msg *irc.Message) error {
 	p.logger.Debugf("sendClient(): sending message: %q\n", msg)
-	if p.client.ReadWriteCloser == nil {
+	if p.client.Pipeline == nil {
 		return errConnectionClosed
 	}
+	msg = p.tagsForClient(msg)
 	err := p.client.WriteMessage(msg)
-	if err != nil {
+	if unwritable(err) {
+		p.logger.Warnf("sendClient(): not sending message: %v.\n", err)
+	} else if err != nil {
 		p.logger.Errorf("sendClient(): error: %v.\n", err)
 		p.dropClient()
 	} else {
+		p.client.trackBatch(msg)
 		p.client.UpdateFromServer(msg)
 
 		// FIXME: We clear the log only when everything is finsihed,
@@ -235,11 +475,39 @@ func (p *Proxy) sendClient(msg *irc.Message) error {
 	return err
 }
 
+// Return `msg`, without any tags the client hasn't negotiated, or a batch
+// tag for a batch the client hasn't seen opened (e.g. because it connected
+// part way through).
+func (p *Proxy) tagsForClient(msg *irc.Message) *irc.Message {
+	enabled := p.client.Session.Caps.Enabled
+	ref, inBatch := msg.BatchRef()
+	strayBatch := inBatch && !p.client.batches[ref]
+	if len(msg.Tags) == 0 || (enabled.Has("message-tags") && !strayBatch) {
+		return msg
+	}
+	tags := make(map[string]string)
+	for name, value := range msg.Tags {
+		if name == "batch" && strayBatch {
+			continue
+		}
+		if capName, ok := capTags[name]; enabled.Has("message-tags") || (ok && enabled.Has(capName)) {
+			tags[name] = value
+		}
+	}
+	if len(tags) == len(msg.Tags) {
+		return msg
+	}
+	filtered := *msg
+	filtered.Tags = nil
+	if len(tags) != 0 {
+		filtered.Tags = tags
+	}
+	return &filtered
+}
+
 // Run the proxy daemon. Returns when the daemon shuts down.
 func (p *Proxy) Run() {
 	p.logger.Infoln("Proxy starting up")
-	ticker := time.NewTicker(pingTime)
-	defer ticker.Stop()
 	for {
 		p.logger.Debugln("Run(): Top of loop")
 		select {
@@ -247,29 +515,20 @@ func (p *Proxy) Run() {
 			p.logger.Infoln("Proxy shutting down")
 			p.reset()
 			return
+		case <-p.splitBatchEnd:
+			p.endSplitBatch()
 		case msg, ok := <-p.client.Chan:
 			p.logger.Debugln("Run(): Got client event")
-			p.client.updateDeadlines()
 			p.handleClientEvent(msg, ok)
 		case msg, ok := <-p.server.Chan:
 			p.logger.Debugln("Run(): Got server event")
-			p.server.updateDeadlines()
 			p.handleServerEvent(msg, ok)
-		case <-ticker.C:
-			p.checkTimeout(
-				p.client,
-				func() { p.dropClient() },
-				func(msg *irc.Message) { p.sendClient(msg) })
-			p.checkTimeout(
-				p.server,
-				func() { p.reset() },
-				func(msg *irc.Message) { p.sendServer(msg) })
 		case clientConn := <-p.clientConns:
 			p.logger.Debugln("Run(): Got client connection")
 			// A client connected. We boot the old one, if any:
 			p.dropClient()
 
-			p.client.setup(clientConn)
+			p.client.setup(clientConn, p.clientFilters)
 
 			if p.server.IsClosed() {
 				p.logger.Debugln("Connecting to server...")
@@ -281,42 +540,78 @@ func (p *Proxy) Run() {
 					p.dropClient()
 				} else {
 					p.logger.Debugln("Established connection to server")
-					p.server.setup(serverConn)
+					p.server.setup(serverConn, p.serverFilters)
+					p.saslMech = nil
+					p.startCapNegotiation()
 				}
 			}
 		}
 	}
 }
 
-// Send PINGs or drop the connection due to timeout, if needed.
+// Returns the filters for messages received from and sent to the client via
+// `pipeline`.
 //
-// `conn` is the connection to query.
-// `drop` is the function to call if the connection should be dropped.
-// `send` is the function to call if a PING message needs to be sent.
-func (p *Proxy) checkTimeout(conn *connection, drop func(), send func(msg *irc.Message)) {
-	if conn.IsClosed() {
-		return
-	}
-	now := time.Now()
-	if conn.PingSent && now.After(conn.DropDeadline) {
-		p.logger.Infoln("PING timeout; dropping connection.")
-		drop()
-	} else if !conn.PingSent && now.After(conn.PingDeadline) {
-		send(&irc.Message{Command: "PING", Params: []string{"irc-idler"}})
-		conn.PingSent = true
-		conn.DropDeadline = now.Add(pingTime)
+// The keepalive answers the client's PINGs and drops it if it stops
+// answering ours, so the proxy proper never sees PINGs or PONGs. There is no
+// outgoing filter, so that sendClient finds out right away if the client has
+// gone, and can log the message instead.
+func (p *Proxy) clientFilters(pipeline *filters.Pipeline) (in, out filters.Filter) {
+	in = filters.Chain(
+		p.logReceived("client"),
+		filters.Keepalive(pingTime, "irc-idler", pipeline),
+	)
+	return in, nil
+}
+
+// Returns the filters for messages received from and sent to the server via
+// `pipeline`.
+//
+// Like the client's, but we also limit how fast we send, so the server
+// doesn't drop us for flooding. Throttle lets the keepalive's PONGs jump the
+// queue.
+func (p *Proxy) serverFilters(pipeline *filters.Pipeline) (in, out filters.Filter) {
+	flood := filters.DefaultFloodControl
+	if p.config.FloodControl != nil {
+		flood = *p.config.FloodControl
 	}
+	in = filters.Chain(
+		p.logReceived("server"),
+		filters.Keepalive(pingTime, "irc-idler", pipeline),
+	)
+	return in, filters.Throttle(flood)
+}
+
+// Returns a filter which logs each message received from `peer`, for
+// debugging.
+func (p *Proxy) logReceived(peer string) filters.Filter {
+	return filters.Tap(func(msg *irc.Message) {
+		p.logger.Debugf("Received from %s: %q\n", peer, msg)
+	})
 }
 
 // Handle a message sent by the client during a handshake.
 func (p *Proxy) handleHandshakeMessage(msg *irc.Message) {
 	switch msg.Command {
+	case "CAP":
+		p.handleClientCap(msg)
+		if !p.client.Handshake.NegotiatingCaps() {
+			p.flushRegistration()
+		}
 	case "PASS", "USER", "NICK":
 		// XXX: The client should only be sending a PASS before NICK
 		// and USER. we're not checking this, and just forwarding to the
 		// server. Might be nice to do a bit more validation ourselves.
 
 		if !p.server.Handshake.Done() {
+			if p.client.Handshake.NegotiatingCaps() {
+				// If we passed this on now, the server could
+				// welcome the client before it's done
+				// negotiating with us.
+				p.client.pending = append(p.client.pending, msg)
+				return
+			}
+
 			// Client and server agree on the handshake state, so just pass
 			// the message through:
 			p.sendServer(msg)
@@ -330,66 +625,323 @@ func (p *Proxy) handleHandshakeMessage(msg *irc.Message) {
 			// In both cases we can just return.
 			return
 		}
+	default:
+		return
+	}
 
-		// XXX: we ought to do at least a little sanity checking here. e.g.
-		// what if the client sends a nick other than what we have on file?
+	// XXX: we ought to do at least a little sanity checking here. e.g.
+	// what if the client sends a nick other than what we have on file?
 
-		if p.server.Handshake.Done() && p.client.Handshake.WantsWelcome() {
-			// Server already thinks we're done; it won't send the welcome sequence,
-			// so we need to do it ourselves.
+	if p.server.Handshake.Done() && p.client.Handshake.WantsWelcome() {
+		// Server already thinks we're done; it won't send the welcome sequence,
+		// so we need to do it ourselves.
+		p.sendWelcome()
+	}
+}
 
-			if !p.haveMsgCache {
-				// We don't have a cached welcome message to send! This is probably
-				// a bug. TODO: We should report it to the user in a more
-				// comprehensible way.
-				p.logger.Errorln("no message cache on client reconnect!")
-				p.reset()
-				return
-			}
+// Send the welcome sequence to a client whose handshake has finished, in the
+// case where the server considers us already logged in.
+func (p *Proxy) sendWelcome() {
+	if !p.haveMsgCache {
+		// We don't have a cached welcome message to send! This is probably
+		// a bug. TODO: We should report it to the user in a more
+		// comprehensible way.
+		p.logger.Errorln("no message cache on client reconnect!")
+		p.reset()
+		return
+	}
 
-			nick := p.server.Session.ClientID.Nick
-			messages := []*irc.Message{
-				{
-					Prefix:  p.serverPrefix,
-					Command: irc.RPL_WELCOME,
-					Params: []string{
-						nick,
-						"Welcome back to IRC Idler, " +
-							p.server.Session.ClientID.String(),
-					},
-				},
-				{
-					Prefix:  p.serverPrefix,
-					Command: irc.RPL_YOURHOST,
-					Params: []string{
-						nick,
-						p.msgCache.yourhost,
-					},
-				},
-				{
-					Prefix:  p.serverPrefix,
-					Command: irc.RPL_CREATED,
-					Params: []string{
-						nick,
-						p.msgCache.created,
-					},
-				},
-				{
-					Prefix:  p.serverPrefix,
-					Command: irc.RPL_MYINFO,
-					Params:  append([]string{nick}, p.msgCache.myinfo...),
-				},
-			}
-			for _, m := range messages {
-				if p.sendClient(m) != nil {
-					return
-				}
-			}
-			p.client.Session.ClientID = p.server.Session.ClientID
-			// Trigger a message of the day response; once that completes
-			// the client will be ready.
-			p.sendServer(&irc.Message{Command: "MOTD", Params: []string{}})
+	nick := p.server.Session.ClientID.Nick
+	messages := []*irc.Message{
+		{
+			Prefix:  p.serverPrefix,
+			Command: irc.RPL_WELCOME,
+			Params: []string{
+				nick,
+				"Welcome back to IRC Idler, " +
+					p.server.Session.ClientID.String(),
+			},
+		},
+		{
+			Prefix:  p.serverPrefix,
+			Command: irc.RPL_YOURHOST,
+			Params: []string{
+				nick,
+				p.msgCache.yourhost,
+			},
+		},
+		{
+			Prefix:  p.serverPrefix,
+			Command: irc.RPL_CREATED,
+			Params: []string{
+				nick,
+				p.msgCache.created,
+			},
+		},
+		{
+			Prefix:  p.serverPrefix,
+			Command: irc.RPL_MYINFO,
+			Params:  append([]string{nick}, p.msgCache.myinfo...),
+		},
+	}
+	for _, m := range messages {
+		if p.sendClient(m) != nil {
+			return
+		}
+	}
+	for _, m := range p.server.Session.ISupport.Messages(p.serverPrefix, nick) {
+		if p.sendISupport(m) != nil {
+			return
+		}
+	}
+	p.client.Session.ClientID = p.server.Session.ClientID
+	// Trigger a message of the day response; once that completes
+	// the client will be ready.
+	p.sendServer(&irc.Message{Command: "MOTD", Params: []string{}})
+}
+
+// Send `msg`, an RPL_ISUPPORT from the server, to the client. We answer
+// CHATHISTORY ourselves, so we drop the server's CHATHISTORY token, if any,
+// and follow the first of these the client sees with our own.
+func (p *Proxy) sendISupport(msg *irc.Message) error {
+	last := len(msg.Params) - 1
+	params := []string{msg.Params[0]}
+	for _, token := range msg.Params[1:last] {
+		name := strings.SplitN(strings.TrimPrefix(token, "-"), "=", 2)[0]
+		if name != "CHATHISTORY" {
+			params = append(params, token)
+		}
+	}
+	if len(params) > 1 {
+		filtered := *msg
+		filtered.Params = append(params, msg.Params[last])
+		if err := p.sendClient(&filtered); err != nil {
+			return err
+		}
+	}
+	if _, ok := p.client.Session.ISupport.Get("CHATHISTORY"); ok {
+		return nil
+	}
+	return p.sendClient(&irc.Message{
+		Prefix:  msg.Prefix,
+		Command: irc.RPL_ISUPPORT,
+		Params: []string{
+			msg.Params[0],
+			"CHATHISTORY=" + strconv.Itoa(maxChatHistory),
+			msg.Params[last],
+		},
+	})
+}
+
+// Forward the registration messages held back while the client negotiated
+// capabilities with us.
+func (p *Proxy) flushRegistration() {
+	pending := p.client.pending
+	p.client.pending = nil
+	for _, msg := range pending {
+		if p.sendServer(msg) != nil {
+			return
+		}
+	}
+}
+
+// Handle a CAP message from the client. We act as the client's CAP server,
+// offering clientCaps. Since sendClient updates the client's session, the
+// capabilities the client enables end up in p.client.Session.Caps.
+func (p *Proxy) handleClientCap(msg *irc.Message) {
+	target := p.client.Session.ClientID.Nick
+	if target == "" {
+		target = "*"
+	}
+	reply := func(params ...string) {
+		p.sendClient(&irc.Message{
+			Prefix:  p.serverPrefix,
+			Command: "CAP",
+			Params:  append([]string{target}, params...),
+		})
+	}
+	switch msg.Params[0] {
+	case "LS":
+		reply("LS", strings.Join(clientCaps, " "))
+	case "LIST":
+		enabled := p.client.Session.Caps.Enabled.Names()
+		sort.Strings(enabled)
+		reply("LIST", strings.Join(enabled, " "))
+	case "REQ":
+		list := msg.Params[len(msg.Params)-1]
+		if offersCaps(list) {
+			reply("ACK", list)
+		} else {
+			reply("NAK", list)
 		}
+	case "END":
+		// Nothing to say; see handleHandshakeMessage.
+	default:
+		p.sendClient(&irc.Message{
+			Prefix:  p.serverPrefix,
+			Command: irc.ERR_INVALIDCAPCMD,
+			Params:  []string{target, msg.Params[0], "Invalid CAP command"},
+		})
+	}
+}
+
+// Return true if `list`, the argument of a CAP REQ, names only capabilities
+// in clientCaps (each of which may be prefixed with '-', to disable it).
+// Per the spec, we must accept or reject a request as a whole.
+func offersCaps(list string) bool {
+	names := strings.Fields(list)
+	if len(names) == 0 {
+		return false
+	}
+	for _, name := range names {
+		if !offersCap(strings.TrimPrefix(name, "-")) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return true if `name` is in clientCaps.
+func offersCap(name string) bool {
+	for _, offered := range clientCaps {
+		if name == offered {
+			return true
+		}
+	}
+	return false
+}
+
+// Start capability negotiation with the server. This should be called
+// right after connecting, before any of the client's registration messages
+// are forwarded.
+func (p *Proxy) startCapNegotiation() {
+	p.sendServer(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+}
+
+// Handle a CAP message from the server. By the time this is called,
+// p.server.Session.Caps has already been updated.
+func (p *Proxy) handleServerCap(msg *irc.Message) {
+	if len(msg.Params) < 3 {
+		return
+	}
+	caps := &p.server.Session.Caps
+	switch msg.Params[1] {
+	case "LS":
+		if len(msg.Params) > 3 && msg.Params[2] == "*" {
+			// Multi-line reply; wait for the rest.
+			return
+		}
+		if !p.requestCaps(caps.Available) {
+			p.endCapNegotiation()
+		}
+	case "NEW":
+		newCaps := make(state.CapSet)
+		for _, name := range strings.Fields(msg.Params[2]) {
+			newCaps[strings.SplitN(name, "=", 2)[0]] = ""
+		}
+		p.requestCaps(newCaps)
+	case "ACK":
+		if p.server.Handshake.NegotiatingCaps() && p.config.SASL != nil &&
+			caps.Enabled.Has("sasl") && p.saslMech == nil {
+
+			p.startSASL()
+		} else {
+			p.endCapNegotiation()
+		}
+	case "NAK":
+		p.endCapNegotiation()
+	}
+}
+
+// Begin SASL authentication with the server. Capability negotiation stays
+// open until the exchange finishes.
+func (p *Proxy) startSASL() {
+	mech, err := p.config.SASL.NewMechanism()
+	if err != nil {
+		p.logger.Errorln("Can't start SASL authentication:", err)
+		p.endCapNegotiation()
+		return
+	}
+	p.saslMech = mech
+	p.saslChallenge = sasl.ChallengeBuffer{}
+	p.sendServer(&irc.Message{Command: "AUTHENTICATE", Params: []string{mech.Name()}})
+}
+
+// Handle an AUTHENTICATE message from the server, i.e. (part of) a challenge.
+func (p *Proxy) handleAuthenticate(msg *irc.Message) {
+	if p.saslMech == nil || len(msg.Params) == 0 {
+		return
+	}
+	challenge, done, err := p.saslChallenge.Add(msg.Params[0])
+	if !done && err == nil {
+		return
+	}
+	var response []byte
+	if err == nil {
+		response, err = p.saslMech.Next(challenge)
+	}
+	if err != nil {
+		p.logger.Errorln("SASL authentication failed:", err)
+		// Abort; the server will reply with ERR_SASLABORTED, which we
+		// pass on to the client.
+		p.sendServer(&irc.Message{Command: "AUTHENTICATE", Params: []string{"*"}})
+		return
+	}
+	for _, m := range sasl.EncodeResponse(response) {
+		if p.sendServer(m) != nil {
+			return
+		}
+	}
+}
+
+// Handle the end of SASL authentication, successful or otherwise. `msg` is
+// the numeric reply that ended it.
+func (p *Proxy) finishSASL(msg *irc.Message) {
+	if msg.Command == irc.RPL_SASLSUCCESS {
+		p.logger.Infoln("SASL authentication succeeded.")
+	} else {
+		p.logger.Errorf("SASL authentication failed: %q\n", msg)
+	}
+	p.saslMech = nil
+
+	// Let the user know what happened. On failure we carry on with
+	// registration regardless; if the network insists on authentication
+	// it will tell the client so itself.
+	p.sendClient(msg)
+	p.endCapNegotiation()
+}
+
+// Return the list of capabilities we want from the server.
+func (p *Proxy) wantedCaps() []string {
+	if p.config.SASL == nil {
+		return wantedCaps
+	}
+	return append(append([]string{}, wantedCaps...), "sasl")
+}
+
+// Send a CAP REQ for those capabilities in `offered` that we want and haven't
+// already enabled. Returns true if a request was sent.
+func (p *Proxy) requestCaps(offered state.CapSet) bool {
+	req := []string{}
+	for _, name := range p.wantedCaps() {
+		if offered.Has(name) && !p.server.Session.Caps.Enabled.Has(name) {
+			req = append(req, name)
+		}
+	}
+	if len(req) == 0 {
+		return false
+	}
+	p.sendServer(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", strings.Join(req, " ")},
+	})
+	return true
+}
+
+// Send CAP END if we're still negotiating capabilities with the server.
+func (p *Proxy) endCapNegotiation() {
+	if p.server.Handshake.NegotiatingCaps() {
+		p.sendServer(&irc.Message{Command: "CAP", Params: []string{"END"}})
 	}
 }
 
@@ -400,12 +952,17 @@ func (p *Proxy) handleHandshakeMessage(msg *irc.Message) {
 // the client has disconnected.
 func (p *Proxy) handleClientEvent(msg *irc.Message, ok bool) {
 	if !ok {
-		p.logger.Debugln("Client disconnected")
+		p.logger.Debugln("Client disconnected:", p.client.closeReason())
 		p.dropClient()
 		return
 	}
 	p.logger.Debugf("handleClientEvent(): Received message: %q\n", msg)
-	if err := msg.Validate(); err != nil {
+	target := p.client.Session.ClientID.Nick
+	if target == "" {
+		target = "*"
+	}
+	if err := msg.ValidateFor(target); err != nil {
+		err.Prefix = p.serverPrefix
 		p.sendClient((*irc.Message)(err))
 		p.dropClient()
 		return
@@ -419,35 +976,93 @@ func (p *Proxy) handleClientEvent(msg *irc.Message, ok bool) {
 	}
 
 	switch msg.Command {
-	case "PING":
-		msg.Prefix = ""
-		msg.Command = "PONG"
-		p.sendClient(msg)
-	case "PONG":
-		// We just ignore this one; the keepalive logic is centralized.
+	case "CAP":
+		// Capability negotiation with the server is our business; don't
+		// let the client interfere with it.
+		p.handleClientCap(msg)
 	case "QUIT":
 		p.logger.Debugln("Client sent quit; disconnecting.")
 		p.dropClient()
 	case "JOIN":
-		channelName := msg.Params[0]
+		join := &irc.Join{}
+		if err := join.FromMessage(msg); err != nil {
+			p.sendClient((*irc.Message)(err.(*irc.MessageError)))
+			return
+		}
+		// The channels (and their keys) we actually need the server to
+		// join for us:
+		forward := &irc.Join{}
+		for i, channelName := range join.Channels {
+			p.logger.Debugf("Got join for channel %q\n", channelName)
+
+			if p.client.Session.HaveChannel(channelName) {
+				p.logger.Infoln("Client already in channel " + channelName)
+				// Some clients (e.g. Pidgin) will send a JOIN message when
+				// the user tries to a join a channel, even if they're already in the
+				// channel. Pidgin ends up with duplicate windows/tabs for that
+				// channel if we actually respond to the extra messages, so we don't.
+				continue
+			}
 
-		p.logger.Debugf("Got join for channel %q\n", channelName)
+			if p.server.Session.HaveChannel(channelName) {
+				p.logger.Infoln("Rejoining channel " + channelName)
+				p.rejoinChannel(channelName, p.preLogSession.GetChannel(channelName))
+				if p.client.IsClosed() {
+					return
+				}
+				continue
+			}
 
-		if p.client.Session.HaveChannel(channelName) {
-			p.logger.Infoln("Client already in channel " + channelName)
-			// Some clients (e.g. Pidgin) will send a JOIN message when
-			// the user tries to a join a channel, even if they're already in the
-			// channel. Pidgin ends up with duplicate windows/tabs for that
-			// channel if we actually respond to the extra messages, so we don't.
+			// Keys belong to the first len(Keys) channels, so dropping
+			// channels as above keeps the rest lined up with theirs.
+			forward.Channels = append(forward.Channels, channelName)
+			if i < len(join.Keys) {
+				forward.Keys = append(forward.Keys, join.Keys[i])
+			}
+		}
+		if len(forward.Channels) != 0 {
+			// The typed command only has the parameters; keep any
+			// tags the client sent along with them.
+			out := forward.ToMessage()
+			out.Tags = msg.Tags
+			p.sendServer(out)
+		}
+	case "TAGMSG":
+		// Only clients which have negotiated message-tags with us send
+		// these. Unless the server has negotiated it with us too,
+		// there's nowhere for this to go.
+		if !p.server.Session.Caps.Enabled.Has("message-tags") || p.sendServer(msg) != nil {
 			return
 		}
-
-		if p.server.Session.HaveChannel(channelName) {
-			p.logger.Infoln("Rejoining channel " + channelName)
-			p.rejoinChannel(channelName, p.preLogSession.GetChannel(channelName))
-		} else {
-			p.sendServer(msg)
+		if p.client.Session.Caps.Enabled.Has("echo-message") {
+			echo := *msg
+			echo.Prefix = p.server.Session.ClientID.String()
+			p.sendClient(&echo)
+		}
+	case "PRIVMSG", "NOTICE":
+		if msg.Command == "PRIVMSG" && p.server.Session.ISupport.EqualNames(msg.Params[0], playbackPrefix) {
+			p.handlePlayback(msg.Params[1])
+			return
+		}
+		echo := p.client.Session.Caps.Enabled.Has("echo-message")
+		for _, part := range irc.SplitMessage(msg, p.maxPrefixLen()) {
+			if p.sendServer(part) != nil {
+				return
+			}
+			// The message as others will see it:
+			sent := *part
+			sent.Prefix = p.server.Session.ClientID.String()
+			sent.Tags = nil
+			stamped := p.stamp(&sent)
+			p.recordHistory(stamped)
+			if echo {
+				// The server won't echo it, as we haven't asked
+				// it to, so we do:
+				p.sendClient(stamped)
+			}
 		}
+	case "CHATHISTORY":
+		p.handleChatHistory(msg)
 	default:
 		// TODO: we should restrict the list of commands used here to known-safe.
 		// We also need to inspect a lot of these and adjust our own state.
@@ -455,29 +1070,41 @@ func (p *Proxy) handleClientEvent(msg *irc.Message, ok bool) {
 	}
 }
 
+// Return a pessimistic estimate of the length of the prefix the server will
+// add to our messages when relaying them. We don't necessarily know our
+// user and host as others see them (e.g. if the server assigns a cloak), so
+// assume they are as long as they can reasonably be.
+func (p *Proxy) maxPrefixLen() int {
+	id := p.server.Session.ClientID
+	userLen, hostLen := len(id.User), len(id.Host)
+	if userLen < maxUserLen {
+		userLen = maxUserLen
+	}
+	if hostLen < maxHostLen {
+		hostLen = maxHostLen
+	}
+	return len(id.Nick) + 1 + userLen + 1 + hostLen
+}
+
 // Handle the case where the client has just requested to join channel that we
 // are already in on the server side. This replays message logs and updates
 // state as necessary.
 func (p *Proxy) rejoinChannel(channelName string, preLogState *state.ChannelState) {
-	joinMessage := &irc.Message{
-		Prefix:  p.client.Session.ClientID.String(),
-		Command: "JOIN",
-		Params:  []string{channelName},
+	join := &irc.Join{
+		Prefix:   p.client.Session.ClientID.String(),
+		Channels: []string{channelName},
 	}
-	if p.sendClient(joinMessage) != nil {
+	if p.sendClient(join.ToMessage()) != nil {
 		return
 	}
 	if preLogState.Topic != "" {
-		rplTopic := &irc.Message{
+		rplTopic := &irc.TopicReply{
 			Prefix:  p.serverPrefix,
-			Command: irc.RPL_TOPIC,
-			Params: []string{
-				p.client.Session.ClientID.String(),
-				channelName,
-				preLogState.Topic,
-			},
+			Target:  p.client.Session.ClientID.String(),
+			Channel: channelName,
+			Topic:   preLogState.Topic,
 		}
-		if p.sendClient(rplTopic) != nil {
+		if p.sendClient(rplTopic.ToMessage()) != nil {
 			return
 		}
 	}
@@ -485,62 +1112,156 @@ func (p *Proxy) rejoinChannel(channelName string, preLogState *state.ChannelStat
 	clientState := p.client.Session.GetChannel(channelName)
 
 	myNick := p.server.Session.ClientID.Nick
-	for _, nick := range preLogState.Users() {
-		rplNamreply := &irc.Message{
-			Prefix:  p.serverPrefix,
-			Command: irc.RPL_NAMEREPLY,
+	for _, member := range preLogState.Members() {
+		rplNamreply := &irc.NamReply{
+			Prefix: p.serverPrefix,
+			Target: myNick,
 			// FIXME: The "=" denotes a public channel. at some point
 			// we should actually check this.
-			Params: []string{myNick, "=", channelName, nick},
+			Symbol:  "=",
+			Channel: channelName,
+			Nicks:   []string{p.formatMembership(member)},
 		}
-		if p.sendClient(rplNamreply) != nil {
+		if p.sendClient(rplNamreply.ToMessage()) != nil {
 			return
 		}
-		clientState.AddUser(nick)
+		clientState.AddMember(member)
 	}
-	if p.sendClient(&irc.Message{
-		Prefix:  p.serverPrefix,
-		Command: irc.RPL_ENDOFNAMES,
-		Params: []string{
-			myNick, channelName, "End of NAMES list",
-		}}) == nil {
+	rplEndOfNames := &irc.Numeric{
+		Prefix: p.serverPrefix,
+		Code:   irc.RPL_ENDOFNAMES,
+		Target: myNick,
+		Params: []string{channelName, "End of NAMES list"},
+	}
+	if p.sendClient(rplEndOfNames.ToMessage()) == nil {
 		p.replayLog(channelName)
 	}
 }
 
+// Format `member` for RPL_NAMEREPLY, as the server would for the client,
+// given the capabilities the client has enabled.
+func (p *Proxy) formatMembership(member irc.Membership) string {
+	enabled := p.client.Session.Caps.Enabled
+	return member.Format(enabled.Has("multi-prefix"), enabled.Has("userhost-in-names"))
+}
+
+// Return a copy of `rpl`, an RPL_NAMEREPLY from the server, adjusted for the
+// client. We may have enabled capabilities which change the format of these
+// (see wantedCaps) that the client hasn't.
+func (p *Proxy) namReplyForClient(rpl *irc.NamReply) *irc.NamReply {
+	ret := *rpl
+	ret.Nicks = make([]string, len(rpl.Nicks))
+	for i, nick := range rpl.Nicks {
+		member, err := p.server.Session.ISupport.ParseMembership(nick)
+		if err != nil {
+			ret.Nicks[i] = nick
+		} else {
+			ret.Nicks[i] = p.formatMembership(member)
+		}
+	}
+	return &ret
+}
+
+// Numeric replies whose parameters we (or our session state) look at, and
+// so must be valid. Others are just passed along to the client.
+var indexedNumerics = map[string]bool{
+	irc.RPL_WELCOME:    true,
+	irc.RPL_YOURHOST:   true,
+	irc.RPL_CREATED:    true,
+	irc.RPL_MYINFO:     true,
+	irc.RPL_ISUPPORT:   true,
+	irc.RPL_TOPIC:      true,
+	irc.RPL_NAMEREPLY:  true,
+	irc.RPL_ENDOFNAMES: true,
+}
+
 // Like handleClientEvent, but for events from the server.
 func (p *Proxy) handleServerEvent(msg *irc.Message, ok bool) {
 	if ok {
 		if err := msg.Validate(); err != nil {
-			p.logger.Errorf("handleServerEvent(): Got an invalid message"+
-				"from server: %q (error: %q), disconnecting.\n", msg, err)
-			p.reset()
-			return
+			if irc.IsNumeric(msg.Command) && !indexedNumerics[msg.Command] {
+				// We only pass these along, so a reply that's off
+				// from what we expect (servers vary) is no reason
+				// to drop the connection.
+				p.logger.Warnf("handleServerEvent(): Got an invalid message "+
+					"from server: %q (error: %q), passing it along.\n", msg, err)
+			} else {
+				p.logger.Errorf("handleServerEvent(): Got an invalid message"+
+					"from server: %q (error: %q), disconnecting.\n", msg, err)
+				p.reset()
+				return
+			}
 		}
 		p.logger.Debugf("handleServerEvent(): RecievedMessage: %q\n", msg)
 	} else {
 		// Server disconnect. We boot the client and start all over.
 		// TODO: might be nice to attempt a reconnect with cached credentials.
-		p.logger.Errorf("Server disconnected")
+		p.logger.Errorln("Server disconnected:", p.server.closeReason())
 		p.reset()
 		return
 	}
 
+	// Validate() has checked that the commands we look at below have the
+	// parameters they need, so if this fails it's something we just pass
+	// along (e.g. an error reply without a target); cmd is then nil.
+	cmd, err := irc.ParseCommand(msg)
+	if err != nil {
+		p.logger.Debugf("handleServerEvent(): Could not parse %q: %v\n", msg, err)
+	}
+
+	// NICK and QUIT don't say which channels they apply to, so we have to
+	// work that out (for logging purposes) before updating our state:
+	var userChannels []string
+	switch cmd.(type) {
+	case *irc.Nick, *irc.Quit:
+		if clientID, err := irc.ParseClientID(msg.Prefix); err == nil {
+			userChannels = p.server.Session.ChannelsWithUser(clientID.Nick)
+		}
+	}
+	msg = p.batchNetsplit(msg, cmd)
+
 	p.server.UpdateFromServer(msg)
 
 	switch msg.Command {
-	case "PING":
-		msg.Prefix = ""
-		msg.Command = "PONG"
-		p.sendServer(msg)
-	case "PONG":
-		// We just ignore this one; the keepalive logic is centralized.
+	case "CAP":
+		p.handleServerCap(msg)
+	case "AUTHENTICATE":
+		p.handleAuthenticate(msg)
+	case
+		irc.RPL_SASLSUCCESS,
+		irc.ERR_SASLFAIL,
+		irc.ERR_SASLTOOLONG,
+		irc.ERR_SASLABORTED,
+		irc.ERR_SASLALREADY,
+		irc.ERR_NICKLOCKED:
+
+		p.finishSASL(msg)
+	case "BATCH":
+		p.forwardBatch(msg)
+	case irc.RPL_ISUPPORT:
+		if p.sendISupport(msg) != nil {
+			p.logMessage(msg, cmd)
+		}
+	case "TAGMSG":
+		// These carry nothing but tags (e.g. typing notifications),
+		// so they're no use to clients without message-tags, and
+		// stale by the time they could be replayed; we don't log them.
+		if p.client.Session.Caps.Enabled.Has("message-tags") {
+			p.sendClient(msg)
+		}
+	case irc.ERR_UNKNOWNCOMMAND:
+		if len(msg.Params) > 1 && msg.Params[1] == "CAP" {
+			// The server doesn't support capability negotiation. We're
+			// the ones who sent the CAP, so the client doesn't need to
+			// know.
+			return
+		}
+		p.sendClient(msg)
 
 	// Things we can pass through to the client without any extra handling:
 	case
 		irc.RPL_MOTDSTART,
 		irc.RPL_MOTD,
-		irc.RPL_NAMEREPLY,
 		irc.RPL_TOPIC,
 
 		// Various nick related errors. TODO: we should be more careful;
@@ -554,12 +1275,17 @@ func (p *Proxy) handleServerEvent(msg *irc.Message, ok bool) {
 		irc.ERR_NICKCOLLISION:
 
 		p.sendClient(msg)
+	case irc.RPL_NAMEREPLY:
+		out := p.namReplyForClient(cmd.(*irc.NamReply)).ToMessage()
+		out.Tags = msg.Tags
+		p.sendClient(out)
 	case irc.RPL_WELCOME:
 		p.serverPrefix = msg.Prefix
 
 		// Extract the client ID. annoyingly, this isn't its own argument, so we
 		// have to pull it out of the welcome message manually.
-		parts := strings.Split(msg.Params[1], " ")
+		welcome := cmd.(*irc.Numeric)
+		parts := strings.Split(welcome.Params[0], " ")
 		clientIDString := parts[len(parts)-1]
 		clientID, err := irc.ParseClientID(clientIDString)
 
@@ -583,13 +1309,13 @@ func (p *Proxy) handleServerEvent(msg *irc.Message, ok bool) {
 	// reconnects, because the server won't send them again if it thinks the client
 	// is already connected:
 	case irc.RPL_YOURHOST:
-		p.msgCache.yourhost = msg.Params[1]
+		p.msgCache.yourhost = cmd.(*irc.Numeric).Params[0]
 		p.sendClient(msg)
 	case irc.RPL_CREATED:
-		p.msgCache.created = msg.Params[1]
+		p.msgCache.created = cmd.(*irc.Numeric).Params[0]
 		p.sendClient(msg)
 	case irc.RPL_MYINFO:
-		p.msgCache.myinfo = msg.Params[1:]
+		p.msgCache.myinfo = cmd.(*irc.Numeric).Params
 		p.sendClient(msg)
 		p.haveMsgCache = true
 	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
@@ -608,35 +1334,117 @@ func (p *Proxy) handleServerEvent(msg *irc.Message, ok bool) {
 		// 2. The user specifically sent a NAMES request, in which case they're
 		//    presumably already in the channel, so there should be no log, and
 		//    therefore it is safe to replay it.
-		p.replayLog(msg.Params[1])
+		p.replayLog(cmd.(*irc.Numeric).Params[0])
 	case "PRIVMSG", "NOTICE":
-		targetName := msg.Params[0]
-		if p.client.Session.HaveChannel(targetName) || p.client.Session.IsMe(targetName) {
-			if p.sendClient(msg) != nil {
-				p.logMessage(msg)
-			}
+		privmsg := cmd.(*irc.Privmsg)
+		var clientWants bool
+		if channelName, ok := p.server.Session.ISupport.ChannelTarget(privmsg.Target); ok {
+			clientWants = p.client.Session.HaveChannel(channelName)
 		} else {
-			p.logMessage(msg)
+			// Addressed to us (or to something like "*" during
+			// registration); the client wants it if it's there at all.
+			clientWants = p.client.Handshake.Done()
+		}
+		if clientWants {
+			// The client sees the same msgid as ends up in the
+			// history:
+			stamped := p.stamp(msg)
+			if p.sendClient(stamped) == nil {
+				p.recordHistory(stamped)
+				return
+			}
+		}
+		if !p.autoReplyCTCP(privmsg) {
+			p.logMessage(msg, cmd)
 		}
 	case "JOIN", "KICK", "PART", "QUIT", "NICK":
 		if !p.client.Handshake.Done() || p.sendClient(msg) != nil {
 			// Can't send the message to the client, so log it.
-			p.logMessage(msg)
+			p.logMessage(msg, cmd, userChannels...)
+		}
+	case "MODE":
+		if !p.server.Session.ISupport.IsChannel(msg.Params[0]) {
+			// A change to our user modes; the client wants these
+			// even during registration.
+			if p.sendClient(msg) != nil {
+				p.logMessage(msg, cmd)
+			}
+		} else if !p.client.Handshake.Done() || p.sendClient(msg) != nil {
+			p.logMessage(msg, cmd)
 		}
 	default:
 		// TODO: be a bit more methodical; there's probably a pretty finite list
 		// of things that can come through, and we want to make sure nothing is
 		// going to get us out of sync with the client.
 		if p.sendClient(msg) != nil {
-			p.logMessage(msg)
+			p.logMessage(msg, cmd)
 		}
 	}
 }
 
+// Answer the CTCP query in `msg`, if it is one we handle, on behalf of a
+// detached client. Rather than logging the query itself (which would have the
+// client answer it, long after the fact, on replay), we log a notice saying
+// who asked. Returns true if `msg` has been dealt with, false if it should be
+// logged as usual.
+func (p *Proxy) autoReplyCTCP(msg *irc.Privmsg) bool {
+	if p.config.DisableCTCPReplies || msg.Notice ||
+		p.server.Session.ISupport.IsChannel(msg.Target) {
+
+		return false
+	}
+	query, ok := ctcp.Decode(msg.Text)
+	if !ok {
+		return false
+	}
+	reply := &ctcp.Message{Command: query.Command}
+	switch query.Command {
+	case "CLIENTINFO":
+		reply.Params = "ACTION " + strings.Join(ctcpAutoReplies, " ")
+	case "PING":
+		reply.Params = query.Params
+	case "TIME":
+		reply.Params = time.Now().Format(time.RFC1123Z)
+	case "VERSION":
+		reply.Params = ctcpVersion
+	default:
+		return false
+	}
+	clientID, err := irc.ParseClientID(msg.Prefix)
+	if err != nil {
+		p.logger.Debugf("CTCP query with invalid prefix: %q\n", msg.ToMessage())
+		return false
+	}
+
+	text := "Answered CTCP " + query.Command + " from " + msg.Prefix +
+		" while you were away."
+	now := time.Now()
+	if now.Sub(p.lastCTCPReply) < ctcpReplyInterval {
+		p.logger.Debugf("Not answering CTCP query %q; too soon since the last.\n", msg.ToMessage())
+		// Still let the user know they were asked:
+		text = "CTCP " + query.Command + " from " + msg.Prefix +
+			" (not answered: rate limited)"
+	} else {
+		p.lastCTCPReply = now
+		if p.sendServer(ctcp.Reply(clientID.Nick, reply)) != nil {
+			return true
+		}
+	}
+	notice := &irc.Privmsg{
+		Prefix: idlerPrefix,
+		Notice: true,
+		Target: msg.Target,
+		Text:   text,
+	}
+	p.logMessage(notice.ToMessage(), notice)
+	return true
+}
+
 // Disconnect the client. If the handshake isn't done, disconnect the server too.
 func (p *Proxy) dropClient() {
 	p.logger.Debugln("dropClient(): dropping client connection.")
 	p.client.shutdown()
+	p.splitBatch, p.splitBatchEnd = nil, nil
 	if !p.server.Handshake.Done() {
 		p.logger.Debugln("dropClient(): handshake incomplete; dropping server connection.")
 		p.server.shutdown()
@@ -648,14 +1456,129 @@ func (p *Proxy) reset() {
 	p.logger.Debugln("Dropping connections.")
 	p.client.shutdown()
 	p.server.shutdown()
+	p.splitBatch, p.splitBatchEnd = nil, nil
+	p.splitUsers = make(map[string]splitUser)
+}
+
+// Return a new batch of type `batchType`, for the client.
+func (p *Proxy) newBatch(batchType string, params ...string) *irc.Batch {
+	p.batchCount++
+	return &irc.Batch{
+		Prefix: p.serverPrefix,
+		// The prefix keeps these from clashing with the server's refs:
+		Ref:    "idler" + strconv.Itoa(p.batchCount),
+		Type:   batchType,
+		Params: params,
+	}
+}
+
+// Pass the BATCH message `msg` from the server on to the client, if it
+// supports batches. We only pass on the end of a batch if the client saw it
+// opened.
+func (p *Proxy) forwardBatch(msg *irc.Message) {
+	if !p.client.Handshake.Done() || !p.client.Session.Caps.Enabled.Has("batch") {
+		return
+	}
+	batch, start, err := irc.ParseBatch(msg)
+	if err != nil {
+		p.logger.Debugf("forwardBatch(): Could not parse %q: %v\n", msg, err)
+		return
+	}
+	if start || p.client.batches[batch.Ref] {
+		p.sendClient(msg)
+	}
+}
+
+// Group the QUITs caused by a netsplit, and the JOINs of the users coming back
+// afterwards, into netsplit and netjoin batches for the client, if it supports
+// batches; the server needn't. `msg` is a message from the server, of which
+// `cmd` is the parsed form; we return it tagged with the batch it belongs to,
+// if any, first opening the batch if need be. The batch is closed by the
+// next message which doesn't belong in it, or after splitBatchTime.
+func (p *Proxy) batchNetsplit(msg *irc.Message, cmd irc.Command) *irc.Message {
+	var batchType string
+	var servers []string
+	clientID, err := irc.ParseClientID(msg.Prefix)
+	nick := p.server.Session.ISupport.FoldName(clientID.Nick)
+	if _, ok := msg.BatchRef(); !ok && err == nil {
+		switch cmd := cmd.(type) {
+		case *irc.Quit:
+			p.pruneSplitUsers()
+			if server1, server2, ok := irc.SplitServers(cmd.Reason); ok {
+				batchType, servers = irc.BatchNetsplit, []string{server1, server2}
+				p.splitUsers[nick] = splitUser{servers: servers, when: now()}
+			}
+		case *irc.Join:
+			p.pruneSplitUsers()
+			if user, ok := p.splitUsers[nick]; ok {
+				batchType, servers = irc.BatchNetjoin, user.servers
+				delete(p.splitUsers, nick)
+			}
+		}
+	}
+
+	batch := p.splitBatch
+	if batch != nil && (batch.Type != batchType || strings.Join(batch.Params, " ") != strings.Join(servers, " ")) {
+		p.endSplitBatch()
+		batch = nil
+	}
+	if batchType == "" || !p.client.Handshake.Done() || !p.client.Session.Caps.Enabled.Has("batch") {
+		return msg
+	}
+	if batch == nil {
+		batch = p.newBatch(batchType, servers...)
+		if p.sendClient(batch.Start()) != nil {
+			return msg
+		}
+		p.splitBatch = batch
+	}
+	p.splitBatchEnd = time.After(splitBatchTime)
+	return batch.Add(msg)
+}
+
+// A user lost in a netsplit; see Proxy.splitUsers.
+type splitUser struct {
+	servers []string  // The servers of the split, as in its QUIT message.
+	when    time.Time // When they quit.
+}
+
+// Forget the users who were lost in netsplits more than splitUserTime ago.
+func (p *Proxy) pruneSplitUsers() {
+	for nick, user := range p.splitUsers {
+		if now().Sub(user.when) > splitUserTime {
+			delete(p.splitUsers, nick)
+		}
+	}
+}
+
+// Close the netsplit or netjoin batch opened by batchNetsplit. Once users
+// have come back from a netsplit, any who haven't are presumably gone for good.
+func (p *Proxy) endSplitBatch() {
+	batch := p.splitBatch
+	p.splitBatch, p.splitBatchEnd = nil, nil
+	if batch.Type == irc.BatchNetjoin {
+		for nick, user := range p.splitUsers {
+			if strings.Join(user.servers, " ") == strings.Join(batch.Params, " ") {
+				delete(p.splitUsers, nick)
+			}
+		}
+	}
+	p.sendClient(batch.End())
+}
+
+// Get the message log for `name`, which may be a channel or a nick (for
+// private messages). Names which differ only in case (per the server's
+// CASEMAPPING) share a log.
+func (p *Proxy) channelLog(name string) (storage.ChannelLog, error) {
+	return p.messagelogs.GetChannel(p.server.Session.ISupport.FoldName(name))
 }
 
 // Replay the message log for channel `channelName`.
 func (p *Proxy) replayLog(channelName string) {
 	p.logger.Debugf("replayLog(%q)\n", channelName)
-	chLog, err := p.messagelogs.GetChannel(channelName)
+	chLog, err := p.channelLog(channelName)
 	if err != nil {
-		p.logger.Debugln("messagelogs.GetChannel(): %v", err)
+		p.logger.Debugf("messagelogs.GetChannel(): %v", err)
 		return
 	}
 
@@ -667,10 +1590,41 @@ func (p *Proxy) replayLog(channelName string) {
 		return
 	}
 	defer cursor.Close()
+
+	// Clients which support batches get each channel's replay as a
+	// chathistory batch, which we open when we have something to put in
+	// it:
+	wantBatch := p.client.Session.Caps.Enabled.Has("batch") &&
+		p.server.Session.ISupport.IsChannel(channelName)
+	// Clients using *playback ask for the messages they want (see
+	// handlePlayback), so we only replay the events they need to know who
+	// is in the channel:
+	playback := p.client.Session.Caps.Enabled.Has("znc.in/playback")
+	var batch *irc.Batch
+	defer func() {
+		if batch != nil && !p.client.IsClosed() {
+			p.sendClient(batch.End())
+		}
+	}()
+
 	for {
 		msg, err := cursor.Get()
-		if err == nil {
-			if p.sendClient(msg) != nil {
+		if err == nil && playback && (msg.Command == "PRIVMSG" || msg.Command == "NOTICE") {
+			// The client will PLAY this if it wants it.
+		} else if err == nil {
+			msg = p.replayedMessage(msg)
+			if wantBatch && batch == nil {
+				batch = p.newBatch(irc.BatchChatHistory, channelName)
+				if p.sendClient(batch.Start()) != nil {
+					return
+				}
+			}
+			if batch != nil {
+				msg = batch.Add(msg)
+			}
+			// A message we can't send now we never will; it's no
+			// reason to hold up the rest of the log.
+			if err := p.sendClient(msg); err != nil && !unwritable(err) {
 				return
 			}
 		} else if err == io.EOF {
@@ -690,32 +1644,697 @@ func (p *Proxy) replayLog(channelName string) {
 	}
 }
 
-// Log the message `msg`. Note that not all message types are logged.
-func (p *Proxy) logMessage(msg *irc.Message) {
-	p.logger.Debugln("logMessage(%q)\n", msg)
-
-	switch msg.Command {
-	case "QUIT":
-		// FIXME: we need to store this, since otherwise we don't
-		// hear about users leaving channels by disconnecting from the
-		// network entirely. However, before we cand do that we need to
-		// do a bit of refactoring, since QUIT doesn't include channel
-		// information. For now, we just punt.
+// Answer the client's CHATHISTORY command `msg` from the message logs. The
+// history of a nick is our private messages with them.
+func (p *Proxy) handleChatHistory(msg *irc.Message) {
+	fail := func(code, description string, context ...string) {
+		params := append([]string{"CHATHISTORY", code}, context...)
+		p.sendClient(&irc.Message{
+			Prefix:  p.serverPrefix,
+			Command: "FAIL",
+			Params:  append(params, description),
+		})
+	}
+	subcommand := strings.ToUpper(msg.Params[0])
+	numParams := map[string]int{
+		"LATEST":  4,
+		"BEFORE":  4,
+		"AFTER":   4,
+		"AROUND":  4,
+		"BETWEEN": 5,
+		"TARGETS": 4,
+	}[subcommand]
+	if numParams == 0 {
+		fail("INVALID_PARAMS", "Unknown subcommand", subcommand)
 		return
-	case "PRIVMSG", "NOTICE", "JOIN", "KICK", "PART", "NICK":
-	default:
-		// Don't log anything we don't specificially whitelist above.
+	} else if len(msg.Params) < numParams {
+		fail("NEED_MORE_PARAMS", "Not enough parameters", subcommand)
 		return
 	}
+	limit, err := strconv.Atoi(msg.Params[numParams-1])
+	if err != nil || limit <= 0 {
+		fail("INVALID_PARAMS", "Invalid limit", subcommand, msg.Params[numParams-1])
+		return
+	}
+	if limit > maxChatHistory {
+		limit = maxChatHistory
+	}
 
-	channelName := msg.Params[0]
-	chLog, err := p.messagelogs.GetChannel(channelName)
+	// The references to points in the history, which follow the target
+	// (except for TARGETS, which has none):
+	refParams := msg.Params[2 : numParams-1]
+	if subcommand == "TARGETS" {
+		refParams = msg.Params[1 : numParams-1]
+	}
+	refs := make([]storage.Anchor, len(refParams))
+	for i, param := range refParams {
+		if param == "*" && subcommand == "LATEST" {
+			continue
+		}
+		anchor, ok := parseHistoryRef(param)
+		if !ok || (subcommand == "TARGETS" && anchor.MsgID != "") {
+			fail("INVALID_PARAMS", "Invalid message reference", subcommand, param)
+			return
+		}
+		refs[i] = anchor
+	}
+
+	if subcommand == "TARGETS" {
+		p.chatHistoryTargets(refs[0].Time, refs[1].Time, limit)
+		return
+	}
+	target := msg.Params[1]
+	chLog, keep, err := p.targetHistory(target)
 	if err != nil {
-		p.logger.Errorf("Failed to get log for %q: %q.\n", channelName, err)
+		p.logger.Errorf("Failed to get log for %q: %q.\n", target, err)
+		fail("MESSAGE_ERROR", "Could not get the history", subcommand, target)
 		return
 	}
-	err = chLog.LogMessage(msg)
+
+	var msgs []*irc.Message
+	switch subcommand {
+	case "LATEST":
+		msgs, err = chatHistory(chLog, storage.HistoryQuery{
+			After: refs[0], Limit: limit, Latest: true,
+		}, keep)
+	case "BEFORE":
+		msgs, err = chatHistory(chLog, storage.HistoryQuery{
+			Before: refs[0], Limit: limit, Latest: true,
+		}, keep)
+	case "AFTER":
+		msgs, err = chatHistory(chLog, storage.HistoryQuery{
+			After: refs[0], Limit: limit,
+		}, keep)
+	case "AROUND":
+		msgs, err = chatHistory(chLog, storage.HistoryQuery{
+			Before: refs[0], Limit: limit / 2, Latest: true,
+		}, keep)
+		// The rest start at the time referred to, or with the
+		// message, i.e. right after the one before it:
+		query := storage.HistoryQuery{Limit: limit - len(msgs)}
+		if refs[0].MsgID == "" {
+			query.After.Time = refs[0].Time.Add(-time.Millisecond)
+		} else if err == nil {
+			var prev []*irc.Message
+			prev, err = chLog.History(storage.HistoryQuery{
+				Before: refs[0], Limit: 1, Latest: true,
+			})
+			if len(prev) != 0 {
+				query.After = historyAnchor(prev[0])
+			}
+		}
+		if err == nil {
+			var after []*irc.Message
+			after, err = chatHistory(chLog, query, keep)
+			msgs = append(msgs, after...)
+		}
+	case "BETWEEN":
+		// The references may come in either order; we start from the
+		// first, whichever way that is.
+		msgs, err = chatHistory(chLog, storage.HistoryQuery{
+			After: refs[0], Before: refs[1], Limit: limit,
+		}, keep)
+		if err == nil && len(msgs) == 0 {
+			msgs, err = chatHistory(chLog, storage.HistoryQuery{
+				After: refs[1], Before: refs[0], Limit: limit, Latest: true,
+			}, keep)
+		}
+	}
+	if err == storage.ErrNoSuchMessage {
+		fail("INVALID_MSGREFID", "Unknown msgid", subcommand, target)
+		return
+	} else if err != nil {
+		p.logger.Errorf("Failed to get history for %q: %q.\n", target, err)
+		fail("MESSAGE_ERROR", "Could not get the history", subcommand, target)
+		return
+	}
+	p.sendHistory(target, msgs)
+}
+
+// Return the log holding the history of `target`, a channel or nick, and
+// which of the messages in it belong to that history (nil for all of them).
+// Private messages all share one log, so a nick's history is the messages
+// to and from them in it.
+func (p *Proxy) targetHistory(target string) (storage.ChannelLog, func(*irc.Message) bool, error) {
+	isupport := p.server.Session.ISupport
+	if isupport.IsChannel(target) {
+		chLog, err := p.channelLog(target)
+		return chLog, nil, err
+	}
+	chLog, err := p.channelLog(p.server.Session.ClientID.Nick)
+	return chLog, func(msg *irc.Message) bool {
+		peer, ok := p.pmPeer(msg)
+		return ok && isupport.EqualNames(peer, target)
+	}, err
+}
+
+// Send `msgs`, from the history of `target`, to the client, in a chathistory
+// batch if it supports batches.
+func (p *Proxy) sendHistory(target string, msgs []*irc.Message) {
+	var batch *irc.Batch
+	if p.client.Session.Caps.Enabled.Has("batch") {
+		batch = p.newBatch(irc.BatchChatHistory, target)
+		if p.sendClient(batch.Start()) != nil {
+			return
+		}
+	}
+	for _, msg := range msgs {
+		if batch != nil {
+			msg = batch.Add(msg)
+		}
+		if err := p.sendClient(msg); err != nil && !unwritable(err) {
+			return
+		}
+	}
+	if batch != nil {
+		p.sendClient(batch.End())
+	}
+}
+
+// Parse a reference to a point in the history, as used by CHATHISTORY:
+// "msgid=<msgid>" or "timestamp=<time>".
+func parseHistoryRef(ref string) (anchor storage.Anchor, ok bool) {
+	parts := strings.SplitN(ref, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return anchor, false
+	}
+	switch parts[0] {
+	case "msgid":
+		anchor.MsgID = parts[1]
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return anchor, false
+		}
+		anchor.Time = t
+	default:
+		return anchor, false
+	}
+	return anchor, true
+}
+
+// Return an Anchor referring to `msg`, from a log's history.
+func historyAnchor(msg *irc.Message) storage.Anchor {
+	if id, ok := msg.Tags["msgid"]; ok {
+		return storage.Anchor{MsgID: id}
+	}
+	t, _ := msg.Time()
+	return storage.Anchor{Time: t}
+}
+
+// Return the PRIVMSGs and NOTICEs selected from `chLog` by `query`, for which
+// `keep` (if not nil) returns true. Since we're not replaying the rest (which
+// would upset the client's idea of who is in the channel), we skip them,
+// fetching more to make up the limit.
+func chatHistory(chLog storage.ChannelLog, query storage.HistoryQuery, keep func(*irc.Message) bool) ([]*irc.Message, error) {
+	ret := []*irc.Message{}
+	for len(ret) < query.Limit {
+		msgs, err := chLog.History(query)
+		if err != nil {
+			return nil, err
+		}
+		var found []*irc.Message
+		for _, msg := range msgs {
+			if (msg.Command == "PRIVMSG" || msg.Command == "NOTICE") && (keep == nil || keep(msg)) {
+				found = append(found, msg)
+			}
+		}
+		if query.Latest {
+			if len(found) > query.Limit-len(ret) {
+				found = found[len(found)-(query.Limit-len(ret)):]
+			}
+			ret = append(found, ret...)
+		} else {
+			if len(found) > query.Limit-len(ret) {
+				found = found[:query.Limit-len(ret)]
+			}
+			ret = append(ret, found...)
+		}
+		if len(msgs) < query.Limit {
+			// That's all there is.
+			break
+		}
+		// Carry on from the last message we looked at:
+		next := msgs[len(msgs)-1]
+		if query.Latest {
+			next = msgs[0]
+		}
+		anchor := historyAnchor(next)
+		if anchor.IsZero() {
+			// We can't say where that is; give up.
+			break
+		}
+		if query.Latest {
+			query.Before = anchor
+		} else {
+			query.After = anchor
+		}
+	}
+	return ret, nil
+}
+
+// Answer CHATHISTORY TARGETS: list, in a batch, the channels we're in and
+// the nicks we've exchanged private messages with, which have messages
+// between `from` and `to` (in either order), with the time of the latest, up
+// to `limit` of them.
+func (p *Proxy) chatHistoryTargets(from, to time.Time, limit int) {
+	if to.Before(from) {
+		from, to = to, from
+	}
+	type target struct {
+		name   string
+		latest time.Time
+	}
+	var targets []target
+	history := func(name string, limit int) []*irc.Message {
+		chLog, err := p.channelLog(name)
+		if err != nil {
+			p.logger.Errorf("Failed to get log for %q: %q.\n", name, err)
+			return nil
+		}
+		msgs, err := chatHistory(chLog, storage.HistoryQuery{
+			After:  storage.Anchor{Time: from},
+			Before: storage.Anchor{Time: to},
+			Limit:  limit,
+			Latest: true,
+		}, nil)
+		if err != nil {
+			p.logger.Errorf("Failed to get history for %q: %q.\n", name, err)
+		}
+		return msgs
+	}
+	for _, channelName := range p.serverChannels() {
+		if msgs := history(channelName, 1); len(msgs) != 0 {
+			latest, _ := msgs[0].Time()
+			targets = append(targets, target{channelName, latest})
+		}
+	}
+	// The private messages all share our log; each peer's latest is the
+	// last we see with them, among as many as *playback would look
+	// through:
+	peers := map[string]int{}
+	for _, msg := range history(p.server.Session.ClientID.Nick, maxPlayback) {
+		peer, ok := p.pmPeer(msg)
+		if !ok {
+			continue
+		}
+		latest, _ := msg.Time()
+		key := p.server.Session.ISupport.FoldName(peer)
+		if i, ok := peers[key]; ok {
+			targets[i].latest = latest
+		} else {
+			peers[key] = len(targets)
+			targets = append(targets, target{peer, latest})
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].latest.Before(targets[j].latest)
+	})
+	if len(targets) > limit {
+		targets = targets[len(targets)-limit:]
+	}
+
+	var batch *irc.Batch
+	if p.client.Session.Caps.Enabled.Has("batch") {
+		batch = p.newBatch("draft/chathistory-targets")
+		if p.sendClient(batch.Start()) != nil {
+			return
+		}
+	}
+	for _, t := range targets {
+		msg := &irc.Message{
+			Prefix:  p.serverPrefix,
+			Command: "CHATHISTORY",
+			Params:  []string{"TARGETS", t.name, irc.FormatServerTime(t.latest)},
+		}
+		if batch != nil {
+			msg = batch.Add(msg)
+		}
+		if p.sendClient(msg) != nil {
+			return
+		}
+	}
+	if batch != nil {
+		p.sendClient(batch.End())
+	}
+}
+
+// Return the channels we're in, in order. The client may not have (re)joined
+// all of them yet.
+func (p *Proxy) serverChannels() []string {
+	channels := p.server.Session.ChannelsWithUser(p.server.Session.ClientID.Nick)
+	sort.Strings(channels)
+	return channels
+}
+
+// A buffer of the emulated *playback module: a channel, or the private
+// messages from a nick.
+type playbackBuffer struct {
+	name string
+	msgs []*irc.Message // The PRIVMSGs and NOTICEs selected, oldest first.
+}
+
+// Answer `text`, a command sent to the *playback module of ZNC, which we
+// emulate for clients with built-in support for it. These ask for the
+// znc.in/playback capability, so that we don't replay messages automatically
+// (see replayLog), and then PLAY those they missed. The buffers are the
+// histories of the channels we're in, and the private messages in our log,
+// grouped by the other party (see pmPeer).
+func (p *Proxy) handlePlayback(text string) {
+	reply := func(text string) {
+		p.sendClient(&irc.Message{
+			Prefix:  playbackPrefix,
+			Command: "PRIVMSG",
+			Params:  []string{p.client.Session.ClientID.Nick, text},
+		})
+	}
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		args = []string{"HELP"}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PLAY":
+		if len(args) < 2 || len(args) > 4 {
+			reply("Usage: PLAY <buffer(s)> [<from> [<to>]]")
+			return
+		}
+		// The times are in seconds since the epoch, and exclusive:
+		var from, to time.Time
+		var ok bool
+		if len(args) > 2 {
+			if from, ok = parsePlaybackTime(args[2]); !ok {
+				reply("Invalid time: " + args[2])
+				return
+			}
+		}
+		if len(args) > 3 {
+			if to, ok = parsePlaybackTime(args[3]); !ok {
+				reply("Invalid time: " + args[3])
+				return
+			}
+		}
+		for _, buffer := range p.playbackBuffers(args[1], from, to) {
+			for i, msg := range buffer.msgs {
+				buffer.msgs[i] = p.replayedMessage(msg)
+			}
+			p.sendHistory(buffer.name, buffer.msgs)
+		}
+	case "LIST":
+		pattern := "*"
+		if len(args) > 1 {
+			pattern = args[1]
+		}
+		buffers := p.playbackBuffers(pattern, time.Time{}, time.Time{})
+		if len(buffers) == 0 {
+			reply("No matching buffers.")
+		}
+		for _, buffer := range buffers {
+			latest, _ := buffer.msgs[len(buffer.msgs)-1].Time()
+			reply(buffer.name + " " + formatPlaybackTime(latest))
+		}
+	case "CLEAR":
+		if len(args) != 2 {
+			reply("Usage: CLEAR <buffer(s)>")
+			return
+		}
+		// All we can do is mark the logs read, which a client using
+		// *playback has seen to already anyway; the history is kept.
+		buffers := p.playbackBuffers(args[1], time.Time{}, time.Time{})
+		for _, buffer := range buffers {
+			name := buffer.name
+			if !p.server.Session.ISupport.IsChannel(name) {
+				// Private messages all share our log.
+				name = p.server.Session.ClientID.Nick
+			}
+			if chLog, err := p.channelLog(name); err == nil {
+				chLog.Clear()
+			}
+		}
+		reply(fmt.Sprintf("Marked %d buffer(s) read; their history is kept.", len(buffers)))
+	default:
+		reply("Commands: PLAY <buffer(s)> [<from> [<to>]], LIST [<buffer(s)>], CLEAR <buffer(s)>. " +
+			"Buffers are comma-separated, and may contain wildcards; times are in seconds since the epoch.")
+	}
+}
+
+// Return the buffers matching `patterns`, a comma-separated list of names,
+// which may contain wildcards, with their messages between `from` and `to`
+// (either of which may be zero, for no limit). Buffers with no messages are
+// left out.
+func (p *Proxy) playbackBuffers(patterns string, from, to time.Time) []playbackBuffer {
+	isupport := p.server.Session.ISupport
+	var matchers []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, ",") {
+		re, err := regexp.Compile("^(?:" + mask.ToFoldedRegexp(pattern, isupport.CaseMapping()) + ")$")
+		if err == nil {
+			matchers = append(matchers, re)
+		}
+	}
+	matches := func(name string) bool {
+		for _, re := range matchers {
+			if re.MatchString(isupport.FoldName(name)) {
+				return true
+			}
+		}
+		return false
+	}
+	history := func(name string) []*irc.Message {
+		chLog, err := p.channelLog(name)
+		if err != nil {
+			p.logger.Errorf("Failed to get log for %q: %q.\n", name, err)
+			return nil
+		}
+		msgs, err := chatHistory(chLog, storage.HistoryQuery{
+			After:  storage.Anchor{Time: from},
+			Before: storage.Anchor{Time: to},
+			Limit:  maxPlayback,
+			Latest: true,
+		}, nil)
+		if err != nil {
+			p.logger.Errorf("Failed to get history for %q: %q.\n", name, err)
+		}
+		return msgs
+	}
+
+	// Clients may PLAY before rejoining the channels, so we go by the
+	// channels we're in, rather than those the client knows about:
+	var buffers []playbackBuffer
+	for _, channelName := range p.serverChannels() {
+		if !matches(channelName) {
+			continue
+		}
+		if msgs := history(channelName); len(msgs) != 0 {
+			buffers = append(buffers, playbackBuffer{channelName, msgs})
+		}
+	}
+
+	byPeer := map[string]*playbackBuffer{}
+	var peers []string
+	for _, msg := range history(p.server.Session.ClientID.Nick) {
+		peer, ok := p.pmPeer(msg)
+		if !ok || !matches(peer) {
+			continue
+		}
+		key := isupport.FoldName(peer)
+		if byPeer[key] == nil {
+			byPeer[key] = &playbackBuffer{name: peer}
+			peers = append(peers, key)
+		}
+		byPeer[key].msgs = append(byPeer[key].msgs, msg)
+	}
+	sort.Strings(peers)
+	for _, key := range peers {
+		buffers = append(buffers, *byPeer[key])
+	}
+	return buffers
+}
+
+// Parse a time given to *playback's PLAY, in seconds since the epoch.
+func parsePlaybackTime(s string) (t time.Time, ok bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	// Time tags only go to the millisecond, so we round to that, lest we
+	// play back the message a client gave the time of:
+	millis := int64(math.Round(seconds * 1e3))
+	return time.Unix(millis/1e3, millis%1e3*1e6).UTC(), true
+}
+
+// Format `t` as *playback does, in seconds since the epoch.
+func formatPlaybackTime(t time.Time) string {
+	return fmt.Sprintf("%d.%03d", t.Unix(), t.Nanosecond()/1e6)
+}
+
+// Return `msg`, ready to be logged: with a time tag, saying when it was sent,
+// and a msgid tag, by which CHATHISTORY commands can refer to it, but without
+// a batch tag. If `msg` needs no changes, it is returned as is; otherwise a
+// copy is.
+func (p *Proxy) stamp(msg *irc.Message) *irc.Message {
+	_, haveTime := msg.Time()
+	_, haveID := msg.Tags["msgid"]
+	_, inBatch := msg.BatchRef()
+	if haveTime && haveID && !inBatch {
+		return msg
+	}
+	stamped := *msg
+	stamped.Tags = map[string]string{}
+	for name, value := range msg.Tags {
+		stamped.Tags[name] = value
+	}
+	if !haveTime {
+		// The server didn't say when this happened (it may not support
+		// server-time), so record when we received it:
+		stamped.Tags["time"] = irc.FormatServerTime(now())
+	}
+	if !haveID {
+		// The time keeps these unique across restarts:
+		p.msgIDCount++
+		stamped.Tags["msgid"] = fmt.Sprintf("idler-%x-%d", now().UnixNano(), p.msgIDCount)
+	}
+	// The batch will be long gone by the time this is replayed:
+	delete(stamped.Tags, "batch")
+	return &stamped
+}
+
+// Add `msg`, a PRIVMSG or NOTICE which the client has seen, to the history
+// of the channel it was sent to. Private messages, to us or from us, go in
+// the log of our own nick, along with those we logged while the client was
+// away; see pmPeer.
+func (p *Proxy) recordHistory(msg *irc.Message) {
+	isupport := p.server.Session.ISupport
+	myNick := p.server.Session.ClientID.Nick
+	logName, isChannel := isupport.ChannelTarget(msg.Params[0])
+	if !isChannel {
+		clientID, err := irc.ParseClientID(msg.Prefix)
+		fromUs := err == nil && isupport.EqualNames(clientID.Nick, myNick)
+		if !fromUs && !isupport.EqualNames(msg.Params[0], myNick) {
+			// e.g. a server notice to "$*"; not part of any
+			// conversation of ours.
+			return
+		}
+		logName = myNick
+	}
+	chLog, err := p.channelLog(logName)
 	if err != nil {
+		p.logger.Errorf("Failed to get log for %q: %q.\n", logName, err)
+		return
+	}
+	// Log it, and if the client is in the channel, mark it read along
+	// with anything before it; anything unread would have been replayed
+	// when the client joined (or, for private messages, registered). The
+	// client may also send to a channel it hasn't rejoined yet, in which
+	// case the backlog is still unread.
+	if err := chLog.LogMessage(msg); err != nil {
 		p.logger.Errorf("Failed log message %q: %q.\n", msg, err)
+	} else if !isChannel || p.client.Session.HaveChannel(logName) {
+		if err := chLog.Clear(); err != nil {
+			p.logger.Errorf("Failed to mark log for %q read: %q.\n", logName, err)
+		}
+	}
+}
+
+// Return the nick of the other party to `msg`, a private message from the log
+// of our own nick: whoever we sent it to, or whoever sent it to us.
+func (p *Proxy) pmPeer(msg *irc.Message) (string, bool) {
+	if !p.server.Session.ISupport.EqualNames(msg.Params[0], p.server.Session.ClientID.Nick) {
+		return msg.Params[0], true
+	}
+	clientID, err := irc.ParseClientID(msg.Prefix)
+	if err != nil {
+		return "", false
+	}
+	return clientID.Nick, true
+}
+
+// Adjust `msg`, from a log, for replaying to the client. Unless the client
+// has enabled server-time (and so will see the time tag), we add the time to
+// the text of PRIVMSGs and NOTICEs, per the config.
+func (p *Proxy) replayedMessage(msg *irc.Message) *irc.Message {
+	if p.config.DisableReplayTimestamps || p.client.Session.Caps.Enabled.Has("server-time") {
+		return msg
+	}
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) != 2 {
+		return msg
+	}
+	when, ok := msg.Time()
+	if !ok {
+		return msg
+	}
+	format := p.config.ReplayTimeFormat
+	if format == "" {
+		format = DefaultReplayTimeFormat
+	}
+	stamp := when.Local().Format(format)
+
+	text := msg.Params[1]
+	if ctcpMsg, ok := ctcp.Decode(text); ok {
+		if ctcpMsg.Command != "ACTION" {
+			// Anything else would stop making sense.
+			return msg
+		}
+		ctcpMsg.Params = stamp + " " + ctcpMsg.Params
+		text = ctcpMsg.Encode()
+	} else {
+		text = stamp + " " + text
+	}
+	replayed := *msg
+	replayed.Params = []string{msg.Params[0], text}
+	if replayed.CheckWritable() != nil {
+		// The stamp made it too long; better to send it without.
+		return msg
+	}
+	return &replayed
+}
+
+// Log the message `msg`, of which `cmd` is the parsed form, in the logs of
+// the channels it applies to. NICK and QUIT messages don't say which channels
+// those are, so the caller must supply them as `channels`. Note that not all
+// message types are logged.
+func (p *Proxy) logMessage(msg *irc.Message, cmd irc.Command, channels ...string) {
+	p.logger.Debugf("logMessage(%q)\n", msg)
+
+	switch cmd := cmd.(type) {
+	case *irc.Privmsg:
+		channelName := cmd.Target
+		// Messages to e.g. "@#channel" belong in #channel's log:
+		if name, ok := p.server.Session.ISupport.ChannelTarget(channelName); ok {
+			channelName = name
+		}
+		channels = []string{channelName}
+	case *irc.Join:
+		channels = cmd.Channels
+	case *irc.Part:
+		channels = cmd.Channels
+	case *irc.Kick:
+		channels = []string{cmd.Channel}
+	case *irc.Mode:
+		if !p.server.Session.ISupport.IsChannel(cmd.Target) {
+			return
+		}
+		channels = []string{cmd.Target}
+	case *irc.Nick:
+		if p.server.Session.ISupport.EqualNames(cmd.Nick, p.server.Session.ClientID.Nick) {
+			// Our own nick change; the client will learn our new nick
+			// when it reconnects, so there's no need to replay this.
+			return
+		}
+	case *irc.Quit:
+	default:
+		// Don't log anything we don't specificially whitelist above.
+		return
+	}
+
+	msg = p.stamp(msg)
+	for _, channelName := range channels {
+		chLog, err := p.channelLog(channelName)
+		if err != nil {
+			p.logger.Errorf("Failed to get log for %q: %q.\n", channelName, err)
+			continue
+		}
+		err = chLog.LogMessage(msg)
+		if err != nil {
+			p.logger.Errorf("Failed log message %q: %q.\n", msg, err)
+		}
 	}
 }
@@ -1,31 +1,58 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 	"zenhack.net/go/irc-idler/irc"
 )
 
-var (
-	motd = ExpectMany{
+func motd(nick string) ProxyAction {
+	return ExpectMany{
 		ForwardS2C(&irc.Message{
 			Command: irc.RPL_MOTDSTART,
-			Params:  []string{"motd for test server"},
+			Params:  []string{nick, "motd for test server"},
 		}),
 		ForwardS2C(&irc.Message{
 			Command: irc.RPL_MOTD,
-			Params:  []string{"Hello, World"},
+			Params:  []string{nick, "Hello, World"},
 		}),
 		ForwardS2C(&irc.Message{
 			Command: irc.RPL_ENDOFMOTD,
-			Params:  []string{"End MOTD."},
+			Params:  []string{nick, "End MOTD."},
 		}),
 	}
-)
+}
+
+// Connect to the server, and expect the proxy to start capability
+// negotiation.
+func connectServer() ProxyAction {
+	return ExpectMany{
+		Connect(Server),
+		ToServer(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}}),
+	}
+}
+
+// Capability negotiation, with a server that supports only server-time.
+var capNegotiation = ExpectMany{
+	FromServer(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"*", "LS", "server-time sasl=PLAIN"},
+	}),
+	ToServer(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time"}}),
+	FromServer(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"*", "ACK", "server-time"},
+	}),
+	ToServer(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+}
 
 func initialConnect(nick string) ProxyAction {
 	return ExpectMany{
 		Connect(Client),
-		Connect(Server),
+		connectServer(),
+		capNegotiation,
 		ForwardC2S(&irc.Message{Command: "NICK", Params: []string{nick}}),
 		ForwardC2S(&irc.Message{Command: "USER", Params: []string{nick, "0", "*", "Alice"}}),
 		ForwardS2C(&irc.Message{
@@ -33,7 +60,7 @@ func initialConnect(nick string) ProxyAction {
 			Params:  []string{nick, "Welcome to a mock irc server alice"},
 		}),
 		ManyMsg(ForwardS2C, welcomeSequence(nick)),
-		motd,
+		motd(nick),
 	}
 }
 
@@ -64,31 +91,76 @@ func welcomeSequence(nick string) []*irc.Message {
 }
 
 func reconnect(nick string) ProxyAction {
+	return reconnectISupport(nick)
+}
+
+// Like reconnect, but expect the proxy to replay the RPL_ISUPPORT messages
+// `isupport` as part of the welcome sequence.
+func reconnectISupport(nick string, isupport ...*irc.Message) ProxyAction {
+	return ExpectMany{
+		Connect(Client),
+		FromClient(&irc.Message{Command: "NICK", Params: []string{nick}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{nick, "0", "*", "Alice"}}),
+		ToClient(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{nick, "Welcome back to IRC Idler, " + nick},
+		}),
+		ManyMsg(ToClient, welcomeSequence(nick)),
+		ManyMsg(ToClient, isupport),
+		ToServer(&irc.Message{Command: "MOTD"}),
+		motd(nick),
+	}
+}
+
+// Like reconnect, but the client first requests the capabilities `caps`, a
+// space-separated list, which we should acknowledge.
+func reconnectCaps(nick, caps string) ProxyAction {
 	return ExpectMany{
 		Connect(Client),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", caps}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "ACK", caps}}),
 		FromClient(&irc.Message{Command: "NICK", Params: []string{nick}}),
 		FromClient(&irc.Message{Command: "USER", Params: []string{nick, "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
 		ToClient(&irc.Message{
 			Command: irc.RPL_WELCOME,
 			Params:  []string{nick, "Welcome back to IRC Idler, " + nick},
 		}),
 		ManyMsg(ToClient, welcomeSequence(nick)),
 		ToServer(&irc.Message{Command: "MOTD"}),
-		motd,
+		motd(nick),
 	}
 }
 
+// Return `msg`, a PRIVMSG or NOTICE, as replayed from the log to a client
+// that hasn't enabled server-time, having been logged at testTime.
+func replayed(msg *irc.Message) *irc.Message {
+	ret := *msg
+	ret.Params = []string{msg.Params[0], replayedText(msg.Params[1])}
+	return &ret
+}
+
+// Return `text` as replayed by replayed.
+func replayedText(text string) string {
+	return testTime.Local().Format(DefaultReplayTimeFormat) + " " + text
+}
+
 func joinSeq(forward bool, nick string) ProxyAction {
+	return joinChannelSeq(forward, nick, "#sandstorm")
+}
+
+// Like joinSeq, but for a channel spelled `channel`.
+func joinChannelSeq(forward bool, nick, channel string) ProxyAction {
 	var (
 		namerepliesAction ProxyAction
 		convert           func(*irc.Message) ProxyAction
 	)
 	namereplyMsgs := []*irc.Message{
 		{Command: irc.RPL_NAMEREPLY, Params: []string{
-			nick, "=", "#sandstorm", nick,
+			nick, "=", channel, nick,
 		}},
 		{Command: irc.RPL_NAMEREPLY, Params: []string{
-			nick, "=", "#sandstorm", "bob",
+			nick, "=", channel, "bob",
 		}},
 	}
 	if forward {
@@ -99,13 +171,13 @@ func joinSeq(forward bool, nick string) ProxyAction {
 		namerepliesAction = UnorderedTo(Client, namereplyMsgs)
 	}
 	return ExpectMany{
-		convert(&irc.Message{Prefix: nick, Command: "JOIN", Params: []string{"#sandstorm"}}),
+		convert(&irc.Message{Prefix: nick, Command: "JOIN", Params: []string{channel}}),
 		convert(&irc.Message{Command: irc.RPL_TOPIC, Params: []string{
-			nick, "#sandstorm", "Welcome to #sandstorm!",
+			nick, channel, "Welcome to #sandstorm!",
 		}}),
 		namerepliesAction,
 		convert(&irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{
-			nick, "#sandstorm", "End of NAMES list",
+			nick, channel, "End of NAMES list",
 		}}),
 	}
 }
@@ -113,7 +185,7 @@ func joinSeq(forward bool, nick string) ProxyAction {
 func TestConnectDisconnect(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		Connect(Client),
-		Connect(Server),
+		connectServer(),
 		Disconnect(Client),
 		// Handshake isn't done:
 		Drop(Server),
@@ -124,11 +196,13 @@ func TestConnectDisconnect(t *testing.T) {
 func TestNickInUse(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		Connect(Client),
-		Connect(Server),
+		connectServer(),
 		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
 		ToServer(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
-		FromServer(&irc.Message{Command: irc.ERR_NICKNAMEINUSE}),
-		ToClient(&irc.Message{Command: irc.ERR_NICKNAMEINUSE}),
+		ForwardS2C(&irc.Message{
+			Command: irc.ERR_NICKNAMEINUSE,
+			Params:  []string{"*", "alice", "Nickname is already in use"},
+		}),
 	})
 }
 
@@ -156,6 +230,54 @@ func TestChannelRejoinNoBackLog(t *testing.T) {
 	})
 }
 
+// Channel names are case insensitive, so a rejoin with a different spelling
+// should still get the logs.
+func TestChannelRejoinCaseInsensitive(t *testing.T) {
+	privmsg := &irc.Message{
+		Prefix:  "bob",
+		Command: "PRIVMSG",
+		Params:  []string{"#SandStorm", "Hello, Alice"},
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		FromServer(privmsg),
+		reconnect("alice"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#SANDSTORM"}}),
+		joinChannelSeq(false, "alice", "#SANDSTORM"),
+		ToClient(replayed(privmsg)),
+	})
+}
+
+// Sending to a channel before rejoining it shouldn't mark the backlog read.
+func TestSendBeforeRejoin(t *testing.T) {
+	privmsg := &irc.Message{
+		Prefix:  "bob",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "Hello, Alice"},
+	}
+	reply := &irc.Message{Command: "PRIVMSG", Params: []string{"#sandstorm", "Hi, Bob"}}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		FromServer(privmsg),
+		reconnect("alice"),
+		ForwardC2S(reply),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		ToClient(replayed(privmsg)),
+		ToClient(replayed(&irc.Message{
+			Prefix:  "alice",
+			Command: "PRIVMSG",
+			Params:  reply.Params,
+		})),
+	})
+}
+
 func TestChangeNickRejoin(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		initialConnect("alice"),
@@ -170,6 +292,86 @@ func TestChangeNickRejoin(t *testing.T) {
 	})
 }
 
+// NICK and QUIT messages don't name a channel, but should still be replayed
+// in the channels the user was in.
+func TestNickQuitRejoin(t *testing.T) {
+	nick := &irc.Message{Prefix: "bob", Command: "NICK", Params: []string{"bobby"}}
+	quit := &irc.Message{Prefix: "bobby", Command: "QUIT", Params: []string{"Bye"}}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		FromServer(nick),
+		FromServer(quit),
+		reconnect("alice"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		ToClient(nick),
+		ToClient(quit),
+	})
+}
+
+// Channel privileges should survive a rejoin, including changes made while
+// the client was away. The client hasn't enabled multi-prefix, so it should
+// only ever see the highest prefix.
+func TestPrefixesRejoin(t *testing.T) {
+	mode := &irc.Message{Prefix: "carol", Command: "MODE", Params: []string{"#sandstorm", "-o", "bob"}}
+	endOfNames := &irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{
+		"alice", "#sandstorm", "End of NAMES list",
+	}}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		ForwardS2C(&irc.Message{Prefix: "alice", Command: "JOIN", Params: []string{"#sandstorm"}}),
+		FromServer(&irc.Message{Command: irc.RPL_NAMEREPLY, Params: []string{
+			"alice", "=", "#sandstorm", "alice @+bob",
+		}}),
+		ToClient(&irc.Message{Command: irc.RPL_NAMEREPLY, Params: []string{
+			"alice", "=", "#sandstorm", "alice @bob",
+		}}),
+		ForwardS2C(endOfNames),
+		Disconnect(Client),
+		FromServer(mode),
+		reconnect("alice"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		ToClient(&irc.Message{Prefix: "alice", Command: "JOIN", Params: []string{"#sandstorm"}}),
+		UnorderedTo(Client, []*irc.Message{
+			{Command: irc.RPL_NAMEREPLY, Params: []string{"alice", "=", "#sandstorm", "alice"}},
+			{Command: irc.RPL_NAMEREPLY, Params: []string{"alice", "=", "#sandstorm", "@bob"}},
+		}),
+		ToClient(endOfNames),
+		ToClient(mode),
+	})
+}
+
+// Nicks are case insensitive, so a mode change spelling one differently
+// still applies to the user, who keeps the spelling from the NAMES reply.
+func TestPrefixesCaseInsensitive(t *testing.T) {
+	endOfNames := &irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{
+		"alice", "#sandstorm", "End of NAMES list",
+	}}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		ForwardS2C(&irc.Message{Prefix: "alice", Command: "JOIN", Params: []string{"#sandstorm"}}),
+		ForwardS2C(&irc.Message{Command: irc.RPL_NAMEREPLY, Params: []string{
+			"alice", "=", "#sandstorm", "alice +bob",
+		}}),
+		ForwardS2C(endOfNames),
+		ForwardS2C(&irc.Message{Prefix: "carol", Command: "MODE", Params: []string{"#sandstorm", "+o", "BOB"}}),
+		Disconnect(Client),
+		reconnect("alice"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		ToClient(&irc.Message{Prefix: "alice", Command: "JOIN", Params: []string{"#sandstorm"}}),
+		UnorderedTo(Client, []*irc.Message{
+			{Command: irc.RPL_NAMEREPLY, Params: []string{"alice", "=", "#sandstorm", "alice"}},
+			{Command: irc.RPL_NAMEREPLY, Params: []string{"alice", "=", "#sandstorm", "@bob"}},
+		}),
+		ToClient(endOfNames),
+	})
+}
+
 func TestClientPingDrop(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		initialConnect("alice"),
@@ -185,3 +387,759 @@ func TestClientPingDrop(t *testing.T) {
 		ToServer(&irc.Message{Command: "PING", Params: []string{"irc-idler"}}),
 	})
 }
+
+// A server that doesn't understand CAP should still let us log in, and the
+// client shouldn't hear about the error.
+func TestNoCapServer(t *testing.T) {
+	TraceTest(t, ExpectMany{
+		Connect(Client),
+		connectServer(),
+		FromServer(&irc.Message{
+			Command: irc.ERR_UNKNOWNCOMMAND,
+			Params:  []string{"*", "CAP", "Unknown command"},
+		}),
+		ForwardC2S(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		ForwardC2S(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		ForwardS2C(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice"},
+		}),
+	})
+}
+
+// Our reply to a client's CAP LS.
+var clientCapLS = &irc.Message{
+	Command: "CAP",
+	Params: []string{
+		"*", "LS", "batch draft/chathistory echo-message message-tags multi-prefix server-time userhost-in-names znc.in/playback",
+	},
+}
+
+// Tags enabled by our capabilities shouldn't leak through to the client,
+// which hasn't negotiated them. The client's own CAP LS should be answered
+// by us rather than forwarded, and its registration held back until it's
+// done negotiating.
+func TestCapsNotForwarded(t *testing.T) {
+	TraceTest(t, ExpectMany{
+		Connect(Client),
+		connectServer(),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}}),
+		ToClient(clientCapLS),
+		capNegotiation,
+		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ToServer(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		ToServer(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromServer(&irc.Message{
+			Tags:    map[string]string{"time": "2016-10-01T12:00:00.000Z"},
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice"},
+		}),
+		ToClient(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice"},
+		}),
+		ManyMsg(ForwardS2C, welcomeSequence("alice")),
+		motd("alice"),
+	})
+}
+
+// Clients can enable the capabilities we offer, both while registering and
+// after reconnecting, and get the behavior they asked for.
+func TestClientCaps(t *testing.T) {
+	privmsg := &irc.Message{Command: "PRIVMSG", Params: []string{"#sandstorm", "hi"}}
+	timeTag := map[string]string{"time": "2016-10-01T12:00:00.000Z"}
+	TraceTest(t, ExpectMany{
+		Connect(Client),
+		connectServer(),
+		capNegotiation,
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}}),
+		ToClient(clientCapLS),
+		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time account-tag"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "NAK", "server-time account-tag"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time echo-message"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "ACK", "server-time echo-message"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ToServer(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		ToServer(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromServer(&irc.Message{
+			Tags:    timeTag,
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice!alice@example.com"},
+		}),
+		ToClient(&irc.Message{
+			Tags:    timeTag,
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice!alice@example.com"},
+		}),
+		ManyMsg(ForwardS2C, welcomeSequence("alice")),
+		motd("alice"),
+
+		// Other tags are still dropped:
+		FromServer(&irc.Message{
+			Tags:    map[string]string{"time": timeTag["time"], "account": "bob"},
+			Prefix:  "bob!bob@example.com",
+			Command: "PRIVMSG",
+			Params:  []string{"alice", "hello"},
+		}),
+		ToClient(&irc.Message{
+			Tags:    timeTag,
+			Prefix:  "bob!bob@example.com",
+			Command: "PRIVMSG",
+			Params:  []string{"alice", "hello"},
+		}),
+
+		FromClient(privmsg),
+		ToServer(privmsg),
+		ToClient(&irc.Message{
+			Tags:    map[string]string{"time": irc.FormatServerTime(testTime)},
+			Prefix:  "alice!alice@example.com",
+			Command: "PRIVMSG",
+			Params:  privmsg.Params,
+		}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"LIST"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"alice", "LIST", "echo-message server-time"}}),
+
+		// A new client starts from scratch:
+		Disconnect(Client),
+		Connect(Client),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}}),
+		ToClient(clientCapLS),
+		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", "multi-prefix"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "ACK", "multi-prefix"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ToClient(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome back to IRC Idler, alice!alice@example.com"},
+		}),
+		ManyMsg(ToClient, welcomeSequence("alice")),
+		ToServer(&irc.Message{Command: "MOTD"}),
+		motd("alice"),
+		FromClient(privmsg),
+		ToServer(privmsg),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"LIST"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"alice", "LIST", "multi-prefix"}}),
+	})
+}
+
+// If the server supports message-tags, clients which have negotiated it with
+// us can send client-only tags and TAGMSGs through us, and receive them.
+func TestMessageTags(t *testing.T) {
+	typing := map[string]string{"+typing": "active"}
+	tagmsg := &irc.Message{Tags: typing, Command: "TAGMSG", Params: []string{"#sandstorm"}}
+	reply := &irc.Message{
+		Tags:    map[string]string{"+draft/reply": "abc"},
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "hi"},
+	}
+	TraceTest(t, ExpectMany{
+		Connect(Client),
+		connectServer(),
+		FromServer(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"*", "LS", "message-tags server-time"},
+		}),
+		ToServer(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time message-tags"}}),
+		FromServer(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"*", "ACK", "server-time message-tags"},
+		}),
+		ToServer(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", "message-tags echo-message"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "ACK", "message-tags echo-message"}}),
+		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ToServer(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		ToServer(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		ForwardS2C(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome to a mock irc server alice"},
+		}),
+		ManyMsg(ForwardS2C, welcomeSequence("alice")),
+		motd("alice"),
+
+		FromClient(tagmsg),
+		ToServer(tagmsg),
+		ToClient(&irc.Message{
+			Tags:    typing,
+			Prefix:  "alice",
+			Command: "TAGMSG",
+			Params:  tagmsg.Params,
+		}),
+		ForwardS2C(&irc.Message{
+			Tags:    typing,
+			Prefix:  "bob!bob@example.com",
+			Command: "TAGMSG",
+			Params:  []string{"#sandstorm"},
+		}),
+		FromClient(reply),
+		ToServer(reply),
+		ToClient(&irc.Message{
+			Tags: map[string]string{
+				"msgid": "idler-147966a240e48000-1",
+				"time":  "2016-10-01T12:00:00.000Z",
+			},
+			Prefix:  "alice",
+			Command: "PRIVMSG",
+			Params:  reply.Params,
+		}),
+
+		// Tags survive the commands we rebuild from their parsed
+		// forms, too:
+		FromClient(&irc.Message{
+			Tags:    map[string]string{"+example.com/note": "hi"},
+			Command: "JOIN",
+			Params:  []string{"#other"},
+		}),
+		ToServer(&irc.Message{
+			Tags:    map[string]string{"+example.com/note": "hi"},
+			Command: "JOIN",
+			Params:  []string{"#other"},
+		}),
+		ForwardS2C(&irc.Message{Prefix: "alice", Command: "JOIN", Params: []string{"#other"}}),
+		ForwardS2C(&irc.Message{
+			Tags:    map[string]string{"msgid": "names1"},
+			Command: irc.RPL_NAMEREPLY,
+			Params:  []string{"alice", "=", "#other", "alice"},
+		}),
+
+		// A client without message-tags doesn't see TAGMSGs, and
+		// they aren't logged for later:
+		Disconnect(Client),
+		FromServer(&irc.Message{
+			Tags:    typing,
+			Prefix:  "bob!bob@example.com",
+			Command: "TAGMSG",
+			Params:  []string{"alice"},
+		}),
+		reconnect("alice"),
+		FromServer(&irc.Message{
+			Tags:    typing,
+			Prefix:  "bob!bob@example.com",
+			Command: "TAGMSG",
+			Params:  []string{"alice"},
+		}),
+		ForwardS2C(&irc.Message{
+			Prefix:  "bob!bob@example.com",
+			Command: "PRIVMSG",
+			Params:  []string{"alice", "hello"},
+		}),
+	})
+}
+
+// Replayed messages should say when they were received: via the time tag for
+// clients which have enabled server-time, and otherwise in the text.
+func TestReplayTimestamps(t *testing.T) {
+	// The server says when this was sent:
+	tagged := &irc.Message{
+		Tags:    map[string]string{"time": "2016-10-01T09:30:00.000Z"},
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "hello"},
+	}
+	// ...but not this, so we note when we got it, at testTime:
+	action := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "\x01ACTION waves\x01"},
+	}
+	taggedAction := *action
+	taggedAction.Tags = map[string]string{"time": irc.FormatServerTime(testTime)}
+
+	when, _ := tagged.Time()
+	stamp := when.Local().Format(DefaultReplayTimeFormat)
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		Disconnect(Client),
+		FromServer(tagged),
+		FromServer(action),
+		reconnect("alice"),
+		ToClient(&irc.Message{
+			Prefix:  tagged.Prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"alice", stamp + " hello"},
+		}),
+		ToClient(&irc.Message{
+			Prefix:  action.Prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"alice", "\x01ACTION " + replayedText("waves\x01")},
+		}),
+
+		Disconnect(Client),
+		FromServer(tagged),
+		FromServer(action),
+		Connect(Client),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time"}}),
+		ToClient(&irc.Message{Command: "CAP", Params: []string{"*", "ACK", "server-time"}}),
+		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+		FromClient(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice"}}),
+		FromClient(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ToClient(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"alice", "Welcome back to IRC Idler, alice"},
+		}),
+		ManyMsg(ToClient, welcomeSequence("alice")),
+		ToServer(&irc.Message{Command: "MOTD"}),
+		motd("alice"),
+		ToClient(tagged),
+		ToClient(&taggedAction),
+	})
+}
+
+// Timestamps in the text can be turned off.
+func TestReplayTimestampsDisabled(t *testing.T) {
+	privmsg := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "hello"},
+	}
+	TraceTestConfig(t, &Config{DisableReplayTimestamps: true}, ExpectMany{
+		initialConnect("alice"),
+		Disconnect(Client),
+		FromServer(privmsg),
+		reconnect("alice"),
+		ToClient(privmsg),
+	})
+}
+
+// Return `msg` tagged as part of the batch with the reference tag `ref`.
+func inBatch(ref string, msg *irc.Message) *irc.Message {
+	return (&irc.Batch{Ref: ref}).Add(msg)
+}
+
+// Clients which enable batch should get channel replays in chathistory
+// batches, and netsplits in netsplit and netjoin batches, whether or not the
+// server sends those itself.
+func TestBatches(t *testing.T) {
+	privmsg := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "hi"},
+	}
+	split := "hub.example.net leaf.example.net"
+	quit := func(nick string) *irc.Message {
+		return &irc.Message{
+			Prefix:  nick + "!" + nick + "@example.com",
+			Command: "QUIT",
+			Params:  []string{split},
+		}
+	}
+	join := func(nick string) *irc.Message {
+		return &irc.Message{
+			Prefix:  nick + "!" + nick + "@example.com",
+			Command: "JOIN",
+			Params:  []string{"#sandstorm"},
+		}
+	}
+	splitBatch := func(ref, batchType string) *irc.Message {
+		return (&irc.Batch{
+			Ref:    ref,
+			Type:   batchType,
+			Params: []string{"hub.example.net", "leaf.example.net"},
+		}).Start()
+	}
+	endBatch := func(ref string) *irc.Message {
+		return (&irc.Batch{Ref: ref}).End()
+	}
+
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+
+		// Clients which haven't enabled batch see netsplits as they
+		// come:
+		ForwardS2C(quit("bob")),
+		ForwardS2C(join("bob")),
+
+		Disconnect(Client),
+		FromServer(privmsg),
+		reconnectCaps("alice", "batch"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		ToClient((&irc.Batch{
+			Ref:    "idler1",
+			Type:   irc.BatchChatHistory,
+			Params: []string{"#sandstorm"},
+		}).Start()),
+		ToClient(inBatch("idler1", replayed(privmsg))),
+		ToClient(endBatch("idler1")),
+
+		// A netsplit batch is closed by the next unrelated message...
+		FromServer(quit("bob")),
+		ToClient(splitBatch("idler2", irc.BatchNetsplit)),
+		ToClient(inBatch("idler2", quit("bob"))),
+		FromServer(quit("carol")),
+		ToClient(inBatch("idler2", quit("carol"))),
+		FromServer(privmsg),
+		ToClient(endBatch("idler2")),
+		ToClient(privmsg),
+
+		// ...or if nothing else comes along. Only those who were lost in
+		// the split come back in the netjoin:
+		FromServer(join("carol")),
+		ToClient(splitBatch("idler3", irc.BatchNetjoin)),
+		ToClient(inBatch("idler3", join("carol"))),
+		FromServer(join("bob")),
+		ToClient(inBatch("idler3", join("bob"))),
+		ToClient(endBatch("idler3")),
+		ForwardS2C(join("dave")),
+
+		// Batches from the server are passed through:
+		ForwardS2C(&irc.Message{Command: "BATCH", Params: []string{"+abc", "netsplit", "a.example.net", "b.example.net"}}),
+		ForwardS2C(inBatch("abc", quit("dave"))),
+		ForwardS2C(&irc.Message{Command: "BATCH", Params: []string{"-abc"}}),
+
+		// ...except to clients which haven't enabled batch, and those
+		// which missed the start of the batch:
+		FromServer(&irc.Message{Command: "BATCH", Params: []string{"+def", "netsplit", "a.example.net", "b.example.net"}}),
+		Disconnect(Client),
+		reconnect("alice"),
+		FromServer(inBatch("def", quit("bob"))),
+		ToClient(quit("bob")),
+		FromServer(&irc.Message{Command: "BATCH", Params: []string{"-def"}}),
+		ForwardS2C(join("bob")),
+	})
+}
+
+// Users lost in a netsplit are only remembered for a while; after that, their
+// JOINs aren't put in a netjoin batch.
+func TestNetsplitExpiry(t *testing.T) {
+	defer func(d time.Duration) { splitUserTime = d }(splitUserTime)
+	splitUserTime = -time.Second // Everything has expired.
+
+	quit := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "QUIT",
+		Params:  []string{"hub.example.net leaf.example.net"},
+	}
+	join := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "JOIN",
+		Params:  []string{"#sandstorm"},
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		reconnectCaps("alice", "batch"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+
+		FromServer(quit),
+		ToClient((&irc.Batch{
+			Ref:    "idler1",
+			Type:   irc.BatchNetsplit,
+			Params: []string{"hub.example.net", "leaf.example.net"},
+		}).Start()),
+		ToClient(inBatch("idler1", quit)),
+		FromServer(join),
+		ToClient((&irc.Batch{Ref: "idler1"}).End()),
+		ToClient(join),
+	})
+}
+
+// Clients can page through channels' histories with CHATHISTORY, which
+// includes messages they've seen, and their own, but not events like MODE.
+func TestChatHistory(t *testing.T) {
+	at := func(hour, min int) string {
+		return irc.FormatServerTime(time.Date(2016, 10, 1, hour, min, 0, 0, time.UTC))
+	}
+	privmsg := func(id, when, text string) *irc.Message {
+		return &irc.Message{
+			Tags:    map[string]string{"msgid": id, "time": when},
+			Prefix:  "bob!bob@example.com",
+			Command: "PRIVMSG",
+			Params:  []string{"#sandstorm", text},
+		}
+	}
+	untagged := func(msg *irc.Message) *irc.Message {
+		ret := *msg
+		ret.Tags = nil
+		return &ret
+	}
+	m1 := privmsg("m1", at(11, 1), "one")
+	m2 := privmsg("m2", at(11, 2), "two")
+	own := &irc.Message{
+		Tags: map[string]string{
+			"msgid": fmt.Sprintf("idler-%x-1", testTime.UnixNano()),
+			"time":  irc.FormatServerTime(testTime),
+		},
+		Prefix:  "alice",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "three"},
+	}
+	mode := &irc.Message{Prefix: "bob!bob@example.com", Command: "MODE", Params: []string{"#sandstorm", "+m"}}
+	m4 := privmsg("m4", at(12, 1), "four")
+	pm := func(from, id, when, text string) *irc.Message {
+		return &irc.Message{
+			Tags:    map[string]string{"msgid": id, "time": when},
+			Prefix:  from + "!" + from + "@example.com",
+			Command: "PRIVMSG",
+			Params:  []string{"alice", text},
+		}
+	}
+	pm1 := pm("bob", "p1", at(12, 2), "psst")
+	pm2 := pm("carol", "p2", at(12, 3), "hey")
+	pm3 := pm("bob", "p3", at(12, 4), "how are you?")
+	ownPM := &irc.Message{
+		Tags: map[string]string{
+			"msgid": fmt.Sprintf("idler-%x-3", testTime.UnixNano()),
+			"time":  irc.FormatServerTime(testTime),
+		},
+		Prefix:  "alice",
+		Command: "PRIVMSG",
+		Params:  []string{"bob", "hi"},
+	}
+	// We note when we got the MODE, and give it an id:
+	loggedMode := *mode
+	loggedMode.Tags = map[string]string{
+		"msgid": fmt.Sprintf("idler-%x-2", testTime.UnixNano()),
+		"time":  irc.FormatServerTime(testTime),
+	}
+
+	// Expect a CHATHISTORY reply for `target` in the batch `ref`, with the
+	// messages `msgs`:
+	replyFor := func(target, ref string, msgs ...*irc.Message) ProxyAction {
+		actions := ExpectMany{ToClient((&irc.Batch{
+			Ref:    ref,
+			Type:   irc.BatchChatHistory,
+			Params: []string{target},
+		}).Start())}
+		for _, msg := range msgs {
+			actions = append(actions, ToClient(inBatch(ref, msg)))
+		}
+		return append(actions, ToClient((&irc.Batch{Ref: ref}).End()))
+	}
+	reply := func(ref string, msgs ...*irc.Message) ProxyAction {
+		return replyFor("#sandstorm", ref, msgs...)
+	}
+	chathistory := func(params ...string) ProxyAction {
+		return FromClient(&irc.Message{Command: "CHATHISTORY", Params: params})
+	}
+	fail := func(params ...string) ProxyAction {
+		return ToClient(&irc.Message{Command: "FAIL", Params: append([]string{"CHATHISTORY"}, params...)})
+	}
+
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		FromServer(m1),
+		ToClient(untagged(m1)),
+		FromServer(m2),
+		ToClient(untagged(m2)),
+		ForwardC2S(&irc.Message{Command: "PRIVMSG", Params: own.Params}),
+
+		Disconnect(Client),
+		FromServer(mode),
+		FromServer(m4),
+		FromServer(pm1),
+		FromServer(pm2),
+		reconnectCaps("alice", "batch draft/chathistory message-tags server-time"),
+		ToClient(pm1),
+		ToClient(pm2),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		reply("idler1", &loggedMode, m4),
+
+		chathistory("LATEST", "#sandstorm", "*", "2"),
+		reply("idler2", own, m4),
+		chathistory("BEFORE", "#sandstorm", "msgid=m4", "10"),
+		reply("idler3", m1, m2, own),
+		chathistory("AFTER", "#sandstorm", "timestamp="+at(11, 1), "1"),
+		reply("idler4", m2),
+		chathistory("AROUND", "#sandstorm", "msgid=m2", "3"),
+		reply("idler5", m1, m2, own),
+		chathistory("BETWEEN", "#sandstorm", "msgid=m4", "msgid=m1", "10"),
+		reply("idler6", m2, own),
+		chathistory("LATEST", "#sandstorm", "msgid=m4", "10"),
+		reply("idler7"),
+
+		chathistory("TARGETS", "timestamp="+at(13, 0), "timestamp="+at(11, 0), "10"),
+		ToClient((&irc.Batch{Ref: "idler8", Type: "draft/chathistory-targets"}).Start()),
+		ToClient(inBatch("idler8", &irc.Message{
+			Command: "CHATHISTORY",
+			Params:  []string{"TARGETS", "#sandstorm", at(12, 1)},
+		})),
+		ToClient(inBatch("idler8", &irc.Message{
+			Command: "CHATHISTORY",
+			Params:  []string{"TARGETS", "bob", at(12, 2)},
+		})),
+		ToClient(inBatch("idler8", &irc.Message{
+			Command: "CHATHISTORY",
+			Params:  []string{"TARGETS", "carol", at(12, 3)},
+		})),
+		ToClient((&irc.Batch{Ref: "idler8"}).End()),
+
+		// A nick's history is our private messages with them; those
+		// from them while we were away:
+		chathistory("LATEST", "BOB", "*", "10"),
+		replyFor("BOB", "idler9", pm1),
+		chathistory("BEFORE", "carol", "msgid=p2", "10"),
+		replyFor("carol", "idler10"),
+		// ...and ours to them, and theirs while we're here:
+		ForwardC2S(&irc.Message{Command: "PRIVMSG", Params: ownPM.Params}),
+		ForwardS2C(pm3),
+		chathistory("LATEST", "bob", "*", "10"),
+		replyFor("bob", "idler11", pm1, ownPM, pm3),
+		chathistory("BEFORE", "#sandstorm", "msgid=nope", "10"),
+		fail("INVALID_MSGREFID", "BEFORE", "#sandstorm", "Unknown msgid"),
+		chathistory("AFTER", "#sandstorm", "yesterday", "10"),
+		fail("INVALID_PARAMS", "AFTER", "yesterday", "Invalid message reference"),
+		chathistory("LATEST", "#sandstorm", "*", "0"),
+		fail("INVALID_PARAMS", "LATEST", "0", "Invalid limit"),
+		chathistory("BETWEEN", "#sandstorm", "*", "10"),
+		fail("NEED_MORE_PARAMS", "BETWEEN", "Not enough parameters"),
+	})
+}
+
+// Clients using ZNC's *playback module ask for the messages they missed,
+// rather than having them replayed, but still see who came and went.
+func TestPlayback(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2016, 10, 1, hour, min, 0, 0, time.UTC)
+	}
+	chanMsg := &irc.Message{
+		Tags:    map[string]string{"time": irc.FormatServerTime(at(11, 1))},
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "one"},
+	}
+	privMsg := &irc.Message{
+		Tags:    map[string]string{"time": irc.FormatServerTime(at(11, 3))},
+		Prefix:  "carol!carol@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"alice", "hey"},
+	}
+	join := &irc.Message{Prefix: "dave!dave@example.com", Command: "JOIN", Params: []string{"#sandstorm"}}
+	replayedJoin := *join
+	replayedJoin.Tags = map[string]string{"time": irc.FormatServerTime(testTime)}
+
+	playback := func(text string) ProxyAction {
+		return FromClient(&irc.Message{Command: "PRIVMSG", Params: []string{"*playback", text}})
+	}
+	reply := func(text string) ProxyAction {
+		return ToClient(&irc.Message{Prefix: "*playback", Command: "PRIVMSG", Params: []string{"alice", text}})
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		FromServer(chanMsg),
+		FromServer(join),
+		FromServer(privMsg),
+		reconnectCaps("alice", "server-time znc.in/playback"),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		ToClient(&replayedJoin),
+
+		playback("PLAY * 0"),
+		ToClient(chanMsg),
+		ToClient(privMsg),
+		playback("play #sandstorm " + formatPlaybackTime(at(11, 1))),
+		playback("PLAY carol,#SAND* 1475319600.000"),
+		ToClient(chanMsg),
+		ToClient(privMsg),
+
+		playback("LIST"),
+		reply("#sandstorm " + formatPlaybackTime(at(11, 1))),
+		reply("carol " + formatPlaybackTime(at(11, 3))),
+		playback("LIST dave"),
+		reply("No matching buffers."),
+		// Escapes work as in masks; under rfc1459, the `\` isn't
+		// mistaken for a '|':
+		playback(`LIST \#SAND*`),
+		reply("#sandstorm " + formatPlaybackTime(at(11, 1))),
+		playback("PLAY * yesterday"),
+		reply("Invalid time: yesterday"),
+		playback("CLEAR"),
+		reply("Usage: CLEAR <buffer(s)>"),
+		playback("CLEAR *"),
+		reply("Marked 2 buffer(s) read; their history is kept."),
+	})
+}
+
+// Clients may PLAY before rejoining their channels; they should still get the
+// channels' history, and not have it replayed when they do rejoin.
+func TestPlaybackBeforeJoin(t *testing.T) {
+	chanMsg := &irc.Message{
+		Tags:    map[string]string{"time": "2016-10-01T11:01:00.000Z"},
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "one"},
+	}
+	// Sent after the rejoin, to check that nothing was replayed before it:
+	live := &irc.Message{
+		Prefix:  "bob!bob@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#sandstorm", "two"},
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardC2S(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(true, "alice"),
+		Disconnect(Client),
+		FromServer(chanMsg),
+		reconnectCaps("alice", "server-time znc.in/playback"),
+		FromClient(&irc.Message{Command: "PRIVMSG", Params: []string{"*playback", "PLAY * 0"}}),
+		ToClient(chanMsg),
+		FromClient(&irc.Message{Command: "JOIN", Params: []string{"#sandstorm"}}),
+		joinSeq(false, "alice"),
+		FromServer(live),
+		ToClient(&irc.Message{
+			Tags:    map[string]string{"time": irc.FormatServerTime(testTime)},
+			Prefix:  live.Prefix,
+			Command: "PRIVMSG",
+			Params:  live.Params,
+		}),
+	})
+}
+
+// The server only sends RPL_ISUPPORT once, so we need to replay it for
+// reconnecting clients. We answer CHATHISTORY ourselves, so we advertise that
+// in place of the server's.
+func TestISupportReplay(t *testing.T) {
+	isupport := func(tokens ...string) *irc.Message {
+		params := append([]string{"alice"}, tokens...)
+		return &irc.Message{
+			Command: irc.RPL_ISUPPORT,
+			Params:  append(params, "are supported by this server"),
+		}
+	}
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		FromServer(isupport("CHANTYPES=#", "CHATHISTORY=50", "NICKLEN=30")),
+		ToClient(isupport("CHANTYPES=#", "NICKLEN=30")),
+		ToClient(isupport("CHATHISTORY=100")),
+		ForwardS2C(isupport("CASEMAPPING=ascii")),
+		Disconnect(Client),
+		reconnectISupport("alice",
+			isupport("CHANTYPES=#", "NICKLEN=30", "CASEMAPPING=ascii"),
+			isupport("CHATHISTORY=100"),
+		),
+	})
+}
+
+// The server prepends our full prefix when relaying messages, so a message
+// that fits when we send it may not when others receive it; we need to split
+// it up.
+func TestSplitLongMessage(t *testing.T) {
+	text := strings.Repeat("x", 450)
+	// Per maxPrefixLen, we assume a 81 byte prefix for "alice", leaving
+	// 407 bytes for the text:
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		FromClient(&irc.Message{Command: "PRIVMSG", Params: []string{"#sandstorm", text}}),
+		ToServer(&irc.Message{Command: "PRIVMSG", Params: []string{"#sandstorm", text[:407]}}),
+		ToServer(&irc.Message{Command: "PRIVMSG", Params: []string{"#sandstorm", text[407:]}}),
+	})
+}
@@ -0,0 +1,68 @@
+package proxy
+
+// Tests for SASL authentication to the server.
+
+import (
+	"encoding/base64"
+	"testing"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/irc/sasl"
+)
+
+var saslConfig = &Config{
+	SASL: &sasl.Credentials{
+		Mechanism: "PLAIN",
+		Username:  "alice",
+		Password:  "secret",
+	},
+}
+
+// Capability negotiation up to the point where the server has asked for our
+// credentials, and we've sent them.
+var saslExchange = ExpectMany{
+	Connect(Client),
+	connectServer(),
+	FromServer(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"*", "LS", "server-time sasl=PLAIN,EXTERNAL"},
+	}),
+	ToServer(&irc.Message{Command: "CAP", Params: []string{"REQ", "server-time sasl"}}),
+	FromServer(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"*", "ACK", "server-time sasl"},
+	}),
+	ToServer(&irc.Message{Command: "AUTHENTICATE", Params: []string{"PLAIN"}}),
+	FromServer(&irc.Message{Command: "AUTHENTICATE", Params: []string{"+"}}),
+	ToServer(&irc.Message{Command: "AUTHENTICATE", Params: []string{
+		base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")),
+	}}),
+}
+
+func TestSASLSuccess(t *testing.T) {
+	TraceTestConfig(t, saslConfig, ExpectMany{
+		saslExchange,
+		ForwardS2C(&irc.Message{
+			Command: irc.RPL_LOGGEDIN,
+			Params:  []string{"*", "alice!alice@example.com", "alice", "You are now logged in as alice"},
+		}),
+		ForwardS2C(&irc.Message{
+			Command: irc.RPL_SASLSUCCESS,
+			Params:  []string{"*", "SASL authentication successful"},
+		}),
+		ToServer(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+	})
+}
+
+// On failure, the client should hear about it, and registration should
+// carry on.
+func TestSASLFailure(t *testing.T) {
+	TraceTestConfig(t, saslConfig, ExpectMany{
+		saslExchange,
+		ForwardS2C(&irc.Message{
+			Command: irc.ERR_SASLFAIL,
+			Params:  []string{"*", "SASL authentication failed"},
+		}),
+		ToServer(&irc.Message{Command: "CAP", Params: []string{"END"}}),
+		ForwardC2S(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
+	})
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"strings"
+	"zenhack.net/go/irc-idler/irc"
+)
+
+// A CapSet tracks the IRCv3 capabilities relevant to a connection. It maps
+// capability names to their values (as sent in CAP LS 302); capabilities
+// without a value map to the empty string.
+type CapSet map[string]string
+
+// Return true if the capability `name` is in the set.
+func (cs CapSet) Has(name string) bool {
+	_, ok := cs[name]
+	return ok
+}
+
+// Return the names of the capabilities in the set.
+func (cs CapSet) Names() []string {
+	ret := make([]string, 0, len(cs))
+	for name := range cs {
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// Add the capabilities in `list`, which is formatted as in the final
+// parameter of a CAP LS or CAP NEW message (space separated, with optional
+// values).
+func (cs CapSet) addList(list string) {
+	for _, item := range strings.Fields(list) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 2 {
+			cs[kv[0]] = kv[1]
+		} else {
+			cs[kv[0]] = ""
+		}
+	}
+}
+
+// Remove the capabilities named in the space separated list `list`.
+func (cs CapSet) removeList(list string) {
+	for _, name := range strings.Fields(list) {
+		delete(cs, name)
+	}
+}
+
+// Capabilities state for a connection.
+type Caps struct {
+	// Capabilities the server has advertised.
+	Available CapSet
+
+	// Capabilities which have been enabled.
+	Enabled CapSet
+}
+
+func newCaps() Caps {
+	return Caps{
+		Available: make(CapSet),
+		Enabled:   make(CapSet),
+	}
+}
+
+func (c *Caps) UpdateFromClient(msg *irc.Message) {
+}
+
+func (c *Caps) UpdateFromServer(msg *irc.Message) {
+	if msg.Command != "CAP" || len(msg.Params) < 3 {
+		return
+	}
+	// The list is always the last argument; for multi-line LS replies
+	// there is an extra "*" before it.
+	list := msg.Params[len(msg.Params)-1]
+	switch msg.Params[1] {
+	case "LS", "NEW":
+		c.Available.addList(list)
+	case "DEL":
+		c.Available.removeList(list)
+		c.Enabled.removeList(list)
+	case "ACK":
+		for _, name := range strings.Fields(list) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.Enabled, name[1:])
+			} else {
+				c.Enabled[name] = c.Available[name]
+			}
+		}
+	}
+}
@@ -11,29 +11,48 @@ type AllChannelStates interface {
 	GetChannel(channelName string) *ChannelState
 	HaveChannel(channelName string) bool
 	DeleteChannel(channelName string)
+	ChannelsWithUser(nick string) []string
 }
 
 type mapChannelStates struct {
+	// Keyed by the channel name, folded according to the server's case
+	// mapping.
 	channels map[string]*ChannelState
+
+	isupport *irc.ISupport
 }
 
 // Return true if we're in the channel `channelName`, false otherwise.
 func (s *mapChannelStates) HaveChannel(channelName string) bool {
-	_, ok := s.channels[channelName]
+	_, ok := s.channels[s.isupport.FoldName(channelName)]
 	return ok
 }
 
 // Get the state for channel `channelName`. If we're not already marked as in
 // the channel, this adds the channel to our list and returns a fresh state.
 func (s *mapChannelStates) GetChannel(channelName string) *ChannelState {
-	if !s.HaveChannel(channelName) {
-		s.channels[channelName] = NewChannelState("")
+	key := s.isupport.FoldName(channelName)
+	if _, ok := s.channels[key]; !ok {
+		s.channels[key] = NewChannelState("")
+		s.channels[key].Name = channelName
+		s.channels[key].isupport = s.isupport
+	}
+	return s.channels[key]
+}
+
+// Return the names of the channels which `nick` is in.
+func (s *mapChannelStates) ChannelsWithUser(nick string) []string {
+	ret := []string{}
+	for _, channel := range s.channels {
+		if channel.HaveUser(nick) {
+			ret = append(ret, channel.Name)
+		}
 	}
-	return s.channels[channelName]
+	return ret
 }
 
 func (s *mapChannelStates) DeleteChannel(channelName string) {
-	delete(s.channels, channelName)
+	delete(s.channels, s.isupport.FoldName(channelName))
 }
 
 func (s *mapChannelStates) UpdateFromClient(msg *irc.Message) {
@@ -41,25 +60,48 @@ func (s *mapChannelStates) UpdateFromClient(msg *irc.Message) {
 }
 
 func (s *mapChannelStates) UpdateFromServer(msg *irc.Message) {
-	switch msg.Command {
-	case "KICK", "PART", "JOIN":
-		s.GetChannel(msg.Params[0]).UpdateFromServer(msg)
-	case irc.RPL_TOPIC:
-		channelName, topic := msg.Params[1], msg.Params[2]
-		s.GetChannel(channelName).Topic = topic
-	case irc.RPL_NAMEREPLY:
-		channelName := msg.Params[2]
-		s.GetChannel(channelName).UpdateFromServer(msg)
-	case "NICK", "QUIT":
+	// TODO: report errors somehow.
+	cmd, err := irc.ParseCommand(msg)
+	if err != nil {
+		return
+	}
+	switch cmd := cmd.(type) {
+	case *irc.Join:
+		for _, name := range cmd.Channels {
+			s.GetChannel(name).UpdateFromServer(msg)
+		}
+	case *irc.Part:
+		for _, name := range cmd.Channels {
+			if s.HaveChannel(name) {
+				s.GetChannel(name).UpdateFromServer(msg)
+			}
+		}
+	case *irc.Kick:
+		if s.HaveChannel(cmd.Channel) {
+			s.GetChannel(cmd.Channel).UpdateFromServer(msg)
+		}
+	case *irc.TopicReply:
+		s.GetChannel(cmd.Channel).Topic = cmd.Topic
+	case *irc.Topic:
+		if s.HaveChannel(cmd.Channel) {
+			s.GetChannel(cmd.Channel).Topic = cmd.Topic
+		}
+	case *irc.NamReply:
+		s.GetChannel(cmd.Channel).UpdateFromServer(msg)
+	case *irc.Mode:
+		if s.HaveChannel(cmd.Target) {
+			s.GetChannel(cmd.Target).UpdateFromServer(msg)
+		}
+	case *irc.Nick, *irc.Quit:
 		for _, channel := range s.channels {
 			channel.UpdateFromServer(msg)
 		}
 	}
-
 }
 
 // A ChannelState tracks state for a single channel.
 type ChannelState struct {
+	Name  string // the name of the channel, as first seen.
 	Topic string // the topic for the channel, if any.
 
 	// Users in the channel. If the client is connected, this is
@@ -70,15 +112,22 @@ type ChannelState struct {
 	// for a user who is not in the channel, which might confuse the client.
 	// putting these users in RPL_NAMREPLY and then replaying the log
 	// should get us to the correct final state.
-	users map[string]bool
+	//
+	// Keyed by nick, folded according to the server's case mapping. The
+	// memberships' IDs have the nicks as the server spells them.
+	users map[string]irc.Membership
+
+	// Used to interpret membership prefixes and modes.
+	isupport *irc.ISupport
 }
 
 // NewChannelState creates a new ChannelState with initial topic `topic` and no
 // users present.
 func NewChannelState(topic string) *ChannelState {
 	return &ChannelState{
-		Topic: topic,
-		users: make(map[string]bool),
+		Topic:    topic,
+		users:    make(map[string]irc.Membership),
+		isupport: irc.NewISupport(),
 	}
 }
 
@@ -89,71 +138,115 @@ func (s *ChannelState) UpdateFromClient(msg *irc.Message) {
 // Return a slice of nicks for users in the channel
 func (s *ChannelState) Users() []string {
 	ret := make([]string, 0, len(s.users))
-	for nick := range s.users {
-		ret = append(ret, nick)
+	for _, m := range s.users {
+		ret = append(ret, m.ID.Nick)
+	}
+	return ret
+}
+
+// Return the memberships of the users in the channel.
+func (s *ChannelState) Members() []irc.Membership {
+	ret := make([]irc.Membership, 0, len(s.users))
+	for _, m := range s.users {
+		ret = append(ret, m)
 	}
 	return ret
 }
 
+// Return the membership of the user `nick`, and whether they're in the
+// channel at all.
+func (s *ChannelState) Member(nick string) (irc.Membership, bool) {
+	m, ok := s.users[s.isupport.FoldName(nick)]
+	return m, ok
+}
+
+// Add the user `nick` to the channel, with no membership prefixes. If they're
+// already present, this does nothing.
 func (s *ChannelState) AddUser(nick string) {
-	s.users[nick] = true
+	if !s.HaveUser(nick) {
+		s.AddMember(irc.Membership{ID: irc.ClientID{Nick: nick}})
+	}
+}
+
+// Add a user to the channel, or update their membership if they're already
+// present.
+func (s *ChannelState) AddMember(m irc.Membership) {
+	s.users[s.isupport.FoldName(m.ID.Nick)] = m
 }
 
 func (s *ChannelState) RemoveUser(nick string) {
-	delete(s.users, nick)
+	delete(s.users, s.isupport.FoldName(nick))
 }
 
 func (s *ChannelState) HaveUser(nick string) bool {
-	return s.users[nick]
+	_, ok := s.users[s.isupport.FoldName(nick)]
+	return ok
+}
+
+// Grant (if `add` is true) or revoke the membership prefix `prefix` for the
+// user `nick`.
+func (s *ChannelState) setPrefix(nick string, prefix byte, add bool) {
+	key := s.isupport.FoldName(nick)
+	m, ok := s.users[key]
+	if !ok {
+		return
+	}
+	prefixes := strings.Replace(m.Prefixes, string(prefix), "", -1)
+	if add {
+		prefixes += string(prefix)
+	}
+	m.Prefixes = s.isupport.SortPrefixes(prefixes)
+	s.users[key] = m
 }
 
 func (s *ChannelState) UpdateFromServer(msg *irc.Message) {
-	// TODO: report the errors from ParseClientID somehow.
-	switch msg.Command {
-	case "JOIN":
-		clientID, err := irc.ParseClientID(msg.Prefix)
-		if err != nil {
-			return
-		}
-		s.AddUser(clientID.Nick)
-	case "PART", "KICK", "QUIT":
-		// TODO: we need to specially handle the case were *we* are leaving.
-		clientID, err := irc.ParseClientID(msg.Prefix)
-		if err != nil {
-			return
-		}
-		s.RemoveUser(clientID.Nick)
-	case irc.RPL_NAMEREPLY:
-		// TODO: store this in the state:
-		// mode := msg.Params[1]
-		users := strings.Split(msg.Params[3], " ")
-
-		for _, user := range users {
-
-			user = strings.Trim(user, " \r\n")
-			// XXX: we're accepting full clientIDs + flag here,
-			// but only nick + flag is legal.
-			clientID, err := irc.ParseClientID(user)
-			var nick string
+	// TODO: report the errors from ParseCommand and ParseClientID somehow.
+	cmd, err := irc.ParseCommand(msg)
+	if err != nil {
+		return
+	}
+	switch cmd := cmd.(type) {
+	case *irc.NamReply:
+		for _, user := range cmd.Nicks {
+			m, err := s.isupport.ParseMembership(user)
 			if err != nil {
-				// TODO: report this. our API doesn't give us a clear
-				// way to complain, so we just leave it unparsed,
-				// which is... wrong. nick = user
-			} else {
-				nick = clientID.Nick
+				continue
 			}
-
-			s.AddUser(nick)
+			if old, ok := s.Member(m.ID.Nick); ok && m.ID.Host == "" {
+				// Don't forget what we already know about the user.
+				old.ID.Nick = m.ID.Nick
+				m.ID = old.ID
+			}
+			s.AddMember(m)
 		}
-	case "NICK":
-		newNick := msg.Params[0]
-		clientID, err := irc.ParseClientID(msg.Prefix)
-		if err != nil {
-			return
+		return
+	case *irc.Mode:
+		for _, change := range s.isupport.ParseModeChanges(cmd.Modes, cmd.Args) {
+			if prefix, ok := s.isupport.MembershipPrefix(change.Mode); ok {
+				s.setPrefix(change.Arg, prefix, change.Add)
+			}
 		}
-		if s.HaveUser(clientID.Nick) {
+		return
+	}
+
+	// Everything else is about the user who sent it:
+	clientID, err := irc.ParseClientID(msg.Prefix)
+	if err != nil {
+		return
+	}
+	switch cmd := cmd.(type) {
+	case *irc.Join:
+		s.AddMember(irc.Membership{ID: clientID})
+	case *irc.Part, *irc.Quit:
+		// TODO: we need to specially handle the case were *we* are leaving.
+		s.RemoveUser(clientID.Nick)
+	case *irc.Kick:
+		s.RemoveUser(cmd.Nick)
+	case *irc.Nick:
+		if m, ok := s.Member(clientID.Nick); ok {
 			s.RemoveUser(clientID.Nick)
-			s.AddUser(newNick)
+			m.ID.Nick = cmd.Nick
+			s.AddMember(m)
 		}
 	}
 }
@@ -6,12 +6,18 @@ import (
 
 // State of the initial handshake. The handshake consist of
 //
-// 1. Client sends NICK and USER messages
-// 2. Server does not reject the NICK (if so, client needs to resend)
-// 3. Server sends welcome sequence up through the MOTD.
+// 1. Client sends NICK and USER messages, optionally preceded by CAP LS
+// 2. If the client sent CAP LS, capability negotiation runs until the
+//    client sends CAP END.
+// 3. Server does not reject the NICK (if so, client needs to resend)
+// 4. Server sends welcome sequence up through the MOTD.
 type Handshake struct {
 	haveNick, haveUser bool // The client has sent the NICK/USER mesage.
 
+	// Capability negotiation is in progress; the server will not complete
+	// registration until the client sends CAP END.
+	negotiatingCaps bool
+
 	// The client has received the full MOTD; this is the last thing the
 	// server sends as part of the initial welcome sequence.
 	haveMOTD bool
@@ -19,13 +25,18 @@ type Handshake struct {
 
 // Return true if the handshake is complete, false otherwise.
 func (h Handshake) Done() bool {
-	return h.haveNick && h.haveUser && h.haveMOTD
+	return h.haveNick && h.haveUser && !h.negotiatingCaps && h.haveMOTD
 }
 
 // Return true if the handshake is complete on the client side, but still
 // waiting for (some of) the server's welcome sequence.
 func (h Handshake) WantsWelcome() bool {
-	return h.haveNick && h.haveUser && !h.haveMOTD
+	return h.haveNick && h.haveUser && !h.negotiatingCaps && !h.haveMOTD
+}
+
+// Return true if capability negotiation has started but not yet finished.
+func (h Handshake) NegotiatingCaps() bool {
+	return h.negotiatingCaps
 }
 
 func (h *Handshake) UpdateFromClient(msg *irc.Message) {
@@ -37,6 +48,17 @@ func (h *Handshake) UpdateFromClient(msg *irc.Message) {
 		h.haveUser = true
 	case "NICK":
 		h.haveNick = true
+	case "CAP":
+		if len(msg.Params) == 0 {
+			return
+		}
+		switch msg.Params[0] {
+		case "LS", "REQ":
+			// Per the spec, either of these suspends registration:
+			h.negotiatingCaps = true
+		case "END":
+			h.negotiatingCaps = false
+		}
 	}
 }
 
@@ -50,6 +72,16 @@ func (h *Handshake) UpdateFromServer(msg *irc.Message) {
 		// Server rejected our NICK message, we'll need to send another before
 		// we're done.
 		h.haveNick = false
+	case irc.RPL_WELCOME:
+		// Registration is complete, so any capability negotiation is
+		// over, whether or not CAP END was ever sent (the server may not
+		// support CAP at all).
+		h.negotiatingCaps = false
+	case irc.ERR_UNKNOWNCOMMAND:
+		if len(msg.Params) > 1 && msg.Params[1] == "CAP" {
+			// Server doesn't know about CAP; no negotiation will happen.
+			h.negotiatingCaps = false
+		}
 	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
 		h.haveMOTD = true
 	}
@@ -11,13 +11,25 @@ type Session struct {
 
 	Handshake
 
+	// IRCv3 capabilities advertised and enabled on the connection.
+	Caps Caps
+
+	// Protocol parameters advertised by the server via RPL_ISUPPORT.
+	ISupport *irc.ISupport
+
 	channels AllChannelStates
 }
 
 // Return a newly initialized session
 func NewSession() *Session {
+	isupport := irc.NewISupport()
 	return &Session{
-		channels: &mapChannelStates{make(map[string]*ChannelState)},
+		Caps:     newCaps(),
+		ISupport: isupport,
+		channels: &mapChannelStates{
+			channels: make(map[string]*ChannelState),
+			isupport: isupport,
+		},
 	}
 }
 
@@ -30,7 +42,7 @@ func (s *Session) IsMe(prefix string) bool {
 		// We should probably start using contexts.
 		return false
 	}
-	return clientID.Nick == s.ClientID.Nick
+	return s.ISupport.EqualNames(clientID.Nick, s.ClientID.Nick)
 }
 
 // Return true if we're in the channel `channelName`, false otherwise.
@@ -38,6 +50,11 @@ func (s *Session) HaveChannel(channelName string) bool {
 	return s.channels.HaveChannel(channelName)
 }
 
+// Return the names of the channels we share with the user `nick`.
+func (s *Session) ChannelsWithUser(nick string) []string {
+	return s.channels.ChannelsWithUser(nick)
+}
+
 // Get the state for channel `channelName`. If we're not already marked as in
 // the channel, this adds the channel to our list and returns a fresh state.
 func (s *Session) GetChannel(channelName string) *ChannelState {
@@ -50,17 +67,31 @@ func (s *Session) UpdateFromClient(msg *irc.Message) {
 
 func (s *Session) UpdateFromServer(msg *irc.Message) {
 	s.Handshake.UpdateFromServer(msg)
+	s.Caps.UpdateFromServer(msg)
+	s.ISupport.Update(msg)
 	s.channels.UpdateFromServer(msg)
 
-	if s.IsMe(msg.Prefix) {
-		// The message is about us:
-		switch msg.Command {
-		case "KICK", "PART":
-			// we left a channel
-			s.channels.DeleteChannel(msg.Params[0])
-		case "NICK":
+	cmd, err := irc.ParseCommand(msg)
+	if err != nil {
+		return
+	}
+	switch cmd := cmd.(type) {
+	case *irc.Part:
+		if s.IsMe(cmd.Prefix) {
+			// we left some channels
+			for _, name := range cmd.Channels {
+				s.channels.DeleteChannel(name)
+			}
+		}
+	case *irc.Kick:
+		if s.ISupport.EqualNames(cmd.Nick, s.ClientID.Nick) {
+			// we were kicked from a channel
+			s.channels.DeleteChannel(cmd.Channel)
+		}
+	case *irc.Nick:
+		if s.IsMe(cmd.Prefix) {
 			// we changed our nick
-			s.ClientID.Nick = msg.Params[0]
+			s.ClientID.Nick = cmd.Nick
 		}
 	}
 }
@@ -39,9 +39,13 @@ var (
 	// This is useful for e.g. single stepping in a debugger, as
 	// otherwise the timeout prevents inspecting things.
 	TimeoutLength = 10 * time.Second
+
+	// What the proxy thinks the time is, during tests; see now.
+	testTime = time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
 )
 
 func init() {
+	now = func() time.Time { return testTime }
 	pingTime = TimeoutLength / 10
 	durationEnv := os.Getenv("II_TEST_TIMEOUT")
 	if durationEnv == "" {
@@ -340,6 +344,10 @@ func ManyMsg(convert func(msg *irc.Message) ProxyAction, msgs []*irc.Message) Pr
 }
 
 func StartTestProxy() *ProxyState {
+	return StartTestProxyConfig(nil)
+}
+
+func StartTestProxyConfig(config *Config) *ProxyState {
 	connectRequests := make(chan struct{})
 	connectResponses := make(chan irc.ReadWriteCloser)
 	clientConns := make(chan irc.ReadWriteCloser)
@@ -355,7 +363,8 @@ func StartTestProxy() *ProxyState {
 		logger,
 		ephemeral.NewStore(),
 		clientConns,
-		connector)
+		connector,
+		config)
 	go proxy.Run()
 
 	state := &ProxyState{
@@ -367,7 +376,11 @@ func StartTestProxy() *ProxyState {
 }
 
 func TraceTest(t *testing.T, action ProxyAction) {
-	state := StartTestProxy()
+	TraceTestConfig(t, nil, action)
+}
+
+func TraceTestConfig(t *testing.T, config *Config, action ProxyAction) {
+	state := StartTestProxyConfig(config)
 	err := action.Expect(state, TimeoutLength)
 	if err != nil {
 		t.Fatal(err)
@@ -10,7 +10,7 @@ import (
 func TestUnexpected_RPL_TOPIC(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		Connect(Client),
-		Connect(Server),
+		connectServer(),
 		FromServer(&irc.Message{
 			Command: irc.RPL_TOPIC,
 			Params:  []string{"alice", "#unexpected", "unexpected topic!"},
@@ -24,7 +24,7 @@ func TestUnexpected_RPL_TOPIC(t *testing.T) {
 func TestUnexpected_RPL_NAMEREPLY(t *testing.T) {
 	TraceTest(t, ExpectMany{
 		Connect(Client),
-		Connect(Server),
+		connectServer(),
 		FromServer(&irc.Message{
 			Command: irc.RPL_NAMEREPLY,
 			Params: []string{
@@ -36,3 +36,16 @@ func TestUnexpected_RPL_NAMEREPLY(t *testing.T) {
 		FromClient(&irc.Message{Command: "NICK", Params: []string{"alice"}}),
 	})
 }
+
+// A reply we only pass along shouldn't cost us the connection just because
+// it's shaped differently than we expect.
+func TestUnexpected_MalformedNumeric(t *testing.T) {
+	TraceTest(t, ExpectMany{
+		initialConnect("alice"),
+		ForwardS2C(&irc.Message{
+			Command: irc.RPL_TRACELINK,
+			Params:  []string{"alice", "Link"},
+		}),
+		ForwardC2S(&irc.Message{Command: "PRIVMSG", Params: []string{"bob", "still here"}}),
+	})
+}
@@ -3,6 +3,7 @@ package webui
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -17,6 +18,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"zenhack.net/go/irc-idler/irc/charset"
+	"zenhack.net/go/irc-idler/irc/sasl"
 	grain_capnp "zenhack.net/go/sandstorm/capnp/grain"
 	grain_ctx "zenhack.net/go/sandstorm/grain/context"
 	"zombiezen.com/go/capnproto2"
@@ -28,6 +31,7 @@ var (
 
 	errBadXSRFToken      = errors.New("Bad XSRF Token")
 	errIllegalPortNumber = errors.New("Illegal Port Number (must be non-zero)")
+	errExternalNeedsCert = errors.New("SASL EXTERNAL requires TLS and a client certificate")
 )
 
 // A ServerConfig specifies a server to connect to.
@@ -35,6 +39,46 @@ type ServerConfig struct {
 	Host string // Hostname of the server
 	Port uint16 // TCP port number
 	TLS  bool   // Whether to connect via TLS
+
+	// PEM encoded client certificate and private key to present to the
+	// server, if any. Only used with TLS.
+	ClientCert string
+	ClientKey  string
+
+	// SASL settings. SASLMechanism is empty if SASL is not to be used.
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+
+	// Encoding with which to decode text from the server that isn't valid
+	// UTF-8, e.g. "latin1". If empty, such text is considered garbled.
+	FallbackCharset string
+}
+
+// Charset returns the character encoding to use for the server connection.
+// The FallbackCharset must be valid; see SettingsForm.Validate.
+func (s *ServerConfig) Charset() charset.Charset {
+	if s.FallbackCharset == "" {
+		return charset.UTF8
+	}
+	cs, err := charset.Lookup(s.FallbackCharset)
+	if err != nil {
+		return charset.UTF8
+	}
+	return charset.Fallback(cs)
+}
+
+// SASLCredentials returns the SASL credentials to use, or nil if SASL is not
+// configured.
+func (s *ServerConfig) SASLCredentials() *sasl.Credentials {
+	if s.SASLMechanism == "" {
+		return nil
+	}
+	return &sasl.Credentials{
+		Mechanism: s.SASLMechanism,
+		Username:  s.SASLUsername,
+		Password:  s.SASLPassword,
+	}
 }
 
 func (s *ServerConfig) String() string {
@@ -58,6 +102,12 @@ type SettingsForm struct {
 type templateContext struct {
 	Form        *SettingsForm
 	HaveNetwork bool
+
+	// Choices for the SASL mechanism; "" means don't use SASL.
+	SASLMechanisms []string
+
+	// Choices for the fallback charset; "" means none.
+	FallbackCharsets []string
 }
 
 // Validate the SettingsForm. This both sanity-checks the ServerConfig and
@@ -69,6 +119,26 @@ func (form *SettingsForm) Validate(xsrfKey string) error {
 	if form.Config.Port == 0 {
 		return errIllegalPortNumber
 	}
+	if creds := form.Config.SASLCredentials(); creds != nil {
+		if _, err := creds.NewMechanism(); err != nil {
+			return err
+		}
+		if creds.Mechanism == "EXTERNAL" && (!form.Config.TLS || form.Config.ClientCert == "") {
+			return errExternalNeedsCert
+		}
+	}
+	if form.Config.FallbackCharset != "" {
+		if _, err := charset.Lookup(form.Config.FallbackCharset); err != nil {
+			return err
+		}
+	}
+	if form.Config.ClientCert != "" {
+		if _, err := tls.X509KeyPair(
+			[]byte(form.Config.ClientCert),
+			[]byte(form.Config.ClientKey)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -103,7 +173,9 @@ func NewHandler(ctx context.Context, backend *Backend) (http.Handler, error) {
 				"/proxy-settings",
 			)
 			indexTpl.Execute(w, &templateContext{
-				HaveNetwork: <-backend.HaveNetwork,
+				HaveNetwork:      <-backend.HaveNetwork,
+				SASLMechanisms:   []string{"", "PLAIN", "SCRAM-SHA-256", "EXTERNAL"},
+				FallbackCharsets: []string{"", "latin1", "cp1252", "cp1251"},
 				Form: &SettingsForm{
 					Config:    <-backend.GetServerConfig,
 					XSRFToken: token,
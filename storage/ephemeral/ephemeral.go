@@ -10,15 +10,22 @@ import (
 
 type store struct {
 	// Our store implementation closely mirrors the interface: we have a map
-	// mapping chnanel names to slices of messages. If there are no messages
-	// for a given channel that entry in the map will be nil.
-	channels map[string][]*irc.Message
+	// mapping chnanel names to their messages. If there are no messages
+	// for a given channel there will be no entry in the map.
+	channels map[string]*channel
+}
+
+type channel struct {
+	msgs []*irc.Message
+
+	// Messages are marked read all at once, so the unread messages are
+	// always msgs[unread:].
+	unread int
 }
 
 type channelLog struct {
-	// Pointer to the store. We can't just store the slice itself, since
-	// it may be nil, and if the user calls Clear(), we need to *set it*
-	// to nil.
+	// Pointer to the store. We can't just store the channel itself, since
+	// it may not exist yet.
 	store *store
 
 	// name of the channel
@@ -35,7 +42,7 @@ type cursor struct {
 
 // NewStore returns a new memory-backed Store.
 func NewStore() storage.Store {
-	return &store{channels: make(map[string][]*irc.Message)}
+	return &store{channels: make(map[string]*channel)}
 }
 
 func (s *store) GetChannel(name string) (storage.ChannelLog, error) {
@@ -43,24 +50,94 @@ func (s *store) GetChannel(name string) (storage.ChannelLog, error) {
 }
 
 func (l *channelLog) LogMessage(msg *irc.Message) error {
-	if l.store.channels[l.name] == nil {
-		l.store.channels[l.name] = []*irc.Message{msg}
-	} else {
-		l.store.channels[l.name] = append(l.store.channels[l.name], msg)
+	ch := l.store.channels[l.name]
+	if ch == nil {
+		ch = &channel{}
+		l.store.channels[l.name] = ch
 	}
+	ch.msgs = append(ch.msgs, msg)
 	return nil
 }
 
 func (l *channelLog) Clear() error {
-	delete(l.store.channels, l.name)
+	ch := l.store.channels[l.name]
+	if ch == nil {
+		return nil
+	}
+	ch.unread = len(ch.msgs)
+	if excess := ch.unread - storage.MaxHistory; excess > 0 {
+		// Copy, rather than reslicing, so the old messages can be
+		// garbage collected:
+		ch.msgs = append([]*irc.Message{}, ch.msgs[excess:]...)
+		ch.unread -= excess
+	}
 	return nil
 }
 
 func (l *channelLog) Replay() (storage.LogCursor, error) {
-	if l.store.channels[l.name] == nil {
+	ch := l.store.channels[l.name]
+	if ch == nil || ch.unread == len(ch.msgs) {
 		return storage.EmptyCursor, nil
 	}
-	return &cursor{l.store.channels[l.name], 0}, nil
+	return &cursor{ch.msgs[ch.unread:], 0}, nil
+}
+
+func (l *channelLog) History(query storage.HistoryQuery) ([]*irc.Message, error) {
+	ch := l.store.channels[l.name]
+	if ch == nil {
+		if query.After.MsgID != "" || query.Before.MsgID != "" {
+			return nil, storage.ErrNoSuchMessage
+		}
+		return nil, nil
+	}
+	start, end := 0, len(ch.msgs)
+	if id := query.After.MsgID; id != "" {
+		i := ch.find(id)
+		if i < 0 {
+			return nil, storage.ErrNoSuchMessage
+		}
+		start = i + 1
+	}
+	if id := query.Before.MsgID; id != "" {
+		i := ch.find(id)
+		if i < 0 {
+			return nil, storage.ErrNoSuchMessage
+		}
+		end = i
+	}
+
+	ret := []*irc.Message{}
+	for i := start; i < end; i++ {
+		msg := ch.msgs[i]
+		// Messages without a time aren't selected by time:
+		when, haveTime := msg.Time()
+		if !query.After.Time.IsZero() && !(haveTime && when.After(query.After.Time)) {
+			continue
+		}
+		if !query.Before.Time.IsZero() && !(haveTime && when.Before(query.Before.Time)) {
+			continue
+		}
+		ret = append(ret, msg)
+	}
+	if len(ret) > query.Limit {
+		if query.Latest {
+			ret = ret[len(ret)-query.Limit:]
+		} else {
+			ret = ret[:query.Limit]
+		}
+	}
+	return ret, nil
+}
+
+// Return the index of the message with the msgid tag `id`, or -1 if there's
+// none.
+func (ch *channel) find(id string) int {
+	for i, msg := range ch.msgs {
+		if msg.Tags["msgid"] == id {
+			return i
+		}
+	}
+	return -1
 }
 
 func (c *cursor) Next() {
@@ -8,3 +8,11 @@ import (
 func TestEphemeral(t *testing.T) {
 	stest.RandTest(t, NewStore)
 }
+
+func TestEphemeralHistory(t *testing.T) {
+	stest.HistoryTest(t, NewStore)
+}
+
+func TestEphemeralRetention(t *testing.T) {
+	stest.RetentionTest(t, NewStore)
+}
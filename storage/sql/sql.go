@@ -5,6 +5,7 @@ package sql
 import (
 	"database/sql"
 	"io"
+	"strings"
 	"zenhack.net/go/irc-idler/irc"
 	"zenhack.net/go/irc-idler/storage"
 )
@@ -30,16 +31,17 @@ func NewStore(db *sql.DB) storage.Store {
 	return &store{db: db}
 }
 
+// Columns added to the messages table since it was first defined, which we
+// add to older databases.
+var addedColumns = []string{
+	"msgid VARCHAR(512)",   // The message's msgid tag, if any.
+	"msg_time VARCHAR(32)", // The message's time tag, if valid, as formatted by irc.FormatServerTime.
+	"is_read INTEGER NOT NULL DEFAULT 0",
+}
+
 func (s *store) GetChannel(name string) (storage.ChannelLog, error) {
 	if !s.haveSchema {
-		_, err := s.db.Exec(
-			`CREATE TABLE IF NOT EXISTS messages (
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
-				channel VARCHAR(512) NOT NULL,
-				message VARCHAR(512) NOT NULL
-			)`,
-		)
-		if err != nil {
+		if err := s.createSchema(); err != nil {
 			return nil, err
 		}
 		s.haveSchema = true
@@ -50,17 +52,132 @@ func (s *store) GetChannel(name string) (storage.ChannelLog, error) {
 	}, nil
 }
 
+// Create the tables we need, and bring those from older versions up to date.
+func (s *store) createSchema() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel VARCHAR(512) NOT NULL,
+			message VARCHAR(512) NOT NULL,
+			` + strings.Join(addedColumns, ",\n\t\t\t") + `
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+	for _, column := range addedColumns {
+		name := strings.Fields(column)[0]
+		if _, err := s.db.Exec("SELECT " + name + " FROM messages LIMIT 1"); err == nil {
+			continue
+		}
+		// The table predates the column.
+		if _, err := s.db.Exec("ALTER TABLE messages ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	for _, index := range []string{
+		"messages_channel_id ON messages(channel, id)",
+		"messages_channel_msgid ON messages(channel, msgid)",
+	} {
+		if _, err := s.db.Exec("CREATE INDEX IF NOT EXISTS " + index); err != nil {
+			return err
+		}
+	}
+
+	// One-off changes to the data, which we note once done:
+	_, err = s.db.Exec("CREATE TABLE IF NOT EXISTS migrations (name VARCHAR(64) PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		var done int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM migrations WHERE name = ?", m.name).Scan(&done)
+		if err != nil {
+			return err
+		}
+		if done != 0 {
+			continue
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.run(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO migrations(name) VALUES (?)", m.name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes to the data in older databases, in the order they're made.
+var migrations = []struct {
+	name string
+	run  func(tx *sql.Tx) error
+}{
+	{"fold-channel-names", foldChannelNames},
+}
+
+// Logs used to be keyed by the channel names (or nicks) as given, before the
+// proxy started folding them (see irc.FoldName), so fold the old keys to find
+// them again. We can't know the server's case mapping here, so we use the
+// default, which is what the proxy uses unless the server says otherwise.
+func foldChannelNames(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT DISTINCT channel FROM messages")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		folded := irc.FoldName(irc.CaseMappingRFC1459, name)
+		if folded == name {
+			continue
+		}
+		_, err := tx.Exec("UPDATE messages SET channel = ? WHERE channel = ?", folded, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *channelLog) LogMessage(msg *irc.Message) error {
+	var msgid, msgTime interface{}
+	if id, ok := msg.Tags["msgid"]; ok {
+		msgid = id
+	}
+	if when, ok := msg.Time(); ok {
+		msgTime = irc.FormatServerTime(when)
+	}
 	_, err := l.db.Exec(
-		"INSERT INTO messages(channel, message) VALUES (?, ?)",
-		l.name, msg.String(),
+		"INSERT INTO messages(channel, message, msgid, msg_time) VALUES (?, ?, ?, ?)",
+		l.name, msg.String(), msgid, msgTime,
 	)
 	return err
 }
 
 func (l *channelLog) Replay() (storage.LogCursor, error) {
 	rows, err := l.db.Query(
-		"SELECT message FROM messages WHERE channel = ? ORDER BY id",
+		"SELECT message FROM messages WHERE channel = ? AND is_read = 0 ORDER BY id",
 		l.name)
 	if err != nil {
 		return nil, err
@@ -75,10 +192,86 @@ func (l *channelLog) Replay() (storage.LogCursor, error) {
 }
 
 func (l *channelLog) Clear() error {
-	_, err := l.db.Exec("DELETE FROM messages WHERE channel = ?", l.name)
+	_, err := l.db.Exec(
+		"UPDATE messages SET is_read = 1 WHERE channel = ? AND is_read = 0",
+		l.name)
+	if err != nil {
+		return err
+	}
+	// Everything is read now, so this keeps the latest MaxHistory
+	// messages. If there are fewer, the subquery is NULL, and nothing
+	// matches.
+	_, err = l.db.Exec(
+		`DELETE FROM messages WHERE channel = ? AND id <= (
+			SELECT id FROM messages WHERE channel = ?
+			ORDER BY id DESC LIMIT 1 OFFSET ?
+		)`,
+		l.name, l.name, storage.MaxHistory)
 	return err
 }
 
+func (l *channelLog) History(query storage.HistoryQuery) ([]*irc.Message, error) {
+	where := []string{"channel = ?"}
+	args := []interface{}{l.name}
+	for _, bound := range []struct {
+		anchor storage.Anchor
+		op     string
+	}{{query.After, ">"}, {query.Before, "<"}} {
+		if id := bound.anchor.MsgID; id != "" {
+			var rowID int64
+			err := l.db.QueryRow(
+				"SELECT id FROM messages WHERE channel = ? AND msgid = ?",
+				l.name, id,
+			).Scan(&rowID)
+			if err == sql.ErrNoRows {
+				return nil, storage.ErrNoSuchMessage
+			} else if err != nil {
+				return nil, err
+			}
+			where = append(where, "id "+bound.op+" ?")
+			args = append(args, rowID)
+		}
+		if t := bound.anchor.Time; !t.IsZero() {
+			where = append(where, "msg_time "+bound.op+" ?")
+			args = append(args, irc.FormatServerTime(t))
+		}
+	}
+	order := "ASC"
+	if query.Latest {
+		order = "DESC"
+	}
+	rows, err := l.db.Query(
+		"SELECT message FROM messages WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY id "+order+" LIMIT ?",
+		append(args, query.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []*irc.Message{}
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, err
+		}
+		msg, err := irc.ParseMessage(str)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if query.Latest {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+	}
+	return ret, nil
+}
+
 func (c *cursor) Get() (*irc.Message, error) {
 	return c.msg, c.err
 }
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"testing"
+	"zenhack.net/go/irc-idler/irc"
 	"zenhack.net/go/irc-idler/storage"
 	stest "zenhack.net/go/irc-idler/storage/testing"
 )
@@ -32,3 +33,101 @@ func TestStore(t *testing.T) {
 		return NewStore(db)
 	})
 }
+
+func TestHistory(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stest.HistoryTest(t, func() storage.Store { return NewStore(db) })
+}
+
+func TestRetention(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stest.RetentionTest(t, func() storage.Store { return NewStore(db) })
+}
+
+// Databases created before we kept a history should get the new columns,
+// and keep their messages, which were logged under the channel's name as
+// given, rather than folded.
+func TestUpgrade(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(
+		`CREATE TABLE messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel VARCHAR(512) NOT NULL,
+			message VARCHAR(512) NOT NULL
+		)`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO messages(channel, message) VALUES ('#Chan', 'PRIVMSG #Chan :old')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := NewStore(db).GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.LogMessage(&irc.Message{Command: "PRIVMSG", Params: []string{"#chan", "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := log.History(storage.HistoryQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Params[1] != "old" || msgs[1].Params[1] != "new" {
+		t.Fatalf("Unexpected history: %q", msgs)
+	}
+}
+
+// A database may have some of the added columns but not others, e.g. from a
+// version in between; it should get the rest.
+func TestPartialUpgrade(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(
+		`CREATE TABLE messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel VARCHAR(512) NOT NULL,
+			message VARCHAR(512) NOT NULL,
+			msgid VARCHAR(512)
+		)`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := NewStore(db).GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &irc.Message{
+		Tags:    map[string]string{"msgid": "m1", "time": "2016-10-01T12:00:00.000Z"},
+		Command: "PRIVMSG",
+		Params:  []string{"#chan", "hi"},
+	}
+	if err := log.LogMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := log.History(storage.HistoryQuery{After: storage.Anchor{MsgID: "m1"}, Limit: 10})
+	if err != nil || len(msgs) != 0 {
+		t.Fatalf("Unexpected history: (%q, %v)", msgs, err)
+	}
+}
@@ -12,7 +12,9 @@
 package storage
 
 import (
+	"errors"
 	"io"
+	"time"
 	"zenhack.net/go/irc-idler/irc"
 )
 
@@ -20,8 +22,16 @@ var (
 	// EmptyCursor is an "empty" cursor, whose Get() method always
 	// returns (nil, io.EOF). Its Close() returns nil and does nothing.
 	EmptyCursor LogCursor = emptyCursor{}
+
+	// ErrNoSuchMessage is returned by ChannelLog.History if an Anchor
+	// names a message which isn't in the log.
+	ErrNoSuchMessage = errors.New("No such message")
 )
 
+// The most read messages a ChannelLog need keep. Clear may forget the oldest
+// read messages past this, so that logs don't grow without bound.
+const MaxHistory = 1000
+
 // A Store is a data store for logged messages
 type Store interface {
 	// Get a ChannelLog for the named channel
@@ -29,16 +39,55 @@ type Store interface {
 }
 
 // A ChannelLog is a (sequential) log for a particular channel.
+//
+// Each message in the log is either unread or read. New messages are unread,
+// and Replay returns those; Clear marks them read. The log's history (see
+// History) includes both.
 type ChannelLog interface {
 
-	// Append a message to the end of log.
+	// Append a message to the end of log, unread. The message's tags must
+	// be preserved; in particular, the proxy records when each message was
+	// received in its time tag (see irc.Message.Time), and gives each one a
+	// msgid tag, by which History's Anchors may refer to it.
 	LogMessage(msg *irc.Message) error
 
-	// Replay the log. Returns a cursor pointing at the first message in the log
+	// Replay the log. Returns a cursor pointing at the first unread message
+	// in the log.
 	Replay() (LogCursor, error)
 
-	// Delete all of the messages in the log
+	// Mark all of the messages in the log as read, forgetting the oldest
+	// past MaxHistory.
 	Clear() error
+
+	// Return the messages in the log which match `query`, in the order they
+	// were logged.
+	History(query HistoryQuery) ([]*irc.Message, error)
+}
+
+// An Anchor identifies a point in a log's history: either a message, by its
+// msgid tag, or a time, per messages' time tags. The zero Anchor identifies
+// nothing.
+type Anchor struct {
+	MsgID string
+	Time  time.Time
+}
+
+// IsZero returns true if `a` is the zero Anchor.
+func (a Anchor) IsZero() bool {
+	return a.MsgID == "" && a.Time.IsZero()
+}
+
+// A HistoryQuery selects messages from a log's history.
+type HistoryQuery struct {
+	// Only messages logged after After (if it's a message), or whose time
+	// tags are later than it (if it's a time), are selected; likewise for
+	// those before Before. A zero Anchor doesn't restrict the selection.
+	After, Before Anchor
+
+	// The maximum number of messages to return. If more are selected,
+	// the first Limit are returned, or the last if Latest is true.
+	Limit  int
+	Latest bool
 }
 
 // A LogCursor is a cursor into a ChannelLog.
@@ -0,0 +1,126 @@
+package testing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"zenhack.net/go/irc-idler/irc"
+	"zenhack.net/go/irc-idler/storage"
+)
+
+// HistoryTest checks that a store's logs select the right messages from their
+// histories, per the anchors and limits of the queries. If any of the checks
+// are unsuccessful, HistoryTest calls t.Fatal.
+//
+// The function newStore should return a new (empty) store to test.
+func HistoryTest(t *testing.T, newStore func() storage.Store) {
+	start := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	log, err := newStore().GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages "0" through "9", a minute apart, with msgids "id0" through
+	// "id9". The first five are read.
+	for i := 0; i < 10; i++ {
+		err := log.LogMessage(&irc.Message{
+			Tags: map[string]string{
+				"msgid": fmt.Sprint("id", i),
+				"time":  irc.FormatServerTime(start.Add(time.Duration(i) * time.Minute)),
+			},
+			Command: "PRIVMSG",
+			Params:  []string{"#chan", fmt.Sprint(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 4 {
+			if err := log.Clear(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	msgid := func(i int) storage.Anchor {
+		return storage.Anchor{MsgID: fmt.Sprint("id", i)}
+	}
+	at := func(i int) storage.Anchor {
+		return storage.Anchor{Time: start.Add(time.Duration(i) * time.Minute)}
+	}
+
+	cases := []struct {
+		query    storage.HistoryQuery
+		expected string // The texts of the messages, concatenated.
+	}{
+		{storage.HistoryQuery{Limit: 100}, "0123456789"},
+		{storage.HistoryQuery{Limit: 3}, "012"},
+		{storage.HistoryQuery{Limit: 3, Latest: true}, "789"},
+		{storage.HistoryQuery{After: msgid(2), Limit: 3}, "345"},
+		{storage.HistoryQuery{After: at(2), Limit: 3}, "345"},
+		{storage.HistoryQuery{Before: msgid(6), Limit: 2, Latest: true}, "45"},
+		{storage.HistoryQuery{Before: at(6), Limit: 2}, "01"},
+		{storage.HistoryQuery{After: msgid(1), Before: at(5), Limit: 100}, "234"},
+		{storage.HistoryQuery{After: at(8), Before: msgid(3), Limit: 100}, ""},
+		{storage.HistoryQuery{After: at(9), Limit: 100}, ""},
+	}
+	for _, c := range cases {
+		msgs, err := log.History(c.query)
+		if err != nil {
+			t.Fatalf("History(%+v): %v", c.query, err)
+		}
+		actual := ""
+		for _, msg := range msgs {
+			actual += msg.Params[1]
+		}
+		if actual != c.expected {
+			t.Fatalf("History(%+v): expected messages %q, but got %q.",
+				c.query, c.expected, actual)
+		}
+	}
+
+	_, err = log.History(storage.HistoryQuery{After: msgid(10), Limit: 100})
+	if err != storage.ErrNoSuchMessage {
+		t.Fatalf("Expected ErrNoSuchMessage for an unknown msgid, but got %v.", err)
+	}
+
+	// Replay only sees the unread messages:
+	cursor, err := log.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close()
+	if msg, err := cursor.Get(); err != nil || msg.Params[1] != "5" {
+		t.Fatalf("Expected replay to start at message 5, but got (%q, %v).", msg, err)
+	}
+}
+
+// RetentionTest checks that a store's logs keep the latest storage.MaxHistory
+// read messages, and no more, once cleared. If any of the checks are
+// unsuccessful, RetentionTest calls t.Fatal.
+//
+// The function newStore should return a new (empty) store to test.
+func RetentionTest(t *testing.T, newStore func() storage.Store) {
+	log, err := newStore().GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := storage.MaxHistory + 5
+	for i := 0; i < total; i++ {
+		err := log.LogMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"#chan", fmt.Sprint(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := log.History(storage.HistoryQuery{Limit: total})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != storage.MaxHistory || msgs[0].Params[1] != "5" {
+		t.Fatalf("Expected messages 5 through %d, but got %d messages, starting with %q.",
+			total-1, len(msgs), msgs[0])
+	}
+}
@@ -20,7 +20,8 @@ import (
 //
 // * Insert random values into the logs
 // * Verify that reading back those values succeeds
-// * Clear the logs and verify that they are actually empty.
+// * Clear the logs and verify that they are actually empty, but that the
+//   values are still in their history.
 //
 // If any of the checks are unsuccessful, RandTest calls t.Fatal
 //
@@ -58,7 +59,7 @@ func fillStore(m map[string][]*irc.Message, store storage.Store) {
 }
 
 func checkClear(m map[string][]*irc.Message, store storage.Store) bool {
-	for k := range m {
+	for k, v := range m {
 		log, _ := store.GetChannel(k)
 		log.Clear()
 		cursor, _ := log.Replay()
@@ -70,6 +71,25 @@ func checkClear(m map[string][]*irc.Message, store storage.Store) bool {
 			return false
 		}
 		cursor.Close()
+
+		history, err := log.History(storage.HistoryQuery{Limit: len(v)})
+		if err != nil {
+			fmt.Printf("Getting history for channel %q: %q\n", k, err)
+			return false
+		}
+		if len(history) != len(v) {
+			fmt.Printf("Expected %d messages in the history for channel %q, "+
+				"but got %d.\n", len(v), k, len(history))
+			return false
+		}
+		for i, msg := range v {
+			if history[i].String() != msg.String() {
+				fmt.Printf(
+					"Mismatch at position %d in history for channel %q: "+
+						"expected %q but got %q.\n", i, k, msg, history[i])
+				return false
+			}
+		}
 	}
 	return true
 }